@@ -0,0 +1,109 @@
+package elchi
+
+import (
+	"math/rand/v2"
+
+	"github.com/miekg/dns"
+)
+
+// Answer ordering policies for the answer_order directive.
+const (
+	answerOrderFixed      = "fixed"       // Snapshot order, the same for every query
+	answerOrderRandom     = "random"      // Shuffled on every query
+	answerOrderRoundRobin = "round_robin" // Rotated by one position per query, per record
+)
+
+// defaultWeightedAnswers is the number of RRs returned for a weighted record
+// when no max_answers limit applies. A single answer per query makes the
+// traffic split follow the weights exactly.
+const defaultWeightedAnswers = 1
+
+// selectAnswer returns the RRs of the set to put in the answer section.
+// Unweighted sets are ordered by the answer_order policy and cut to the
+// max_answers limit. Weighted sets are sampled by weight, which already
+// randomizes the order. The result is always a fresh slice, the cached set
+// is never reordered.
+func (e *Elchi) selectAnswer(set *rrSet) []dns.RR {
+	limit := set.maxAnswers
+	if limit == 0 {
+		limit = e.MaxAnswers
+	}
+
+	total := len(set.rrs)
+	if set.weights != nil {
+		n := defaultWeightedAnswers
+		if limit > 0 {
+			n = limit
+		}
+		n = min(n, total)
+		return set.pickWeighted(make([]dns.RR, 0, n), n)
+	}
+
+	n := total
+	if limit > 0 && limit < total {
+		n = limit
+	}
+
+	switch e.AnswerOrder {
+	case answerOrderRandom:
+		rrs := make([]dns.RR, total)
+		copy(rrs, set.rrs)
+		// Partial Fisher-Yates shuffle, only the first n positions are needed
+		for i := 0; i < n && i < total-1; i++ {
+			j := i + rand.IntN(total-i) //nolint:gosec // Load balancing does not need a CSPRNG
+			rrs[i], rrs[j] = rrs[j], rrs[i]
+		}
+		return rrs[:n]
+	case answerOrderRoundRobin:
+		rrs := make([]dns.RR, n)
+		start := int((set.next.Add(1) - 1) % uint32(total)) //nolint:gosec // RR sets are small
+		for i := range rrs {
+			rrs[i] = set.rrs[(start+i)%total]
+		}
+		return rrs
+	default:
+		rrs := make([]dns.RR, n)
+		copy(rrs, set.rrs)
+		return rrs
+	}
+}
+
+// pickWeighted appends n RRs drawn at random without replacement to dst.
+// Each draw picks an RR with probability proportional to its weight.
+func (s *rrSet) pickWeighted(dst []dns.RR, n int) []dns.RR {
+	if n <= 0 {
+		return dst
+	}
+	if n == 1 {
+		// Fast path, no bookkeeping for already picked RRs
+		return append(dst, s.rrs[s.drawWeighted(s.totalWeight, nil)])
+	}
+
+	picked := make([]bool, len(s.rrs))
+	remaining := s.totalWeight
+	for ; n > 0 && remaining > 0; n-- {
+		i := s.drawWeighted(remaining, picked)
+		picked[i] = true
+		remaining -= uint64(s.weights[i])
+		dst = append(dst, s.rrs[i])
+	}
+	return dst
+}
+
+// drawWeighted returns the index of a randomly drawn RR among those not yet
+// picked. total must be the sum of the weights of the RRs not yet picked.
+func (s *rrSet) drawWeighted(total uint64, picked []bool) int {
+	r := rand.Uint64N(total) //nolint:gosec // Load balancing does not need a CSPRNG
+	last := 0
+	for i, w := range s.weights {
+		if picked != nil && picked[i] {
+			continue
+		}
+		if r < uint64(w) {
+			return i
+		}
+		r -= uint64(w)
+		last = i
+	}
+	return last
+}
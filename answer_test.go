@@ -0,0 +1,340 @@
+package elchi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newWeightedSet builds an RR set from a weighted A record.
+func newWeightedSet(t *testing.T, endpoints ...Endpoint) *rrSet {
+	t.Helper()
+	set, err := buildRRSet(DNSRecord{
+		Name:      "weighted.gslb.elchi",
+		Type:      "A",
+		Endpoints: endpoints,
+	}, 300)
+	if err != nil {
+		t.Fatalf("buildRRSet failed: %v", err)
+	}
+	return set
+}
+
+func TestSelectAnswer_Unweighted(t *testing.T) {
+	set, err := buildRRSet(DNSRecord{
+		Name: "plain.gslb.elchi",
+		Type: "A",
+		IPs:  []string{"192.168.1.10", "192.168.1.11"},
+	}, 300)
+	if err != nil {
+		t.Fatalf("buildRRSet failed: %v", err)
+	}
+
+	e := &Elchi{}
+	rrs := e.selectAnswer(set)
+	if len(rrs) != 2 {
+		t.Fatalf("Expected all 2 RRs for unweighted record, got %d", len(rrs))
+	}
+}
+
+func TestSelectAnswer_WeightedDistribution(t *testing.T) {
+	set := newWeightedSet(t,
+		Endpoint{IP: "192.168.1.10", Weight: 80},
+		Endpoint{IP: "192.168.2.10", Weight: 20},
+	)
+
+	e := &Elchi{}
+	counts := make(map[string]int)
+	const draws = 10000
+	for i := 0; i < draws; i++ {
+		rrs := e.selectAnswer(set)
+		if len(rrs) != 1 {
+			t.Fatalf("Expected 1 RR for weighted record, got %d", len(rrs))
+		}
+		counts[rrIP(rrs[0])]++
+	}
+
+	// 80/20 split with a generous tolerance to keep the test stable
+	share := float64(counts["192.168.1.10"]) / draws
+	if share < 0.75 || share > 0.85 {
+		t.Errorf("Expected ~80%% of answers for 192.168.1.10, got %.1f%%", share*100)
+	}
+}
+
+func TestPickWeighted_NoDuplicates(t *testing.T) {
+	set := newWeightedSet(t,
+		Endpoint{IP: "192.168.1.10", Weight: 100},
+		Endpoint{IP: "192.168.1.11", Weight: 1},
+		Endpoint{IP: "192.168.1.12", Weight: 1},
+	)
+
+	for i := 0; i < 100; i++ {
+		rrs := set.pickWeighted(nil, 3)
+		if len(rrs) != 3 {
+			t.Fatalf("Expected 3 RRs, got %d", len(rrs))
+		}
+		seen := make(map[string]bool)
+		for _, rr := range rrs {
+			if seen[rrIP(rr)] {
+				t.Fatalf("Duplicate RR %s in weighted sample", rrIP(rr))
+			}
+			seen[rrIP(rr)] = true
+		}
+	}
+}
+
+func TestPickWeighted_LargeWeights(t *testing.T) {
+	// The weights sum to 1<<32, which does not fit a uint32
+	set := newWeightedSet(t,
+		Endpoint{IP: "192.168.1.10", Weight: 1 << 31},
+		Endpoint{IP: "192.168.1.11", Weight: 1 << 31},
+	)
+	if set.totalWeight != 1<<32 {
+		t.Fatalf("Expected total weight %d, got %d", uint64(1<<32), set.totalWeight)
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		rrs := set.pickWeighted(nil, 1)
+		if len(rrs) != 1 {
+			t.Fatalf("Expected 1 RR, got %d", len(rrs))
+		}
+		seen[rrIP(rrs[0])]++
+	}
+	if seen["192.168.1.10"] < 400 || seen["192.168.1.11"] < 400 {
+		t.Errorf("Expected an even split for equal weights, got %v", seen)
+	}
+	if rrs := set.pickWeighted(nil, 2); len(rrs) != 2 {
+		t.Errorf("Expected both RRs, got %d", len(rrs))
+	}
+}
+
+func TestBuildRRSet_DefaultWeight(t *testing.T) {
+	// An endpoint without weight gets weight 1 once any endpoint is weighted
+	set := newWeightedSet(t,
+		Endpoint{IP: "192.168.1.10", Weight: 3},
+		Endpoint{IP: "192.168.1.11"},
+	)
+
+	if set.totalWeight != 4 {
+		t.Errorf("Expected total weight 4, got %d", set.totalWeight)
+	}
+	if set.weight(1) != 1 {
+		t.Errorf("Expected default weight 1, got %d", set.weight(1))
+	}
+}
+
+func TestServeDNS_WeightedWithRegions(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, clientRegions: &clientRegionTable{}}
+	if err := e.clientRegions.add("avrupa", "10.20.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "geo1",
+		Records: []DNSRecord{
+			{
+				Name: "mixed.gslb.elchi",
+				Type: "A",
+				Endpoints: []Endpoint{
+					{IP: "192.168.1.10", Weight: 50, Region: "asya"},
+					{IP: "192.168.1.11", Weight: 50, Region: "asya"},
+					{IP: "192.168.2.10", Weight: 100, Region: "avrupa"},
+				},
+			},
+		},
+	}, 300)
+
+	// An avrupa client only ever sees the avrupa endpoint
+	for i := 0; i < 20; i++ {
+		rec := &testResponseWriter{}
+		if _, err := e.ServeDNS(context.Background(), rec, newECSQuery("mixed.gslb.elchi.", "10.20.5.0", 24)); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		if len(rec.msg.Answer) != 1 {
+			t.Fatalf("Expected 1 answer, got %d", len(rec.msg.Answer))
+		}
+		if a := rec.msg.Answer[0].(*dns.A); a.A.String() != "192.168.2.10" {
+			t.Errorf("Expected 192.168.2.10 for avrupa client, got %s", a.A.String())
+		}
+	}
+}
+
+// newOrderedSet builds an unweighted RR set with three A records.
+func newOrderedSet(t *testing.T) *rrSet {
+	t.Helper()
+	set, err := buildRRSet(DNSRecord{
+		Name: "ordered.gslb.elchi",
+		Type: "A",
+		IPs:  []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"},
+	}, 300)
+	if err != nil {
+		t.Fatalf("buildRRSet failed: %v", err)
+	}
+	return set
+}
+
+func TestSelectAnswer_Fixed(t *testing.T) {
+	set := newOrderedSet(t)
+	e := &Elchi{AnswerOrder: answerOrderFixed}
+
+	for i := 0; i < 3; i++ {
+		if ip := rrIP(e.selectAnswer(set)[0]); ip != "192.168.1.10" {
+			t.Errorf("Query %d: expected first answer 192.168.1.10, got %s", i, ip)
+		}
+	}
+}
+
+func TestSelectAnswer_RoundRobin(t *testing.T) {
+	set := newOrderedSet(t)
+	e := &Elchi{AnswerOrder: answerOrderRoundRobin}
+
+	want := []string{"192.168.1.10", "192.168.1.11", "192.168.1.12", "192.168.1.10"}
+	for i, first := range want {
+		rrs := e.selectAnswer(set)
+		if len(rrs) != 3 {
+			t.Fatalf("Expected 3 RRs, got %d", len(rrs))
+		}
+		if ip := rrIP(rrs[0]); ip != first {
+			t.Errorf("Query %d: expected first answer %s, got %s", i, first, ip)
+		}
+	}
+
+	// The cached set itself must keep its snapshot order
+	if ip := rrIP(set.rrs[0]); ip != "192.168.1.10" {
+		t.Errorf("Cached set was reordered, first RR is %s", ip)
+	}
+}
+
+func TestSelectAnswer_Random(t *testing.T) {
+	set := newOrderedSet(t)
+	e := &Elchi{AnswerOrder: answerOrderRandom}
+
+	firsts := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		rrs := e.selectAnswer(set)
+		if len(rrs) != 3 {
+			t.Fatalf("Expected 3 RRs, got %d", len(rrs))
+		}
+		firsts[rrIP(rrs[0])] = true
+	}
+	if len(firsts) != 3 {
+		t.Errorf("Expected every IP to come first at least once, got %v", firsts)
+	}
+}
+
+func BenchmarkSelectAnswer(b *testing.B) {
+	set, _ := buildRRSet(DNSRecord{
+		Name: "bench.gslb.elchi",
+		Type: "A",
+		IPs:  []string{"192.168.1.10", "192.168.1.11", "192.168.1.12", "192.168.1.13"},
+	}, 300)
+
+	for _, order := range []string{answerOrderFixed, answerOrderRandom, answerOrderRoundRobin} {
+		b.Run(order, func(b *testing.B) {
+			e := &Elchi{AnswerOrder: order}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = e.selectAnswer(set)
+			}
+		})
+	}
+}
+
+func TestSelectAnswer_MaxAnswers(t *testing.T) {
+	tests := []struct {
+		order string
+		want  []string // expected answers of the first query (nil = any)
+	}{
+		{answerOrderFixed, []string{"192.168.1.10", "192.168.1.11"}},
+		{answerOrderRoundRobin, []string{"192.168.1.10", "192.168.1.11"}},
+		{answerOrderRandom, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			set := newOrderedSet(t)
+			e := &Elchi{AnswerOrder: tt.order, MaxAnswers: 2}
+
+			rrs := e.selectAnswer(set)
+			if len(rrs) != 2 {
+				t.Fatalf("Expected 2 RRs, got %d", len(rrs))
+			}
+			if rrIP(rrs[0]) == rrIP(rrs[1]) {
+				t.Errorf("Duplicate RR %s in answer", rrIP(rrs[0]))
+			}
+			for i, ip := range tt.want {
+				if got := rrIP(rrs[i]); got != ip {
+					t.Errorf("Answer %d: expected %s, got %s", i, ip, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectAnswer_MaxAnswersRoundRobinWraps(t *testing.T) {
+	set := newOrderedSet(t)
+	e := &Elchi{AnswerOrder: answerOrderRoundRobin, MaxAnswers: 2}
+
+	e.selectAnswer(set)
+	e.selectAnswer(set)
+	rrs := e.selectAnswer(set) // third query starts at the last IP
+
+	if rrIP(rrs[0]) != "192.168.1.12" || rrIP(rrs[1]) != "192.168.1.10" {
+		t.Errorf("Expected [192.168.1.12 192.168.1.10], got [%s %s]", rrIP(rrs[0]), rrIP(rrs[1]))
+	}
+}
+
+func TestSelectAnswer_PerRecordMaxAnswers(t *testing.T) {
+	set, err := buildRRSet(DNSRecord{
+		Name:       "capped.gslb.elchi",
+		Type:       "A",
+		IPs:        []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"},
+		MaxAnswers: 1,
+	}, 300)
+	if err != nil {
+		t.Fatalf("buildRRSet failed: %v", err)
+	}
+
+	// The record limit overrides the directive
+	e := &Elchi{MaxAnswers: 2}
+	if rrs := e.selectAnswer(set); len(rrs) != 1 {
+		t.Errorf("Expected 1 RR from per-record limit, got %d", len(rrs))
+	}
+}
+
+func TestSelectAnswer_WeightedMaxAnswers(t *testing.T) {
+	set := newWeightedSet(t,
+		Endpoint{IP: "192.168.1.10", Weight: 80},
+		Endpoint{IP: "192.168.1.11", Weight: 10},
+		Endpoint{IP: "192.168.1.12", Weight: 10},
+	)
+
+	// max_answers raises the number of weighted picks
+	e := &Elchi{MaxAnswers: 2}
+	if rrs := e.selectAnswer(set); len(rrs) != 2 {
+		t.Errorf("Expected 2 weighted RRs, got %d", len(rrs))
+	}
+}
+
+func TestServeDNS_MaxAnswersKeepsFullPool(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, MaxAnswers: 1}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.Update([]DNSRecord{{
+		Name: "pool.gslb.elchi",
+		Type: "A",
+		IPs:  []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"},
+	}}, 300)
+
+	if msg := query(t, e, "pool.gslb.elchi.", dns.TypeA); len(msg.Answer) != 1 {
+		t.Errorf("Expected 1 answer, got %d", len(msg.Answer))
+	}
+
+	// /records still reports the whole pool
+	records := e.cache.GetAllRecords()
+	if len(records) != 1 || len(records[0].IPs) != 3 {
+		t.Errorf("Expected full pool of 3 IPs in records, got %+v", records)
+	}
+}
@@ -0,0 +1,187 @@
+package elchi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication modes.
+const (
+	authHMAC   = "hmac"   // HMAC-SHA256 signatures only
+	authCompat = "compat" // Send signatures, accept either (migration from the legacy header)
+	authLegacy = "legacy" // Plain shared secret in X-Elchi-Secret only
+)
+
+// Authentication headers.
+const (
+	headerSecret    = "X-Elchi-Secret"    // Legacy plain shared secret
+	headerTimestamp = "X-Elchi-Timestamp" // Unix time in seconds the request was signed at
+	headerNonce     = "X-Elchi-Nonce"     // Random value, unique per request
+	headerSignature = "X-Elchi-Signature" // Hex HMAC-SHA256 of the canonical request
+)
+
+const (
+	defaultAuthSkew = 5 * time.Minute // Accepted clock difference between signer and verifier
+	maxSignedBody   = 32 << 20        // Largest request body read for verification
+	nonceSweepSize  = 1024            // Smallest nonce cache size that triggers a sweep of expired nonces
+)
+
+// signRequestHMAC signs a request with the shared secret: the timestamp,
+// nonce and signature headers are set from the canonical request.
+func signRequestHMAC(req *http.Request, secret string, body []byte, now time.Time) {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonceHex)
+	req.Header.Set(headerSignature, signature(secret, req.Method, req.URL, body, timestamp, nonceHex))
+}
+
+// signature returns the hex HMAC-SHA256 of the canonical request: method,
+// escaped path, sorted query, hex SHA-256 of the body, timestamp and nonce,
+// each on its own line.
+func signature(secret, method string, u *url.URL, body []byte, timestamp, nonce string) string {
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.Query().Encode(),
+		hex.EncodeToString(bodyHash[:]),
+		timestamp,
+		nonce,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestVerifier checks the authentication of incoming requests.
+type requestVerifier struct {
+	mode    string
+	secrets *secretSource // Requests signed with any of them are accepted
+	skew    time.Duration
+
+	mu      sync.Mutex
+	nonces  map[string]time.Time // nonce -> time after which it can no longer be replayed
+	sweepAt int                  // nonce cache size of the next sweep
+}
+
+// newRequestVerifier creates a verifier. An empty mode means compat and a
+// zero skew the default.
+func newRequestVerifier(mode string, secrets *secretSource, skew time.Duration) *requestVerifier {
+	if mode == "" {
+		mode = authCompat
+	}
+	if skew <= 0 {
+		skew = defaultAuthSkew
+	}
+	return &requestVerifier{
+		mode:    mode,
+		secrets: secrets,
+		skew:    skew,
+		nonces:  make(map[string]time.Time),
+		sweepAt: nonceSweepSize,
+	}
+}
+
+// verify checks the request. In compat mode, signed requests are verified
+// by their signature and unsigned ones by the legacy header. The body is read
+// for hashing and replaced, so handlers can still read it.
+func (v *requestVerifier) verify(r *http.Request, now time.Time) error {
+	secrets := v.secrets.accepted(now)
+	signed := r.Header.Get(headerSignature) != ""
+	if v.mode == authLegacy || (v.mode == authCompat && !signed) {
+		// Use constant-time comparison to prevent timing attacks
+		header := []byte(r.Header.Get(headerSecret))
+		for _, secret := range secrets {
+			if subtle.ConstantTimeCompare(header, []byte(secret)) == 1 {
+				return nil
+			}
+		}
+		return errors.New("invalid secret")
+	}
+	if !signed {
+		return errors.New("missing signature")
+	}
+
+	timestamp := r.Header.Get(headerTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-v.skew)) || signedAt.After(now.Add(v.skew)) {
+		return fmt.Errorf("timestamp %s outside the allowed skew of %v", signedAt.UTC().Format(time.RFC3339), v.skew)
+	}
+
+	nonce := r.Header.Get(headerNonce)
+	if nonce == "" {
+		return errors.New("missing nonce")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil {
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		if len(body) > maxSignedBody {
+			return errors.New("body too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	got := []byte(r.Header.Get(headerSignature))
+	valid := false
+	for _, secret := range secrets {
+		want := signature(secret, r.Method, r.URL, body, timestamp, nonce)
+		valid = valid || hmac.Equal(got, []byte(want))
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	// Only a valid signature claims the nonce, so forged requests cannot
+	// block legitimate ones
+	if !v.claimNonce(nonce, signedAt.Add(v.skew), now) {
+		return errors.New("replayed nonce")
+	}
+	return nil
+}
+
+// claimNonce records a nonce until it expires and reports whether it was
+// unused. Expired nonces are swept whenever the cache has doubled.
+func (v *requestVerifier) claimNonce(nonce string, expires, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if until, seen := v.nonces[nonce]; seen && now.Before(until) {
+		return false
+	}
+	if len(v.nonces) >= v.sweepAt {
+		for n, until := range v.nonces {
+			if !now.Before(until) {
+				delete(v.nonces, n)
+			}
+		}
+		v.sweepAt = max(nonceSweepSize, 2*len(v.nonces))
+	}
+	v.nonces[nonce] = expires
+	return true
+}
@@ -0,0 +1,156 @@
+package elchi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSignedRequest returns a request signed with secret at now.
+func newSignedRequest(t *testing.T, method, target, body, secret string, now time.Time) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	signRequestHMAC(req, secret, []byte(body), now)
+	return req
+}
+
+func TestRequestVerifier_Signature(t *testing.T) {
+	now := time.Now()
+	v := newRequestVerifier(authHMAC, newSecretSource("test-secret"), 0)
+
+	req := newSignedRequest(t, http.MethodPost, "/notify?b=2&a=1", `{"records":[]}`, "test-secret", now)
+	if err := v.verify(req, now); err != nil {
+		t.Fatalf("Expected a valid signature, got %v", err)
+	}
+	// The body is still readable by the handler
+	if body, _ := io.ReadAll(req.Body); string(body) != `{"records":[]}` {
+		t.Errorf("Expected the body to be restored, got %q", body)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request)
+	}{
+		{"method", func(r *http.Request) { r.Method = http.MethodPut }},
+		{"path", func(r *http.Request) { r.URL.Path = "/records" }},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "a=1&b=3" }},
+		{"body", func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"deletes":[]}`)) }},
+		{"timestamp", func(r *http.Request) { r.Header.Set(headerTimestamp, "1") }},
+		{"nonce", func(r *http.Request) { r.Header.Set(headerNonce, "other") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newSignedRequest(t, http.MethodPost, "/notify?b=2&a=1", `{"records":[]}`, "test-secret", now)
+			tt.tamper(req)
+			if err := v.verify(req, now); err == nil {
+				t.Error("Expected a tampered request to be rejected")
+			}
+		})
+	}
+
+	req = newSignedRequest(t, http.MethodGet, "/records", "", "wrong-secret", now)
+	if err := v.verify(req, now); err == nil {
+		t.Error("Expected a request signed with another secret to be rejected")
+	}
+}
+
+func TestRequestVerifier_SkewAndReplay(t *testing.T) {
+	now := time.Now()
+	v := newRequestVerifier(authHMAC, newSecretSource("test-secret"), time.Minute)
+
+	if err := v.verify(newSignedRequest(t, http.MethodGet, "/records", "", "test-secret", now.Add(-2*time.Minute)), now); err == nil {
+		t.Error("Expected an old request to be rejected")
+	}
+	if err := v.verify(newSignedRequest(t, http.MethodGet, "/records", "", "test-secret", now.Add(2*time.Minute)), now); err == nil {
+		t.Error("Expected a request from the future to be rejected")
+	}
+
+	req := newSignedRequest(t, http.MethodGet, "/records", "", "test-secret", now.Add(-30*time.Second))
+	replay := req.Clone(req.Context())
+	if err := v.verify(req, now); err != nil {
+		t.Fatalf("Expected a request within the skew to pass, got %v", err)
+	}
+	if err := v.verify(replay, now.Add(10*time.Second)); err == nil {
+		t.Error("Expected a replayed request to be rejected")
+	}
+}
+
+func TestRequestVerifier_NonceSweep(t *testing.T) {
+	now := time.Now()
+	v := newRequestVerifier(authHMAC, newSecretSource("test-secret"), time.Minute)
+	for i := range nonceSweepSize {
+		v.claimNonce(strings.Repeat("x", i+1), now.Add(time.Second), now)
+	}
+
+	// Once expired, the nonces are swept on the next claim
+	later := now.Add(2 * time.Second)
+	if !v.claimNonce("fresh", later.Add(time.Minute), later) {
+		t.Fatal("Expected a fresh nonce to be accepted")
+	}
+	if len(v.nonces) != 1 {
+		t.Errorf("Expected expired nonces to be swept, got %d left", len(v.nonces))
+	}
+}
+
+func TestRequestVerifier_Modes(t *testing.T) {
+	now := time.Now()
+	legacy := httptest.NewRequest(http.MethodGet, "/records", nil)
+	legacy.Header.Set(headerSecret, "test-secret")
+
+	tests := []struct {
+		mode       string
+		wantLegacy bool
+		wantSigned bool
+	}{
+		{authHMAC, false, true},
+		{authCompat, true, true},
+		{authLegacy, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			v := newRequestVerifier(tt.mode, newSecretSource("test-secret"), 0)
+			if err := v.verify(legacy, now); (err == nil) != tt.wantLegacy {
+				t.Errorf("legacy header: error = %v, want accepted %v", err, tt.wantLegacy)
+			}
+			signed := newSignedRequest(t, http.MethodGet, "/records", "", "test-secret", now)
+			if err := v.verify(signed, now); (err == nil) != tt.wantSigned {
+				t.Errorf("signature: error = %v, want accepted %v", err, tt.wantSigned)
+			}
+		})
+	}
+}
+
+func TestSignRequest_Modes(t *testing.T) {
+	tests := []struct {
+		mode       string
+		wantSecret bool
+		wantSigned bool
+	}{
+		{authHMAC, false, true},
+		{authCompat, false, true}, // The plain secret would give the signature away
+		{authLegacy, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			client := NewElchiClient([]string{"http://localhost"}, "gslb.elchi", "test-secret", "", nil, time.Second, nil)
+			client.authMode = tt.mode
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/dns/snapshot?zone=gslb.elchi", nil)
+			client.signRequest(req)
+
+			if got := req.Header.Get(headerSecret) != ""; got != tt.wantSecret {
+				t.Errorf("secret header sent = %v, want %v", got, tt.wantSecret)
+			}
+			if got := req.Header.Get(headerSignature) != ""; got != tt.wantSigned {
+				t.Errorf("signature sent = %v, want %v", got, tt.wantSigned)
+			}
+			if tt.wantSigned {
+				if err := newRequestVerifier(authHMAC, newSecretSource("test-secret"), 0).verify(req, time.Now()); err != nil {
+					t.Errorf("Expected the client signature to verify, got %v", err)
+				}
+			}
+		})
+	}
+}
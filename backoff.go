@@ -0,0 +1,70 @@
+package elchi
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Sync scheduling defaults.
+const (
+	retryBaseDelay = time.Second // First retry delay after a failed sync, doubled per failure
+	syncJitter     = 10          // Steady state jitter in percent of sync_interval
+
+	breakerThreshold = 5           // Consecutive 5xx responses that open an endpoint's circuit breaker
+	breakerCooldown  = time.Minute // Time an open breaker blocks requests before one trial request
+)
+
+// syncScheduler computes the delay before the next sync. In steady state it
+// waits sync_interval with some jitter, so that nodes started together do not
+// hit the controller in lockstep. After failures it retries sooner with
+// exponential backoff and full jitter, capped at sync_interval.
+type syncScheduler struct {
+	interval time.Duration
+	failures int // Consecutive failed syncs
+}
+
+// newSyncScheduler creates a scheduler for the given sync interval.
+func newSyncScheduler(interval time.Duration) *syncScheduler {
+	return &syncScheduler{interval: interval}
+}
+
+// first returns the delay before the first background sync. With a loaded
+// snapshot it is a random offset within one interval, otherwise the first
+// retry delay.
+func (s *syncScheduler) first(loaded bool) time.Duration {
+	if !loaded {
+		return s.next(false)
+	}
+	return jitter(s.interval)
+}
+
+// next returns the delay before the next sync, given the result of the last
+// one.
+func (s *syncScheduler) next(ok bool) time.Duration {
+	if ok {
+		s.failures = 0
+		spread := s.interval * syncJitter / 100
+		return s.interval - spread + jitter(2*spread)
+	}
+
+	s.failures++
+	backoff := s.interval
+	if s.failures < 32 {
+		backoff = min(retryBaseDelay<<(s.failures-1), s.interval)
+	}
+	return jitter(backoff)
+}
+
+// reset clears the failure count after a success that is not followed by a
+// scheduled delay.
+func (s *syncScheduler) reset() {
+	s.failures = 0
+}
+
+// jitter returns a random duration in (0, d].
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(d))) + 1 //nolint:gosec // Jitter does not need a CSPRNG
+}
@@ -0,0 +1,51 @@
+package elchi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncScheduler_SteadyStateJitter(t *testing.T) {
+	s := newSyncScheduler(time.Minute)
+	for range 100 {
+		d := s.next(true)
+		if d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("Expected delay within 10%% of the interval, got %v", d)
+		}
+	}
+
+	for range 100 {
+		if d := s.first(true); d <= 0 || d > time.Minute {
+			t.Fatalf("Expected initial offset within one interval, got %v", d)
+		}
+	}
+}
+
+func TestSyncScheduler_Backoff(t *testing.T) {
+	s := newSyncScheduler(time.Minute)
+
+	// Full jitter keeps every retry below the doubling backoff
+	for i, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if d := s.next(false); d <= 0 || d > limit {
+			t.Fatalf("Retry %d: expected delay in (0, %v], got %v", i+1, limit, d)
+		}
+	}
+
+	// The backoff is capped at the sync interval, even after many failures
+	for range 100 {
+		if d := s.next(false); d > time.Minute {
+			t.Fatalf("Expected delay capped at the interval, got %v", d)
+		}
+	}
+
+	// A success resets the backoff
+	s.next(true)
+	if d := s.next(false); d > time.Second {
+		t.Errorf("Expected backoff reset after success, got %v", d)
+	}
+
+	// Without a snapshot the first sync is a fast retry
+	if d := newSyncScheduler(time.Minute).first(false); d > time.Second {
+		t.Errorf("Expected a fast first retry without a snapshot, got %v", d)
+	}
+}
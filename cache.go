@@ -3,9 +3,13 @@ package elchi
 
 import (
 	"fmt"
+	"maps"
 	"net"
+	"net/netip"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -18,18 +22,53 @@ const (
 
 // RecordCache is a thread-safe cache for DNS records.
 type RecordCache struct {
+	writeMu     sync.Mutex // serializes writers, so a delta can be built outside mu
 	mu          sync.RWMutex
 	zone        string
 	versionHash string
 	updatedAt   time.Time
-	records     map[string]map[uint16][]dns.RR // domain -> qtype -> []RR
+	generation  uint64                       // incremented on every change
+	records     map[string]map[uint16]*rrSet // domain -> qtype -> RR set
+	sources     map[string][]DNSRecord       // domain -> records the RR sets were built from
+	guard       *GuardLimits                 // limits for replacing the records (nil = no limits)
+	quarantine  *quarantine                  // records rejected by the guard (nil = none)
+	dampener    *dampener                    // holds back changes to flapping names (nil = disabled)
+	canonical   *canonicalRecords            // encodings of sources for delta hashes (nil = not built), guarded by writeMu
+}
+
+// rrSet holds the pre-built RRs for one domain and qtype together with the
+// metadata needed to pick an answer at query time. An rrSet is never modified
+// after it has been built (apart from the atomic round-robin counter), so it
+// can be used without holding the cache lock.
+type rrSet struct {
+	rrs         []dns.RR
+	weights     []uint32          // per-RR weight, parallel to rrs (nil if the record is unweighted)
+	totalWeight uint64            // sum of weights, wider than a weight so it cannot overflow
+	byRegion    map[string]*rrSet // region -> subset of rrs (nil if the record has no regional IPs)
+	next        *atomic.Uint32    // round-robin position, the only state that changes after build
+	recordSettings
+}
+
+// recordSettings holds the per-record options of an RR set, shared by its
+// regional subsets.
+type recordSettings struct {
+	maxAnswers int          // per-record answer limit (0 = use max_answers directive)
+	check      *HealthCheck // per-record health check (nil = use health_check directive)
+	checkKey   string       // identity of check, used to look up health state ("" = default check)
+	failover   []dns.RR     // CNAMEs to the failover targets in order of preference (nil = none)
+}
+
+// newRRSet creates an empty RR set.
+func newRRSet() *rrSet {
+	return &rrSet{next: new(atomic.Uint32)}
 }
 
 // NewRecordCache creates a new record cache for the given zone.
 func NewRecordCache(zone string) *RecordCache {
 	return &RecordCache{
 		zone:    zone,
-		records: make(map[string]map[uint16][]dns.RR),
+		records: make(map[string]map[uint16]*rrSet),
+		sources: make(map[string][]DNSRecord),
 	}
 }
 
@@ -39,68 +78,135 @@ func (c *RecordCache) ReplaceFromSnapshot(snapshot *DNSSnapshot, defaultTTL uint
 		return fmt.Errorf("snapshot is nil")
 	}
 
-	// Build new cache from snapshot
-	newRecords := make(map[string]map[uint16][]dns.RR)
-	var loaded, skipped int
-
+	builder := c.newSnapshotBuilder(defaultTTL)
 	for _, record := range snapshot.Records {
-		// Normalize domain name
-		domain := normalizeDomain(record.Name)
+		builder.add(record)
+	}
+	return builder.commit(snapshot.VersionHash)
+}
 
-		// Validate record is within our zone
-		if !strings.HasSuffix(domain, c.zone) && domain != c.zone {
-			log.Warningf("Skipping record %s: not in zone %s", domain, c.zone)
-			skipped++
-			continue
-		}
+// snapshotBuilder builds a new cache content one record at a time, so a
+// snapshot can be loaded while it is decoded. The cache is only replaced by
+// commit.
+type snapshotBuilder struct {
+	cache      *RecordCache
+	defaultTTL uint32
+	records    map[string]map[uint16]*rrSet
+	sources    map[string][]DNSRecord
+	loaded     int
+	skipped    int
+}
 
-		// Build dns.RR objects from the record
-		rrs, err := buildDNSRecords(record, defaultTTL)
-		if err != nil {
-			log.Warningf("Failed to build DNS records for %s: %v", record.Name, err)
-			skipped++
-			continue
-		}
+// newSnapshotBuilder returns an empty builder for the cache.
+func (c *RecordCache) newSnapshotBuilder(defaultTTL uint32) *snapshotBuilder {
+	return &snapshotBuilder{
+		cache:      c,
+		defaultTTL: defaultTTL,
+		records:    make(map[string]map[uint16]*rrSet),
+		sources:    make(map[string][]DNSRecord),
+	}
+}
 
-		// nil means record was skipped (no IPs, no failover)
-		if rrs == nil {
-			skipped++
-			continue
-		}
+// add adds a record of the snapshot.
+func (b *snapshotBuilder) add(record DNSRecord) {
+	// Normalize domain name
+	domain := normalizeDomain(record.Name)
 
-		if len(rrs) == 0 {
-			skipped++
-			continue
-		}
+	// Validate record is within our zone
+	if !b.cache.inZone(domain) {
+		log.Warningf("Skipping record %s: not in zone %s", domain, b.cache.zone)
+		b.skipped++
+		return
+	}
+	b.sources[domain] = append(b.sources[domain], record)
 
-		// Determine qtype from first RR
-		qtype := rrs[0].Header().Rrtype
+	if addRecord(b.records, domain, record, b.defaultTTL) {
+		b.loaded++
+	} else {
+		b.skipped++
+	}
+}
 
-		// Initialize nested map if needed
-		if newRecords[domain] == nil {
-			newRecords[domain] = make(map[uint16][]dns.RR)
-		}
+// commit atomically replaces the cache with the records added so far.
+func (b *snapshotBuilder) commit(versionHash string) error {
+	c := b.cache
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 
-		// Append RRs to cache
-		newRecords[domain][qtype] = append(newRecords[domain][qtype], rrs...)
-		loaded++
+	// A failover loop would send clients around in circles, keep the current records instead
+	if loop := findFailoverLoop(b.records); loop != nil {
+		return fmt.Errorf("failover loop in snapshot: %s", strings.Join(loop, " -> "))
 	}
 
 	// Atomically replace cache
-	c.mu.Lock()
-	c.records = newRecords
-	c.versionHash = snapshot.VersionHash
-	c.updatedAt = time.Now()
-	recordCount := c.updateCacheSizeMetric()
-	c.mu.Unlock()
+	recordCount, err := c.guardedReplace(b.records, b.sources, versionHash)
+	if err != nil {
+		return err
+	}
 
-	log.Infof("Snapshot loaded: %d records loaded, %d skipped (total RRs: %d)", loaded, skipped, recordCount)
+	log.Infof("Snapshot loaded: %d records loaded, %d skipped (total RRs: %d)", b.loaded, b.skipped, recordCount)
 
 	return nil
 }
 
+// addRecord builds the RR set of a record and merges it into records. It
+// reports whether the record was loaded.
+func addRecord(records map[string]map[uint16]*rrSet, domain string, record DNSRecord, defaultTTL uint32) bool {
+	// Build dns.RR objects from the record
+	set, err := buildRRSet(record, defaultTTL)
+	if err != nil {
+		log.Warningf("Failed to build DNS records for %s: %v", record.Name, err)
+		return false
+	}
+
+	// nil means record was skipped (no IPs, no failover)
+	if set == nil {
+		return false
+	}
+
+	// Determine qtype from first RR
+	qtype := set.rrs[0].Header().Rrtype
+
+	// Initialize nested map if needed
+	if records[domain] == nil {
+		records[domain] = make(map[uint16]*rrSet)
+	}
+
+	// Merge with RRs already loaded for this domain+qtype
+	records[domain][qtype] = mergeRRSets(records[domain][qtype], set)
+	return true
+}
+
+// inZone reports whether domain is the zone or a name below it.
+func (c *RecordCache) inZone(domain string) bool {
+	return strings.HasSuffix(domain, c.zone) || domain == c.zone
+}
+
 // Get retrieves pre-built dns.RR objects for a query.
 func (c *RecordCache) Get(qname string, qtype uint16) []dns.RR {
+	set := c.lookup(qname, qtype)
+	if set == nil {
+		return nil
+	}
+
+	// Return copy of RRs to prevent external modification
+	result := make([]dns.RR, len(set.rrs))
+	copy(result, set.rrs)
+	return result
+}
+
+// HasName reports whether the cache has records of any type for qname.
+func (c *RecordCache) HasName(qname string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, exists := c.records[normalizeDomain(qname)]
+	return exists
+}
+
+// lookup returns the RR set for a query, or nil if there is none.
+// The returned set is immutable and must not be modified by the caller.
+func (c *RecordCache) lookup(qname string, qtype uint16) *rrSet {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
@@ -113,15 +219,50 @@ func (c *RecordCache) Get(qname string, qtype uint16) []dns.RR {
 	}
 
 	// Check if qtype exists for this domain
-	rrs, exists := qtypeMap[qtype]
-	if !exists {
-		return nil
+	return qtypeMap[qtype]
+}
+
+// Generation returns a counter that changes whenever the cache content changes.
+func (c *RecordCache) Generation() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+// healthTargets returns every cached IP with the health check of its record
+// (nil when the record has none and the health_check directive applies).
+func (c *RecordCache) healthTargets() map[healthKey]*HealthCheck {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	targets := make(map[healthKey]*HealthCheck)
+	for _, qtypeMap := range c.records {
+		for _, set := range qtypeMap {
+			for _, rr := range set.rrs {
+				if addr := rrAddr(rr); addr.IsValid() {
+					targets[healthKey{addr: addr, check: set.checkKey}] = set.check
+				}
+			}
+		}
 	}
+	return targets
+}
 
-	// Return copy of RRs to prevent external modification
-	result := make([]dns.RR, len(rrs))
-	copy(result, rrs)
-	return result
+// failoverRecords returns the RR sets that have a failover target.
+func (c *RecordCache) failoverRecords() map[recordKey]*rrSet {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	records := make(map[recordKey]*rrSet)
+	for domain, qtypeMap := range c.records {
+		for qtype, set := range qtypeMap {
+			// Static CNAMEs have no IPs to fail over from
+			if set.failover != nil && qtype != dns.TypeCNAME {
+				records[recordKey{name: domain, qtype: qtype}] = set
+			}
+		}
+	}
+	return records
 }
 
 // GetVersionHash returns the current version hash.
@@ -144,8 +285,8 @@ func (c *RecordCache) RRCount() int {
 	defer c.mu.RUnlock()
 	count := 0
 	for _, qtypeMap := range c.records {
-		for _, rrs := range qtypeMap {
-			count += len(rrs)
+		for _, set := range qtypeMap {
+			count += len(set.rrs)
 		}
 	}
 	return count
@@ -157,43 +298,58 @@ func (c *RecordCache) Update(records []DNSRecord, defaultTTL uint32) error {
 		return nil
 	}
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.canonical = nil
 
+	// Build the new RR sets of each name in a copy, so a name changes at once
+	updated := make(map[string]map[uint16]*rrSet)
 	for _, record := range records {
 		// Normalize domain name
 		domain := normalizeDomain(record.Name)
 
 		// Validate record is within our zone
-		if !strings.HasSuffix(domain, c.zone) && domain != c.zone {
+		if !c.inZone(domain) {
 			log.Warningf("Skipping record %s: not in zone %s", domain, c.zone)
 			continue
 		}
+		c.sources[domain] = append(withoutType(c.sources[domain], record.Type), record)
 
 		// Build dns.RR objects from the record
-		rrs, err := buildDNSRecords(record, defaultTTL)
+		set, err := buildRRSet(record, defaultTTL)
 		if err != nil {
 			log.Warningf("Failed to build DNS records for %s: %v", record.Name, err)
 			continue
 		}
 
-		if len(rrs) == 0 {
+		if set == nil {
 			continue
 		}
 
 		// Determine qtype from first RR
-		qtype := rrs[0].Header().Rrtype
+		qtype := set.rrs[0].Header().Rrtype
 
-		// Initialize nested map if needed
-		if c.records[domain] == nil {
-			c.records[domain] = make(map[uint16][]dns.RR)
+		sets, ok := updated[domain]
+		if !ok {
+			sets = maps.Clone(c.records[domain])
+			if sets == nil {
+				sets = make(map[uint16]*rrSet)
+			}
+			updated[domain] = sets
 		}
 
 		// Replace existing RRs for this domain+qtype
-		c.records[domain][qtype] = rrs
+		sets[qtype] = set
 	}
 
-	c.updatedAt = time.Now()
+	now := time.Now()
+	for domain, sets := range updated {
+		c.setRecords(domain, sets, now)
+	}
+	c.updatedAt = now
+	c.generation++
 	c.updateCacheSizeMetric()
 
 	return nil
@@ -205,12 +361,21 @@ func (c *RecordCache) Delete(deletes []DeleteRecord) error {
 		return nil
 	}
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.canonical = nil
 
+	updated := make(map[string]map[uint16]*rrSet)
 	for _, del := range deletes {
 		// Normalize domain name
 		domain := normalizeDomain(del.Name)
+		if remaining := withoutType(c.sources[domain], del.Type); len(remaining) > 0 {
+			c.sources[domain] = remaining
+		} else {
+			delete(c.sources, domain)
+		}
 
 		// Parse record type
 		var qtype uint16
@@ -225,21 +390,25 @@ func (c *RecordCache) Delete(deletes []DeleteRecord) error {
 		}
 
 		// Check if domain exists
-		qtypeMap, exists := c.records[domain]
-		if !exists {
-			continue
+		sets, ok := updated[domain]
+		if !ok {
+			if _, exists := c.records[domain]; !exists {
+				continue
+			}
+			sets = maps.Clone(c.records[domain])
+			updated[domain] = sets
 		}
 
-		// Delete the specific qtype
-		delete(qtypeMap, qtype)
-
-		// If no more qtypes for this domain, remove the domain entry
-		if len(qtypeMap) == 0 {
-			delete(c.records, domain)
-		}
+		// Delete the specific qtype, the domain entry goes with its last one
+		delete(sets, qtype)
 	}
 
-	c.updatedAt = time.Now()
+	now := time.Now()
+	for domain, sets := range updated {
+		c.setRecords(domain, sets, now)
+	}
+	c.updatedAt = now
+	c.generation++
 	c.updateCacheSizeMetric()
 
 	return nil
@@ -253,8 +422,8 @@ func (c *RecordCache) GetAllRecords() []DNSRecord {
 	var records []DNSRecord
 
 	for domain, qtypeMap := range c.records {
-		for qtype, rrs := range qtypeMap {
-			if len(rrs) == 0 {
+		for qtype, set := range qtypeMap {
+			if len(set.rrs) == 0 {
 				continue
 			}
 
@@ -262,13 +431,10 @@ func (c *RecordCache) GetAllRecords() []DNSRecord {
 			var ips []string
 			var ttl uint32
 
-			for _, rr := range rrs {
+			for _, rr := range set.rrs {
 				ttl = rr.Header().Ttl
-				switch r := rr.(type) {
-				case *dns.A:
-					ips = append(ips, r.A.String())
-				case *dns.AAAA:
-					ips = append(ips, r.AAAA.String())
+				if ip := rrIP(rr); ip != "" {
+					ips = append(ips, ip)
 				}
 			}
 
@@ -282,10 +448,14 @@ func (c *RecordCache) GetAllRecords() []DNSRecord {
 			}
 
 			records = append(records, DNSRecord{
-				Name: strings.TrimSuffix(domain, "."),
-				Type: typeStr,
-				TTL:  ttl,
-				IPs:  ips,
+				Name:       strings.TrimSuffix(domain, "."),
+				Type:       typeStr,
+				TTL:        ttl,
+				IPs:        ips,
+				IPRegions:  set.ipRegions(),
+				Endpoints:  set.weightedEndpoints(),
+				Failover:   set.failoverNames(),
+				MaxAnswers: set.maxAnswers,
 			})
 		}
 	}
@@ -313,19 +483,11 @@ func buildDNSRecords(record DNSRecord, defaultTTL uint32) ([]dns.RR, error) {
 	}
 
 	// Check if failover is needed (IPs empty)
-	if len(record.IPs) == 0 {
-		// If failover is configured, return CNAME
-		if record.Failover != "" {
-			cname := &dns.CNAME{
-				Hdr: dns.RR_Header{
-					Name:   name,
-					Rrtype: dns.TypeCNAME,
-					Class:  dns.ClassINET,
-					Ttl:    ttl,
-				},
-				Target: normalizeDomain(record.Failover),
-			}
-			return []dns.RR{cname}, nil
+	endpoints := record.endpoints()
+	if len(endpoints) == 0 {
+		// If failover is configured, return CNAME to the preferred target
+		if cnames := buildFailoverCNAMEs(name, ttl, record.Failover); len(cnames) > 0 {
+			return cnames[:1], nil
 		}
 		// No IPs and no failover - skip this record (will result in NXDOMAIN)
 		return nil, nil
@@ -336,7 +498,8 @@ func buildDNSRecords(record DNSRecord, defaultTTL uint32) ([]dns.RR, error) {
 
 	switch recordType {
 	case "A":
-		for _, ipStr := range record.IPs {
+		for _, ep := range endpoints {
+			ipStr := ep.IP
 			ip := net.ParseIP(ipStr)
 			if ip == nil {
 				log.Warningf("Invalid IP address: %s", ipStr)
@@ -363,7 +526,8 @@ func buildDNSRecords(record DNSRecord, defaultTTL uint32) ([]dns.RR, error) {
 		}
 
 	case RecordTypeAAAA:
-		for _, ipStr := range record.IPs {
+		for _, ep := range endpoints {
+			ipStr := ep.IP
 			ip := net.ParseIP(ipStr)
 			if ip == nil {
 				log.Warningf("Invalid IP address: %s", ipStr)
@@ -399,13 +563,307 @@ func buildDNSRecords(record DNSRecord, defaultTTL uint32) ([]dns.RR, error) {
 	return rrs, nil
 }
 
+// buildRRSet converts a DNSRecord from API to an rrSet, attaching per-IP
+// weights and grouping the RRs by region when the record carries them.
+// It returns nil when the record should be skipped.
+func buildRRSet(record DNSRecord, defaultTTL uint32) (*rrSet, error) {
+	rrs, err := buildDNSRecords(record, defaultTTL)
+	if err != nil {
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		return nil, nil
+	}
+
+	// Endpoints are matched to RRs by IP string, so normalize them the same
+	// way rrIP does (e.g. "2001:DB8::1" -> "2001:db8::1").
+	endpoints := make(map[string]Endpoint)
+	weighted := false
+	for _, ep := range record.endpoints() {
+		if ip := net.ParseIP(ep.IP); ip != nil {
+			endpoints[ip.String()] = ep
+			weighted = weighted || ep.Weight > 0
+		}
+	}
+
+	set := newRRSet()
+	for _, rr := range rrs {
+		ep := endpoints[rrIP(rr)]
+		var weight uint32
+		if weighted {
+			weight = max(ep.Weight, 1)
+		}
+		set.add(rr, weight)
+		if ep.Region != "" {
+			set.regionSubset(ep.Region).add(rr, weight)
+		}
+	}
+	settings := recordSettings{
+		maxAnswers: max(record.MaxAnswers, 0),
+		check:      record.HealthCheck,
+		checkKey:   record.HealthCheck.key(),
+	}
+	settings.failover = buildFailoverCNAMEs(rrs[0].Header().Name, rrs[0].Header().Ttl, record.Failover)
+	set.setRecordSettings(settings)
+	return set, nil
+}
+
+// buildFailoverCNAMEs builds one CNAME per failover target, keeping their order.
+func buildFailoverCNAMEs(name string, ttl uint32, targets FailoverTargets) []dns.RR {
+	var cnames []dns.RR
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		cnames = append(cnames, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Target: normalizeDomain(target),
+		})
+	}
+	return cnames
+}
+
+// failoverNames returns the failover targets of the set (for /records endpoint).
+func (s *rrSet) failoverNames() FailoverTargets {
+	var names FailoverTargets
+	for _, rr := range s.failover {
+		names = append(names, strings.TrimSuffix(rr.(*dns.CNAME).Target, "."))
+	}
+	return names
+}
+
+// findFailoverLoop returns the names on a failover loop such as a -> b -> a,
+// or nil if the failover targets of the records never lead back to a record.
+func findFailoverLoop(records map[string]map[uint16]*rrSet) []string {
+	edges := make(map[string][]string)
+	for domain, qtypeMap := range records {
+		for _, set := range qtypeMap {
+			for _, rr := range set.failover {
+				edges[domain] = append(edges[domain], rr.(*dns.CNAME).Target)
+			}
+		}
+	}
+
+	// Depth-first search, visiting names in a stable order so the same
+	// snapshot always reports the same loop
+	domains := make([]string, 0, len(edges))
+	for domain := range edges {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	const (
+		unvisited = iota
+		inPath
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(domain string) []string
+	visit = func(domain string) []string {
+		switch state[domain] {
+		case inPath:
+			// Back at a name on the current path, cut the path to the loop
+			for i, d := range path {
+				if d == domain {
+					return append(append([]string{}, path[i:]...), domain)
+				}
+			}
+		case done:
+			return nil
+		}
+
+		state[domain] = inPath
+		path = append(path, domain)
+		for _, target := range edges[domain] {
+			if loop := visit(target); loop != nil {
+				return loop
+			}
+		}
+		path = path[:len(path)-1]
+		state[domain] = done
+		return nil
+	}
+
+	for _, domain := range domains {
+		if loop := visit(domain); loop != nil {
+			return loop
+		}
+	}
+	return nil
+}
+
+// setRecordSettings sets the per-record settings on the set and its regional subsets.
+func (s *rrSet) setRecordSettings(settings recordSettings) {
+	s.recordSettings = settings
+	for _, sub := range s.byRegion {
+		sub.recordSettings = settings
+	}
+}
+
+// add appends an RR to the set. A weight of 0 adds it to an unweighted set.
+func (s *rrSet) add(rr dns.RR, weight uint32) {
+	s.rrs = append(s.rrs, rr)
+	if weight == 0 && s.weights == nil {
+		return
+	}
+	if s.weights == nil {
+		// First weighted RR: earlier RRs get the default weight
+		s.weights = make([]uint32, len(s.rrs)-1, cap(s.rrs))
+		for i := range s.weights {
+			s.weights[i] = 1
+		}
+		s.totalWeight = uint64(len(s.weights))
+	}
+	weight = max(weight, 1)
+	s.weights = append(s.weights, weight)
+	s.totalWeight += uint64(weight)
+}
+
+// subset returns a set with the first n RRs of s, sharing its settings and
+// round-robin counter.
+func (s *rrSet) subset(n int) *rrSet {
+	sub := &rrSet{next: s.next, recordSettings: s.recordSettings}
+	for i, rr := range s.rrs[:n] {
+		sub.add(rr, s.weight(i))
+	}
+	return sub
+}
+
+// weight returns the weight of the i-th RR (0 if the set is unweighted).
+func (s *rrSet) weight(i int) uint32 {
+	if s.weights == nil {
+		return 0
+	}
+	return s.weights[i]
+}
+
+// regionSubset returns the subset for the given region, creating it if needed.
+func (s *rrSet) regionSubset(region string) *rrSet {
+	if s.byRegion == nil {
+		s.byRegion = make(map[string]*rrSet)
+	}
+	sub := s.byRegion[region]
+	if sub == nil {
+		sub = newRRSet()
+		s.byRegion[region] = sub
+	}
+	return sub
+}
+
+// mergeRRSets combines two RR sets for the same domain and qtype.
+// It is used when a snapshot carries more than one record for a name.
+func mergeRRSets(existing, set *rrSet) *rrSet {
+	if existing == nil {
+		return set
+	}
+
+	merged := newRRSet()
+	for _, src := range []*rrSet{existing, set} {
+		for i, rr := range src.rrs {
+			merged.add(rr, src.weight(i))
+		}
+		for region, sub := range src.byRegion {
+			for i, rr := range sub.rrs {
+				merged.regionSubset(region).add(rr, sub.weight(i))
+			}
+		}
+	}
+
+	// The later record's settings win where it has any
+	settings := set.recordSettings
+	if settings.maxAnswers == 0 {
+		settings.maxAnswers = existing.maxAnswers
+	}
+	if settings.check == nil {
+		settings.check = existing.check
+		settings.checkKey = existing.checkKey
+	}
+	if settings.failover == nil {
+		settings.failover = existing.failover
+	}
+	merged.setRecordSettings(settings)
+	return merged
+}
+
+// forRegion returns the subset of the RR set that serves the given region.
+// If the record has no IPs in that region, the full set is returned.
+func (s *rrSet) forRegion(region string) *rrSet {
+	if sub, ok := s.byRegion[region]; ok {
+		return sub
+	}
+	return s
+}
+
+// regional reports whether the RR set has per-region subsets.
+func (s *rrSet) regional() bool {
+	return len(s.byRegion) > 0
+}
+
+// ipRegions rebuilds the IP -> region map of the RR set (for /records endpoint).
+func (s *rrSet) ipRegions() map[string]string {
+	if len(s.byRegion) == 0 {
+		return nil
+	}
+	regions := make(map[string]string)
+	for region, sub := range s.byRegion {
+		for _, rr := range sub.rrs {
+			regions[rrIP(rr)] = region
+		}
+	}
+	return regions
+}
+
+// weightedEndpoints rebuilds the endpoint list of a weighted RR set
+// (for /records endpoint). It returns nil for unweighted sets.
+func (s *rrSet) weightedEndpoints() []Endpoint {
+	if s.weights == nil {
+		return nil
+	}
+	regions := s.ipRegions()
+	endpoints := make([]Endpoint, 0, len(s.rrs))
+	for i, rr := range s.rrs {
+		ip := rrIP(rr)
+		endpoints = append(endpoints, Endpoint{IP: ip, Weight: s.weights[i], Region: regions[ip]})
+	}
+	return endpoints
+}
+
+// rrIP returns the address of an A or AAAA record as a string, or "" for other types.
+func rrIP(rr dns.RR) string {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A.String()
+	case *dns.AAAA:
+		return r.AAAA.String()
+	}
+	return ""
+}
+
+// rrAddr returns the address of an A or AAAA record, or an invalid address for other types.
+func rrAddr(rr dns.RR) netip.Addr {
+	var addr netip.Addr
+	switch r := rr.(type) {
+	case *dns.A:
+		addr, _ = netip.AddrFromSlice(r.A.To4())
+	case *dns.AAAA:
+		addr, _ = netip.AddrFromSlice(r.AAAA)
+	}
+	return addr
+}
+
 // updateCacheSizeMetric calculates and updates the cache size prometheus metric.
 // Must be called while holding the mutex lock.
 func (c *RecordCache) updateCacheSizeMetric() int {
 	count := 0
 	for _, qtypeMap := range c.records {
-		for _, rrs := range qtypeMap {
-			count += len(rrs)
+		for _, set := range qtypeMap {
+			count += len(set.rrs)
 		}
 	}
 	cacheSize.WithLabelValues(c.zone).Set(float64(count))
@@ -1,6 +1,7 @@
 package elchi
 
 import (
+	"strings"
 	"sync"
 	"testing"
 
@@ -380,7 +381,7 @@ func TestBuildDNSRecords_CNAME_Failover(t *testing.T) {
 		Type:     "A",
 		TTL:      20,
 		IPs:      []string{}, // Empty IPs triggers failover
-		Failover: "abc.avrupa-gslb.elchi",
+		Failover: FailoverTargets{"abc.avrupa-gslb.elchi"},
 	}
 
 	rrs, err := buildDNSRecords(record, 300)
@@ -413,7 +414,7 @@ func TestBuildDNSRecords_EmptyIPs_NoFailover(t *testing.T) {
 		Type:     "A",
 		TTL:      20,
 		IPs:      []string{}, // Empty IPs
-		Failover: "",         // No failover
+		Failover: nil,        // No failover
 	}
 
 	rrs, err := buildDNSRecords(record, 300)
@@ -433,7 +434,7 @@ func TestBuildDNSRecords_WithIPs_IgnoresFailover(t *testing.T) {
 		Type:     "A",
 		TTL:      20,
 		IPs:      []string{"10.10.1.20", "10.10.1.21"},
-		Failover: "abc.avrupa-gslb.elchi", // Should be ignored
+		Failover: FailoverTargets{"abc.avrupa-gslb.elchi"}, // Should be ignored
 	}
 
 	rrs, err := buildDNSRecords(record, 300)
@@ -465,7 +466,7 @@ func TestCache_CNAME_Failover_Integration(t *testing.T) {
 				Type:     "A",
 				TTL:      30,
 				IPs:      []string{}, // Empty IPs triggers failover
-				Failover: "service1-backup.gslb.elchi",
+				Failover: FailoverTargets{"service1-backup.gslb.elchi"},
 			},
 			{
 				Name: "service1-backup.gslb.elchi",
@@ -510,7 +511,7 @@ func TestBuildDNSRecords_CNAME_EmptyIPs(t *testing.T) {
 		Type:     "A",
 		TTL:      30,
 		IPs:      []string{}, // Empty IPs - no healthy endpoints
-		Failover: "service.region2.elchi",
+		Failover: FailoverTargets{"service.region2.elchi"},
 	}
 
 	rrs, err := buildDNSRecords(record, 300)
@@ -543,7 +544,7 @@ func TestBuildDNSRecords_CNAME_EmptyIPs_NoFailover(t *testing.T) {
 		Type:     "A",
 		TTL:      30,
 		IPs:      []string{}, // Empty IPs
-		Failover: "",         // No failover configured
+		Failover: nil,        // No failover configured
 	}
 
 	rrs, err := buildDNSRecords(record, 300)
@@ -568,7 +569,7 @@ func TestCache_CNAME_EmptyIPs_Integration(t *testing.T) {
 				Type:     "A",
 				TTL:      20,
 				IPs:      []string{}, // No healthy endpoints in Asia
-				Failover: "api-europe.gslb.elchi",
+				Failover: FailoverTargets{"api-europe.gslb.elchi"},
 			},
 			{
 				Name: "api-europe.gslb.elchi",
@@ -605,3 +606,118 @@ func TestCache_CNAME_EmptyIPs_Integration(t *testing.T) {
 		t.Fatalf("Expected 2 A records for Europe service, got %d", len(aRRs))
 	}
 }
+
+func TestBuildDNSRecords_Endpoints(t *testing.T) {
+	// Endpoints take precedence over the plain ips array
+	record := DNSRecord{
+		Name: "test.gslb.elchi",
+		Type: "A",
+		TTL:  300,
+		IPs:  []string{"192.168.9.9"},
+		Endpoints: []Endpoint{
+			{IP: "192.168.1.10", Weight: 80},
+			{IP: "192.168.2.10", Weight: 20},
+		},
+	}
+
+	rrs, err := buildDNSRecords(record, 300)
+	if err != nil {
+		t.Fatalf("buildDNSRecords failed: %v", err)
+	}
+	if len(rrs) != 2 {
+		t.Fatalf("Expected 2 A records from endpoints, got %d", len(rrs))
+	}
+	if ip := rrIP(rrs[0]); ip != "192.168.1.10" {
+		t.Errorf("Expected first IP 192.168.1.10, got %s", ip)
+	}
+}
+
+func TestGetAllRecords_WeightedEndpoints(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+
+	snapshot := &DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{
+				Name: "weighted.gslb.elchi",
+				Type: "A",
+				Endpoints: []Endpoint{
+					{IP: "192.168.1.10", Weight: 80},
+					{IP: "192.168.2.10", Weight: 20},
+				},
+			},
+		},
+	}
+	if err := cache.ReplaceFromSnapshot(snapshot, 300); err != nil {
+		t.Fatalf("ReplaceFromSnapshot failed: %v", err)
+	}
+
+	records := cache.GetAllRecords()
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(records))
+	}
+	if len(records[0].IPs) != 2 {
+		t.Errorf("Expected full pool of 2 IPs, got %v", records[0].IPs)
+	}
+	if len(records[0].Endpoints) != 2 || records[0].Endpoints[0].Weight != 80 {
+		t.Errorf("Expected weighted endpoints, got %+v", records[0].Endpoints)
+	}
+}
+
+func TestReplaceFromSnapshot_FailoverLoop(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	if err := cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records:     []DNSRecord{{Name: "a.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+	}, 300); err != nil {
+		t.Fatalf("ReplaceFromSnapshot failed: %v", err)
+	}
+
+	// a -> b -> c -> a, with c only reachable through b's second target
+	err := cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v2",
+		Records: []DNSRecord{
+			{Name: "a.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}, Failover: FailoverTargets{"b.gslb.elchi"}},
+			{Name: "b.gslb.elchi", Type: "A", IPs: []string{"192.168.1.20"}, Failover: FailoverTargets{"d.other-gslb.elchi", "c.gslb.elchi"}},
+			{Name: "c.gslb.elchi", Type: "A", Failover: FailoverTargets{"a.gslb.elchi"}},
+		},
+	}, 300)
+	if err == nil {
+		t.Fatal("Expected error for failover loop")
+	}
+	if !strings.Contains(err.Error(), "a.gslb.elchi. -> b.gslb.elchi. -> c.gslb.elchi. -> a.gslb.elchi.") {
+		t.Errorf("Expected loop in error, got %v", err)
+	}
+
+	// The rejected snapshot leaves the cache untouched
+	if cache.GetVersionHash() != "v1" {
+		t.Errorf("Expected version v1 to be kept, got %s", cache.GetVersionHash())
+	}
+}
+
+func TestReplaceFromSnapshot_FailoverChainWithoutLoop(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+
+	// Two records sharing a backup is not a loop
+	err := cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "a.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}, Failover: FailoverTargets{"b.gslb.elchi", "sorry.gslb.elchi"}},
+			{Name: "b.gslb.elchi", Type: "A", IPs: []string{"192.168.1.20"}, Failover: FailoverTargets{"sorry.gslb.elchi"}},
+			{Name: "sorry.gslb.elchi", Type: "A", IPs: []string{"192.168.9.9"}},
+		},
+	}, 300)
+	if err != nil {
+		t.Fatalf("ReplaceFromSnapshot failed: %v", err)
+	}
+
+	for _, record := range cache.GetAllRecords() {
+		if record.Name == "a.gslb.elchi" && len(record.Failover) != 2 {
+			t.Errorf("Expected 2 failover targets for a.gslb.elchi, got %v", record.Failover)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package elchi
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +9,8 @@ import (
 	"net/url"
 	"strings"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // DNSSnapshot represents the full DNS snapshot response from Elchi backend.
@@ -17,67 +18,186 @@ type DNSSnapshot struct {
 	Zone        string      `json:"zone"`
 	VersionHash string      `json:"version_hash"`
 	Records     []DNSRecord `json:"records"`
+	Signature   string      `json:"signature,omitempty"` // Base64 Ed25519 signature of the controller (see trusted_keys)
 }
 
 // DNSChangesResponse represents the response from the changes endpoint.
+// With a base hash it is a delta: Records are added or replaced and Deletes
+// are removed, on top of the records with that version hash.
 type DNSChangesResponse struct {
-	Unchanged   bool        `json:"unchanged"`
-	Zone        string      `json:"zone,omitempty"`
-	VersionHash string      `json:"version_hash,omitempty"`
-	Records     []DNSRecord `json:"records,omitempty"`
+	Unchanged   bool           `json:"unchanged"`
+	Zone        string         `json:"zone,omitempty"`
+	VersionHash string         `json:"version_hash,omitempty"`
+	BaseHash    string         `json:"base_hash,omitempty"` // Version hash a delta applies to ("" = full record list)
+	Records     []DNSRecord    `json:"records,omitempty"`
+	Deletes     []DeleteRecord `json:"deletes,omitempty"`   // Records removed by a delta
+	Signature   string         `json:"signature,omitempty"` // Base64 Ed25519 signature of the controller (see trusted_keys)
 }
 
 // DNSRecord represents a single DNS record from Elchi.
 type DNSRecord struct {
-	Name     string   `json:"name"`               // e.g., "listener1.gslb.elchi"
-	Type     string   `json:"type"`               // "A" or "AAAA"
-	TTL      uint32   `json:"ttl"`                // TTL in seconds
-	IPs      []string `json:"ips"`                // List of IP addresses
-	Failover string   `json:"failover,omitempty"` // CNAME target when IPs is empty
+	Name     string          `json:"name"`               // e.g., "listener1.gslb.elchi"
+	Type     string          `json:"type"`               // "A" or "AAAA"
+	TTL      uint32          `json:"ttl"`                // TTL in seconds
+	IPs      []string        `json:"ips"`                // List of IP addresses
+	Failover FailoverTargets `json:"failover,omitempty"` // CNAME targets when IPs is empty or all IPs are unhealthy
+
+	// IPRegions maps an IP from IPs to the region it serves. Clients whose
+	// subnet maps to that region (see client_region) are answered with the
+	// IPs of their region only.
+	IPRegions map[string]string `json:"ip_regions,omitempty"`
+
+	// Endpoints lists the IPs with per-IP weights. When set, it takes
+	// precedence over IPs and IPRegions.
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+
+	// MaxAnswers limits the number of RRs per answer for this record,
+	// overriding the max_answers directive (0 = use the directive).
+	MaxAnswers int `json:"max_answers,omitempty"`
+
+	// HealthCheck configures local probing of the record's IPs, overriding
+	// the health_check directive field by field.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+// Endpoint is a single IP address of a DNS record.
+type Endpoint struct {
+	IP     string `json:"ip"`
+	Weight uint32 `json:"weight,omitempty"` // Relative share of answers (0 = default weight of 1)
+	Region string `json:"region,omitempty"` // Region served by this IP (see client_region)
+}
+
+// FailoverTargets is an ordered list of failover CNAME targets, most
+// preferred first. In JSON it is either a single name or an array of names.
+type FailoverTargets []string
+
+// UnmarshalJSON accepts a single name or an array of names.
+func (f *FailoverTargets) UnmarshalJSON(data []byte) error {
+	var target string
+	if err := json.Unmarshal(data, &target); err == nil {
+		*f = nil
+		if target != "" {
+			*f = FailoverTargets{target}
+		}
+		return nil
+	}
+
+	var targets []string
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return fmt.Errorf("failover must be a name or an array of names: %w", err)
+	}
+	*f = targets
+	return nil
+}
+
+// MarshalJSON writes a single target as a plain name for compatibility.
+func (f FailoverTargets) MarshalJSON() ([]byte, error) {
+	if len(f) == 1 {
+		return json.Marshal(f[0])
+	}
+	return json.Marshal([]string(f))
+}
+
+// endpoints returns the IPs of the record as endpoints, converting the plain
+// ips array (and ip_regions) when no endpoints are given.
+func (r *DNSRecord) endpoints() []Endpoint {
+	if len(r.Endpoints) > 0 {
+		return r.Endpoints
+	}
+	eps := make([]Endpoint, 0, len(r.IPs))
+	for _, ip := range r.IPs {
+		eps = append(eps, Endpoint{IP: ip, Region: r.IPRegions[ip]})
+	}
+	return eps
 }
 
 // ElchiClient is the HTTP client for the Elchi DNS API.
 type ElchiClient struct {
-	endpoint   string
+	endpoints  *controllerPool
 	zone       string
-	secret     string
+	secrets    *secretSource
+	authMode   string      // authHMAC, authCompat or authLegacy
+	strictHash bool        // Reject version hashes that are not canonical hashes of the records
+	trusted    trustedKeys // Keys responses must be signed with (empty = signatures not required)
+	maxSize    int64       // Largest decoded response body read from a controller
+	encoding   string      // Preferred response encoding, encodingJSON or encodingProtobuf
 	nodeIP     string
 	regions    []string
 	httpClient *http.Client
+
+	// watchClient shares the transport of httpClient but has no overall
+	// timeout, as watch requests stay open until the controller has news.
+	watchClient *http.Client
 }
 
-// NewElchiClient creates a new Elchi DNS API client.
-func NewElchiClient(endpoint, zone, secret, nodeIP string, regions []string, timeout time.Duration, tlsSkipVerify bool) *ElchiClient {
+// NewElchiClient creates a new Elchi DNS API client. Requests go to the first
+// endpoint and move on to the next ones when it fails. tlsConfig configures
+// HTTPS endpoints (nil = verify against the system roots).
+func NewElchiClient(endpoints []string, zone, secret, nodeIP string, regions []string, timeout time.Duration, tlsConfig *controllerTLS) *ElchiClient {
 	transport := &http.Transport{
 		MaxIdleConns:        10,
 		MaxIdleConnsPerHost: 10,
 		IdleConnTimeout:     30 * time.Second,
 	}
 
-	// Configure TLS if skip verify is enabled
-	if tlsSkipVerify {
-		transport.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: true, //nolint:gosec // User explicitly requested to skip TLS verification
-		}
+	// Build the TLS config per connection, so rotated certificates are used
+	if tlsConfig != nil {
+		transport.DialTLSContext = tlsConfig.dialTLS
 	}
 
-	return &ElchiClient{
-		endpoint: strings.TrimRight(endpoint, "/"),
-		zone:     strings.TrimSuffix(zone, "."), // Remove trailing dot for API requests
-		secret:   secret,
-		nodeIP:   nodeIP,
-		regions:  regions,
+	client := &ElchiClient{
+		endpoints: newControllerPool(dns.Fqdn(zone), endpoints),
+		zone:      strings.TrimSuffix(zone, "."), // Remove trailing dot for API requests
+		secrets:   newSecretSource(secret),
+		authMode:  authCompat,
+		maxSize:   defaultMaxResponseSize,
+		encoding:  encodingJSON,
+		nodeIP:    nodeIP,
+		regions:   regions,
 		httpClient: &http.Client{
 			Timeout:   timeout,
 			Transport: transport,
 		},
 	}
+	client.watchClient = &http.Client{Transport: transport}
+	return client
 }
 
 // FetchSnapshot fetches the complete DNS snapshot from Elchi backend.
 func (c *ElchiClient) FetchSnapshot(ctx context.Context) (*DNSSnapshot, error) {
+	var records []DNSRecord
+	snapshot, err := c.StreamSnapshot(ctx, func() func(DNSRecord) {
+		records = nil
+		return func(record DNSRecord) {
+			records = append(records, record)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Records = records
+	return snapshot, nil
+}
+
+// StreamSnapshot fetches the complete DNS snapshot and passes its records to
+// a sink while they are decoded. newSink is called for every endpoint tried,
+// so records of a failed attempt can be dropped. The returned snapshot has no
+// records. It is only returned once the whole snapshot has been verified, so
+// the records passed to the sink must not be used before.
+func (c *ElchiClient) StreamSnapshot(ctx context.Context, newSink func() func(DNSRecord)) (*DNSSnapshot, error) {
+	var snapshot *DNSSnapshot
+	err := c.endpoints.do(ctx, func(endpoint string) error {
+		var err error
+		snapshot, err = c.fetchSnapshot(ctx, endpoint, newSink())
+		return err
+	})
+	return snapshot, err
+}
+
+// fetchSnapshot fetches the snapshot from a single controller endpoint.
+func (c *ElchiClient) fetchSnapshot(ctx context.Context, endpoint string, sink func(DNSRecord)) (*DNSSnapshot, error) {
 	// Build request URL
-	u, err := url.Parse(fmt.Sprintf("%s/dns/snapshot", c.endpoint))
+	u, err := url.Parse(fmt.Sprintf("%s/dns/snapshot", endpoint))
 	if err != nil {
 		return nil, fmt.Errorf("invalid endpoint URL: %w", err)
 	}
@@ -96,6 +216,8 @@ func (c *ElchiClient) FetchSnapshot(ctx context.Context) (*DNSSnapshot, error) {
 
 	// Add authentication headers
 	c.signRequest(req)
+	req.Header.Set("Accept", acceptHeader(c.encoding))
+	req.Header.Set("Accept-Encoding", acceptEncoding)
 
 	// Execute request
 	resp, err := c.httpClient.Do(req)
@@ -106,22 +228,50 @@ func (c *ElchiClient) FetchSnapshot(ctx context.Context) (*DNSSnapshot, error) {
 		_ = resp.Body.Close()
 	}()
 
-	// Read body once for both error handling and decoding
-	body, err := io.ReadAll(resp.Body)
+	body, release, err := responseBody(resp, c.maxSize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, err
 	}
+	defer release()
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+		message, _ := io.ReadAll(io.LimitReader(body, 4096))
+		return nil, &statusError{code: resp.StatusCode, body: string(message)}
 	}
 
-	// Parse response
+	// Decode the records straight into the sink. They are hashed on the way
+	// when the version hash or signature has to be checked, which is only
+	// known for sure when the version hash comes before the records. The
+	// hasher then buffers the encoded records, see canonicalHasher.
 	var snapshot DNSSnapshot
-	if err := json.Unmarshal(body, &snapshot); err != nil {
+	var hasher *canonicalHasher
+	first := true
+	decode := decodeSnapshot
+	if isProtobuf(resp.Header.Get("Content-Type")) {
+		decode = decodeSnapshotProto
+	}
+	err = decode(body, &snapshot, func(record DNSRecord) error {
+		if first {
+			first = false
+			if snapshot.VersionHash == "" || c.needsRecordsHash(snapshot.VersionHash) {
+				hasher = &canonicalHasher{}
+			}
+		}
+		if hasher != nil {
+			if err := hasher.add(&record); err != nil {
+				return err
+			}
+		}
+		sink(record)
+		return nil
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
+	if first {
+		hasher = &canonicalHasher{} // No records
+	}
 
 	// Validate response
 	if snapshot.Zone == "" {
@@ -130,14 +280,40 @@ func (c *ElchiClient) FetchSnapshot(ctx context.Context) (*DNSSnapshot, error) {
 	if snapshot.VersionHash == "" {
 		return nil, fmt.Errorf("invalid response: missing version_hash")
 	}
+	if hasher == nil {
+		if c.needsRecordsHash(snapshot.VersionHash) {
+			return nil, fmt.Errorf("invalid response: version_hash changed after the records")
+		}
+		return &snapshot, nil
+	}
+	recordsSum := hasher.sum()
+	if err := c.trusted.verifySnapshotSum(&snapshot, recordsSum); err != nil {
+		return nil, err
+	}
+	if isCanonicalHash(snapshot.VersionHash) || c.strictHash {
+		if err := checkVersionHash(snapshot.VersionHash, recordsSum); err != nil {
+			return nil, err
+		}
+	}
 
 	return &snapshot, nil
 }
 
 // CheckChanges checks for DNS changes since the given version hash.
 func (c *ElchiClient) CheckChanges(ctx context.Context, sinceHash string) (*DNSChangesResponse, error) {
+	var changes *DNSChangesResponse
+	err := c.endpoints.do(ctx, func(endpoint string) error {
+		var err error
+		changes, err = c.checkChanges(ctx, endpoint, sinceHash)
+		return err
+	})
+	return changes, err
+}
+
+// checkChanges checks a single controller endpoint for changes.
+func (c *ElchiClient) checkChanges(ctx context.Context, endpoint, sinceHash string) (*DNSChangesResponse, error) {
 	// Build request URL
-	u, err := url.Parse(fmt.Sprintf("%s/dns/changes", c.endpoint))
+	u, err := url.Parse(fmt.Sprintf("%s/dns/changes", endpoint))
 	if err != nil {
 		return nil, fmt.Errorf("invalid endpoint URL: %w", err)
 	}
@@ -145,6 +321,7 @@ func (c *ElchiClient) CheckChanges(ctx context.Context, sinceHash string) (*DNSC
 	q := u.Query()
 	q.Set("zone", c.zone)
 	q.Set("since", sinceHash)
+	q.Set("delta", "true")
 	c.addNodeIP(q)
 	c.addRegions(q)
 	u.RawQuery = q.Encode()
@@ -157,6 +334,8 @@ func (c *ElchiClient) CheckChanges(ctx context.Context, sinceHash string) (*DNSC
 
 	// Add authentication headers
 	c.signRequest(req)
+	req.Header.Set("Accept", acceptHeader(c.encoding))
+	req.Header.Set("Accept-Encoding", acceptEncoding)
 
 	// Execute request
 	resp, err := c.httpClient.Do(req)
@@ -175,38 +354,74 @@ func (c *ElchiClient) CheckChanges(ctx context.Context, sinceHash string) (*DNSC
 		}, nil
 	}
 
-	// Read body once for both error handling and decoding
-	body, err := io.ReadAll(resp.Body)
+	body, release, err := responseBody(resp, c.maxSize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, err
 	}
+	defer release()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+		message, _ := io.ReadAll(io.LimitReader(body, 4096))
+		return nil, &statusError{code: resp.StatusCode, body: string(message)}
 	}
 
 	// Parse response
 	var changes DNSChangesResponse
-	if err := json.Unmarshal(body, &changes); err != nil {
+	if err := decodeChanges(resp.Header.Get("Content-Type"), body, &changes); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
 	// Validate response
-	if !changes.Unchanged {
-		if changes.Zone == "" {
-			return nil, fmt.Errorf("invalid response: missing zone in changes")
-		}
-		if changes.VersionHash == "" {
-			return nil, fmt.Errorf("invalid response: missing version_hash in changes")
-		}
+	if err := changes.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.verifyChanges(&changes); err != nil {
+		return nil, err
 	}
 
 	return &changes, nil
 }
 
-// signRequest adds authentication headers to the request.
+// validate checks that a changes response carries a zone and version hash.
+func (r *DNSChangesResponse) validate() error {
+	if r.Unchanged {
+		return nil
+	}
+	if r.Zone == "" {
+		return fmt.Errorf("invalid response: missing zone in changes")
+	}
+	if r.VersionHash == "" {
+		return fmt.Errorf("invalid response: missing version_hash in changes")
+	}
+	return nil
+}
+
+// syncTimeout returns the time budget of one sync cycle, which leaves room
+// for trying every endpoint once.
+func (c *ElchiClient) syncTimeout() time.Duration {
+	return c.httpClient.Timeout * time.Duration(max(len(c.endpoints.endpoints), 1))
+}
+
+// activeEndpoint returns the controller endpoint currently preferred.
+func (c *ElchiClient) activeEndpoint() string {
+	if c == nil {
+		return ""
+	}
+	return c.endpoints.active()
+}
+
+// signRequest adds authentication headers to the request: the legacy
+// secret header in legacy mode, else an HMAC signature. Compat mode only
+// differs on the webhook side, the plugin never sends the plain secret next
+// to a signature, which would make the signature pointless.
 func (c *ElchiClient) signRequest(req *http.Request) {
-	req.Header.Set("X-Elchi-Secret", c.secret)
+	now := time.Now()
+	secret := c.secrets.signing(now)
+	if c.authMode == authLegacy {
+		req.Header.Set(headerSecret, secret)
+	} else {
+		signRequestHMAC(req, secret, nil, now)
+	}
 	req.Header.Set("Accept", "application/json")
 }
 
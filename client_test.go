@@ -23,8 +23,8 @@ func TestFetchSnapshot_Success(t *testing.T) {
 		}
 
 		// Verify auth headers
-		if secret := r.Header.Get("X-Elchi-Secret"); secret != "test-secret" {
-			t.Errorf("Expected secret test-secret, got %s", secret)
+		if err := newRequestVerifier(authHMAC, newSecretSource("test-secret"), 0).verify(r, time.Now()); err != nil {
+			t.Errorf("Expected a request signed with test-secret, got %v", err)
 		}
 
 		// Send response
@@ -46,7 +46,7 @@ func TestFetchSnapshot_Success(t *testing.T) {
 	defer server.Close()
 
 	// Create client
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", nil, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
 
 	// Fetch snapshot
 	ctx := context.Background()
@@ -75,7 +75,7 @@ func TestFetchSnapshot_HTTPError(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", nil, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
 
 	ctx := context.Background()
 	_, err := client.FetchSnapshot(ctx)
@@ -93,7 +93,7 @@ func TestFetchSnapshot_InvalidJSON(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", nil, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
 
 	ctx := context.Background()
 	_, err := client.FetchSnapshot(ctx)
@@ -111,7 +111,7 @@ func TestFetchSnapshot_Timeout(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", nil, 100*time.Millisecond, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 100*time.Millisecond, nil)
 
 	ctx := context.Background()
 	_, err := client.FetchSnapshot(ctx)
@@ -147,7 +147,7 @@ func TestCheckChanges_Unchanged(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", nil, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
 
 	ctx := context.Background()
 	changes, err := client.CheckChanges(ctx, "abc123")
@@ -182,7 +182,7 @@ func TestCheckChanges_Changed(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", nil, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
 
 	ctx := context.Background()
 	changes, err := client.CheckChanges(ctx, "abc123")
@@ -214,14 +214,17 @@ func TestSignRequest(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "my-secret-key", "", nil, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "my-secret-key", "", nil, 5*time.Second, nil)
 
 	ctx := context.Background()
 	_, _ = client.FetchSnapshot(ctx)
 
-	// Verify headers
-	if secret := capturedHeaders.Get("X-Elchi-Secret"); secret != "my-secret-key" {
-		t.Errorf("Expected X-Elchi-Secret: my-secret-key, got %s", secret)
+	// Verify headers, the default compat mode signs without sending the secret
+	if secret := capturedHeaders.Get("X-Elchi-Secret"); secret != "" {
+		t.Errorf("Expected no X-Elchi-Secret header, got %s", secret)
+	}
+	if capturedHeaders.Get("X-Elchi-Signature") == "" {
+		t.Error("Expected an X-Elchi-Signature header")
 	}
 	if accept := capturedHeaders.Get("Accept"); accept != "application/json" {
 		t.Errorf("Expected Accept: application/json, got %s", accept)
@@ -241,7 +244,7 @@ func TestFetchSnapshot_WithRegions(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", []string{"asya", "avrupa"}, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", []string{"asya", "avrupa"}, 5*time.Second, nil)
 
 	ctx := context.Background()
 	_, err := client.FetchSnapshot(ctx)
@@ -266,7 +269,7 @@ func TestFetchSnapshot_WithAllRegion(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", []string{"all"}, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", []string{"all"}, 5*time.Second, nil)
 
 	ctx := context.Background()
 	_, err := client.FetchSnapshot(ctx)
@@ -291,7 +294,7 @@ func TestFetchSnapshot_WithoutRegions(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", nil, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
 
 	ctx := context.Background()
 	_, err := client.FetchSnapshot(ctx)
@@ -312,7 +315,7 @@ func TestCheckChanges_WithRegions(t *testing.T) {
 	}))
 	defer server.Close()
 
-	client := NewElchiClient(server.URL, "gslb.elchi", "test-secret", "", []string{"asya"}, 5*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", []string{"asya"}, 5*time.Second, nil)
 
 	ctx := context.Background()
 	_, err := client.CheckChanges(ctx, "hash1")
@@ -324,3 +327,49 @@ func TestCheckChanges_WithRegions(t *testing.T) {
 		t.Errorf("Expected regions=asya, got %s", capturedQuery)
 	}
 }
+
+func TestFailoverTargets_JSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    FailoverTargets
+		wantErr bool
+	}{
+		{"single name", `{"failover": "europe.gslb.elchi"}`, FailoverTargets{"europe.gslb.elchi"}, false},
+		{"empty name", `{"failover": ""}`, nil, false},
+		{"missing", `{}`, nil, false},
+		{"ordered list", `{"failover": ["europe", "us", "static-sorry"]}`, FailoverTargets{"europe", "us", "static-sorry"}, false},
+		{"invalid", `{"failover": 42}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record DNSRecord
+			err := json.Unmarshal([]byte(tt.input), &record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(record.Failover) != len(tt.want) {
+				t.Fatalf("Failover = %v, want %v", record.Failover, tt.want)
+			}
+			for i := range tt.want {
+				if record.Failover[i] != tt.want[i] {
+					t.Errorf("Failover[%d] = %s, want %s", i, record.Failover[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	// A single target is written back as a plain name
+	data, _ := json.Marshal(DNSRecord{Name: "app.gslb.elchi", Failover: FailoverTargets{"europe.gslb.elchi"}})
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["failover"] != "europe.gslb.elchi" {
+		t.Errorf("Expected single failover target as string, got %v", raw["failover"])
+	}
+}
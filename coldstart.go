@@ -0,0 +1,39 @@
+package elchi
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// Cold start policies, applied while no snapshot has been loaded yet.
+const (
+	coldStartServfail    = "servfail"    // Answer SERVFAIL so resolvers retry elsewhere
+	coldStartRefused     = "refused"     // Answer REFUSED
+	coldStartFallthrough = "fallthrough" // Pass queries to the next plugin
+	coldStartNXDOMAIN    = "nxdomain"    // Answer from the empty cache (authoritative NXDOMAIN)
+)
+
+// startupRetryInterval is the delay between initial snapshot attempts while
+// waiting for startup_wait.
+const startupRetryInterval = time.Second
+
+// serveColdStart answers a query according to the cold start policy. Negative
+// answers from an empty cache would be cached by resolvers as the truth, so
+// they are replaced with an error or handed to the next plugin.
+func (e *Elchi) serveColdStart(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	coldStartResponses.WithLabelValues(e.Zone, e.ColdStartPolicy).Inc()
+	log.Debugf("No snapshot loaded yet, applying cold_start_policy %s", e.ColdStartPolicy)
+
+	switch e.ColdStartPolicy {
+	case coldStartFallthrough:
+		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
+	case coldStartRefused:
+		// CoreDNS writes the error response for us
+		return dns.RcodeRefused, nil
+	default:
+		return dns.RcodeServerFailure, nil
+	}
+}
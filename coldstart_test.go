@@ -0,0 +1,106 @@
+package elchi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNS_ColdStartPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantCode int
+	}{
+		{coldStartServfail, dns.RcodeServerFailure},
+		{coldStartRefused, dns.RcodeRefused},
+		{coldStartFallthrough, dns.RcodeBadCookie}, // answered by the next plugin
+		{coldStartNXDOMAIN, dns.RcodeNameError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			e := &Elchi{
+				Zone:            "gslb.elchi.",
+				TTL:             300,
+				ColdStartPolicy: tt.policy,
+				Next:            test.NextHandler(dns.RcodeBadCookie, nil),
+			}
+			e.cache = NewRecordCache("gslb.elchi.")
+
+			m := new(dns.Msg)
+			m.SetQuestion("test.gslb.elchi.", dns.TypeA)
+			rec := &testResponseWriter{}
+			code, err := e.ServeDNS(context.Background(), rec, m)
+			if err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("Expected rcode %d, got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestServeDNS_ColdStartEndsWithSnapshot(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, ColdStartPolicy: coldStartServfail}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi.", VersionHash: "v1"}, 300)
+
+	m := new(dns.Msg)
+	m.SetQuestion("test.gslb.elchi.", dns.TypeA)
+	rec := &testResponseWriter{}
+	code, _ := e.ServeDNS(context.Background(), rec, m)
+
+	// An empty but loaded snapshot is the truth
+	if code != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN after the first snapshot, got %d", code)
+	}
+}
+
+func TestInitClient_StartupWait(t *testing.T) {
+	controller := newMockController()
+	controller.setSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records:     []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+	})
+
+	// The controller fails the first request
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		controller.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	e := &Elchi{
+		Endpoints:       []string{server.URL},
+		Zone:            "gslb.elchi.",
+		Secret:          "test-secret",
+		TTL:             300,
+		SyncInterval:    time.Minute,
+		Timeout:         time.Second,
+		ColdStartPolicy: coldStartServfail,
+		StartupWait:     10 * time.Second,
+	}
+	if err := e.InitClient(); err != nil {
+		t.Fatalf("InitClient failed: %v", err)
+	}
+	defer e.Shutdown()
+
+	if got := e.cache.GetVersionHash(); got != "v1" {
+		t.Errorf("Expected snapshot v1 to be loaded before serving, got %q", got)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("Expected 2 snapshot requests, got %d", requests.Load())
+	}
+}
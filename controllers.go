@@ -0,0 +1,155 @@
+package elchi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned when every controller endpoint has an open
+// circuit breaker, so no request was made.
+var errCircuitOpen = errors.New("circuit breaker open for every controller endpoint")
+
+// controllerEndpoint is the base URL of one controller instance.
+type controllerEndpoint struct {
+	url          string
+	failures     int       // Consecutive failed requests
+	serverErrors int       // Consecutive 5xx responses
+	openUntil    time.Time // Requests are skipped until then while the circuit breaker is open
+}
+
+// statusError is an unexpected HTTP status code from the controller.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d: %s", e.code, e.body)
+}
+
+// isServerError reports whether err is a 5xx response from the controller.
+func isServerError(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.code >= http.StatusInternalServerError
+}
+
+// controllerPool spreads requests over several controller instances. The
+// endpoint that answered last is tried first, so a node sticks to one
+// controller until it fails.
+type controllerPool struct {
+	mu        sync.Mutex
+	zone      string
+	endpoints []*controllerEndpoint
+	preferred *controllerEndpoint
+}
+
+// newControllerPool creates a pool for the given base URLs, preferring the
+// first one.
+func newControllerPool(zone string, urls []string) *controllerPool {
+	p := &controllerPool{zone: zone}
+	for _, u := range urls {
+		p.endpoints = append(p.endpoints, &controllerEndpoint{url: strings.TrimRight(u, "/")})
+	}
+	if len(p.endpoints) > 0 {
+		p.preferred = p.endpoints[0]
+	}
+	return p
+}
+
+// order returns the endpoints in the order they are tried: the preferred one
+// first, then the others by consecutive failures, in configuration order on
+// ties. Endpoints with an open circuit breaker are left out.
+func (p *controllerPool) order(now time.Time) []*controllerEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	order := make([]*controllerEndpoint, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		if !now.Before(ep.openUntil) {
+			order = append(order, ep)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if (order[i] == p.preferred) != (order[j] == p.preferred) {
+			return order[i] == p.preferred
+		}
+		return order[i].failures < order[j].failures
+	})
+	return order
+}
+
+// report records the result of a request to ep. A successful endpoint
+// becomes the preferred one. After breakerThreshold 5xx responses in a row
+// the endpoint's circuit breaker opens for breakerCooldown; once it expires
+// a single trial request decides whether it closes or opens again.
+func (p *controllerPool) report(ep *controllerEndpoint, err error, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		ep.failures++
+		controllerErrors.WithLabelValues(p.zone, ep.url).Inc()
+		if isServerError(err) {
+			ep.serverErrors++
+			if ep.serverErrors >= breakerThreshold {
+				log.Warningf("Controller %s returned %d server errors in a row, pausing requests for %v",
+					ep.url, ep.serverErrors, breakerCooldown)
+				ep.openUntil = now.Add(breakerCooldown)
+				circuitBreakerOpen.WithLabelValues(p.zone, ep.url).Set(1)
+			}
+		}
+		return
+	}
+	ep.failures = 0
+	if ep.serverErrors >= breakerThreshold {
+		log.Infof("Controller %s recovered, closing circuit breaker", ep.url)
+		circuitBreakerOpen.WithLabelValues(p.zone, ep.url).Set(0)
+	}
+	ep.serverErrors = 0
+	if p.preferred != ep {
+		log.Infof("Switching to controller %s", ep.url)
+		p.preferred = ep
+	}
+}
+
+// active returns the URL of the preferred endpoint.
+func (p *controllerPool) active() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.preferred.url
+}
+
+// do runs fn against the endpoints in order until one succeeds. Only when
+// every endpoint failed is an error returned, so the caller counts a single
+// sync error per cycle.
+func (p *controllerPool) do(ctx context.Context, fn func(endpoint string) error) error {
+	order := p.order(time.Now())
+	if len(order) == 0 {
+		return errCircuitOpen
+	}
+
+	var err error
+	for i, ep := range order {
+		if i > 0 && ctx.Err() != nil {
+			break
+		}
+		err = fn(ep.url)
+		p.report(ep, err, time.Now())
+		if err == nil {
+			return nil
+		}
+		if len(order) > 1 {
+			err = fmt.Errorf("controller %s: %w", ep.url, err)
+			if i < len(order)-1 {
+				log.Warningf("Request to %v, trying next controller", err)
+			}
+		}
+	}
+	return err
+}
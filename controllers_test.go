@@ -0,0 +1,171 @@
+package elchi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newControllerServer returns a mock controller that serves a snapshot with
+// the given hash, or 503 while down is set. It counts the requests it gets.
+func newControllerServer(t *testing.T, hash string, down *atomic.Bool, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(DNSSnapshot{Zone: "gslb.elchi", VersionHash: hash})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestControllerPool_FailoverAndStickiness(t *testing.T) {
+	var down1, down2 atomic.Bool
+	var requests1, requests2 atomic.Int32
+	server1 := newControllerServer(t, "from-1", &down1, &requests1)
+	server2 := newControllerServer(t, "from-2", &down2, &requests2)
+
+	client := NewElchiClient([]string{server1.URL, server2.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	ctx := context.Background()
+
+	// The first controller is down, the request is retried on the second one
+	down1.Store(true)
+	snapshot, err := client.FetchSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("FetchSnapshot failed: %v", err)
+	}
+	if snapshot.VersionHash != "from-2" {
+		t.Errorf("Expected snapshot from the second controller, got %s", snapshot.VersionHash)
+	}
+	if got := client.activeEndpoint(); got != server2.URL {
+		t.Errorf("Expected active endpoint %s, got %s", server2.URL, got)
+	}
+
+	// Once back, the first controller is not used while the second one works
+	down1.Store(false)
+	requests1.Store(0)
+	if _, err := client.FetchSnapshot(ctx); err != nil {
+		t.Fatalf("FetchSnapshot failed: %v", err)
+	}
+	if requests1.Load() != 0 {
+		t.Errorf("Expected no requests to the first controller, got %d", requests1.Load())
+	}
+
+	// The second controller goes down, so the node switches back
+	down2.Store(true)
+	snapshot, err = client.FetchSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("FetchSnapshot failed: %v", err)
+	}
+	if snapshot.VersionHash != "from-1" {
+		t.Errorf("Expected snapshot from the first controller, got %s", snapshot.VersionHash)
+	}
+}
+
+func TestControllerPool_AllDown(t *testing.T) {
+	var down atomic.Bool
+	var requests1, requests2 atomic.Int32
+	down.Store(true)
+	server1 := newControllerServer(t, "from-1", &down, &requests1)
+	server2 := newControllerServer(t, "from-2", &down, &requests2)
+
+	client := NewElchiClient([]string{server1.URL, server2.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	if _, err := client.CheckChanges(context.Background(), "v1"); err == nil {
+		t.Fatal("Expected error with every controller down")
+	}
+	if requests1.Load() != 1 || requests2.Load() != 1 {
+		t.Errorf("Expected one request per controller, got %d and %d", requests1.Load(), requests2.Load())
+	}
+}
+
+func TestControllerPool_Order(t *testing.T) {
+	p := newControllerPool("gslb.elchi.", []string{"http://a/", "http://b", "http://c"})
+	a, b, c := p.endpoints[0], p.endpoints[1], p.endpoints[2]
+	if a.url != "http://a" {
+		t.Errorf("Expected trailing slash to be trimmed, got %s", a.url)
+	}
+
+	// Failing endpoints are tried after the healthy ones
+	p.report(b, context.DeadlineExceeded, time.Now())
+	order := p.order(time.Now())
+	if order[0] != a || order[1] != c || order[2] != b {
+		t.Errorf("Expected order a, c, b, got %s, %s, %s", order[0].url, order[1].url, order[2].url)
+	}
+
+	// A success makes an endpoint the preferred one
+	p.report(c, nil, time.Now())
+	if order := p.order(time.Now()); order[0] != c || order[1] != a {
+		t.Errorf("Expected c then a first, got %s, %s", order[0].url, order[1].url)
+	}
+}
+
+func TestControllerPool_CircuitBreaker(t *testing.T) {
+	p := newControllerPool("gslb.elchi.", []string{"http://a", "http://b"})
+	a := p.endpoints[0]
+	now := time.Now()
+	serverErr := &statusError{code: http.StatusBadGateway, body: "bad gateway"}
+
+	// Errors other than 5xx do not open the breaker
+	for range breakerThreshold {
+		p.report(a, context.DeadlineExceeded, now)
+	}
+	if len(p.order(now)) != 2 {
+		t.Fatal("Expected both endpoints without server errors")
+	}
+
+	for range breakerThreshold {
+		p.report(a, serverErr, now)
+	}
+	if order := p.order(now); len(order) != 1 || order[0] == a {
+		t.Fatalf("Expected a to be skipped while its breaker is open, got %d endpoints", len(order))
+	}
+
+	// After the cooldown a trial request is allowed, and a failure opens it again
+	later := now.Add(breakerCooldown)
+	if order := p.order(later); len(order) != 2 {
+		t.Fatalf("Expected a trial request after the cooldown, got %d endpoints", len(order))
+	}
+	p.report(a, serverErr, later)
+	if len(p.order(later)) != 1 {
+		t.Fatal("Expected the breaker to open again after a failed trial")
+	}
+
+	// A successful trial closes it
+	later = later.Add(breakerCooldown)
+	p.report(a, nil, later)
+	p.report(a, serverErr, later)
+	if len(p.order(later)) != 2 {
+		t.Error("Expected the breaker to stay closed after a success")
+	}
+}
+
+func TestControllerPool_AllOpen(t *testing.T) {
+	var down atomic.Bool
+	var requests atomic.Int32
+	down.Store(true)
+	server := newControllerServer(t, "v1", &down, &requests)
+
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	for range breakerThreshold {
+		if _, err := client.FetchSnapshot(context.Background()); err == nil {
+			t.Fatal("Expected error from a failing controller")
+		}
+	}
+
+	// The controller is not contacted while its breaker is open
+	_, err := client.FetchSnapshot(context.Background())
+	if !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected errCircuitOpen, got %v", err)
+	}
+	if requests.Load() != breakerThreshold {
+		t.Errorf("Expected %d requests, got %d", breakerThreshold, requests.Load())
+	}
+}
@@ -0,0 +1,339 @@
+package elchi
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDampeningPenalty     = 1000             // Penalty added per change
+	defaultDampeningSuppress    = 2000             // Penalty above which changes are held back
+	defaultDampeningReuse       = 750              // Penalty below which held back changes are applied
+	defaultDampeningHalfLife    = 15 * time.Minute // Time for a penalty to decay by half
+	defaultDampeningMaxSuppress = time.Hour        // Longest suppression after the last change
+	dampeningReleaseInterval    = time.Second      // How often suppressed names are checked for release
+)
+
+// DampeningConfig configures flap dampening, modeled on BGP route
+// dampening. Every change to the records of a name adds Penalty to its
+// penalty, which decays by half every HalfLife. Above Suppress the name keeps
+// its records until the penalty has decayed below Reuse, then the latest
+// records are applied.
+type DampeningConfig struct {
+	Penalty     int
+	Suppress    int
+	Reuse       int
+	HalfLife    time.Duration
+	MaxSuppress time.Duration // The penalty is capped so a name is released at most this long after its last change
+}
+
+// defaultDampening returns the dampening defaults of the dampening directive.
+func defaultDampening() *DampeningConfig {
+	return &DampeningConfig{
+		Penalty:     defaultDampeningPenalty,
+		Suppress:    defaultDampeningSuppress,
+		Reuse:       defaultDampeningReuse,
+		HalfLife:    defaultDampeningHalfLife,
+		MaxSuppress: defaultDampeningMaxSuppress,
+	}
+}
+
+// maxPenalty returns the penalty that decays to Reuse in MaxSuppress.
+func (d *DampeningConfig) maxPenalty() float64 {
+	return float64(d.Reuse) * math.Exp2(float64(d.MaxSuppress)/float64(d.HalfLife))
+}
+
+// validate checks that names can be suppressed and released again.
+func (d *DampeningConfig) validate() error {
+	switch {
+	case d.Penalty < 1 || d.Suppress < 1 || d.Reuse < 1:
+		return fmt.Errorf("penalty, suppress and reuse must be positive")
+	case d.Reuse >= d.Suppress:
+		return fmt.Errorf("reuse %d must be below suppress %d", d.Reuse, d.Suppress)
+	case d.HalfLife <= 0 || d.MaxSuppress <= 0:
+		return fmt.Errorf("half_life and max_suppress must be positive")
+	case float64(d.Suppress) >= d.maxPenalty():
+		return fmt.Errorf("suppress %d is never reached, the penalty is capped at %.0f by max_suppress %v",
+			d.Suppress, d.maxPenalty(), d.MaxSuppress)
+	}
+	return nil
+}
+
+// flapState tracks the penalty of a name that changed.
+type flapState struct {
+	penalty    float64   // Penalty as of updated
+	updated    time.Time // Last change
+	state      string    // Records last received from the controller, see recordsState
+	changes    int       // Changes since the name is tracked
+	suppressed bool
+	since      time.Time         // Start of the suppression
+	pending    map[uint16]*rrSet // Records last received while suppressed (nil = removed)
+}
+
+// decayed returns the penalty at now.
+func (s *flapState) decayed(now time.Time, halfLife time.Duration) float64 {
+	return s.penalty * math.Exp2(-float64(now.Sub(s.updated))/float64(halfLife))
+}
+
+// dampener holds back changes to names that change too often. Its methods
+// must be called with the cache write lock held.
+type dampener struct {
+	zone       string
+	config     DampeningConfig
+	maxPenalty float64
+	names      map[string]*flapState
+	suppressed int // Number of suppressed names
+}
+
+// newDampener creates a dampener for the names of zone.
+func newDampener(zone string, config DampeningConfig) *dampener {
+	return &dampener{
+		zone:       zone,
+		config:     config,
+		maxPenalty: config.maxPenalty(),
+		names:      make(map[string]*flapState),
+	}
+}
+
+// observe tracks the records received for domain (nil = removed) and returns
+// the records to serve. current are the records served now.
+func (d *dampener) observe(domain string, current, next map[uint16]*rrSet, now time.Time) map[uint16]*rrSet {
+	if sameRRSets(current, next) {
+		return next
+	}
+
+	st := d.names[domain]
+	state := recordsState(next)
+	if st == nil {
+		// New names are not penalized
+		if current == nil || state == recordsState(current) {
+			return next
+		}
+		st = &flapState{state: recordsState(current), updated: now}
+		d.names[domain] = st
+	}
+
+	if state != st.state {
+		st.penalty = min(st.decayed(now, d.config.HalfLife)+float64(d.config.Penalty), d.maxPenalty)
+		st.updated = now
+		st.state = state
+		st.changes++
+		recordFlaps.WithLabelValues(d.zone).Inc()
+
+		if !st.suppressed && st.penalty > float64(d.config.Suppress) {
+			st.suppressed = true
+			st.since = now
+			d.suppressed++
+			dampeningEvents.WithLabelValues(d.zone, "suppressed").Inc()
+			suppressedNames.WithLabelValues(d.zone).Set(float64(d.suppressed))
+			log.Warningf("Dampening: %s changed %d times (penalty %.0f), holding back its changes",
+				domain, st.changes, st.penalty)
+		}
+	}
+
+	if st.suppressed {
+		st.pending = next
+		return current
+	}
+	return next
+}
+
+// release returns the records of the suppressed names whose penalty has
+// decayed below the reuse threshold (nil = removed), and forgets names whose
+// penalty has decayed to half of it.
+func (d *dampener) release(now time.Time) map[string]map[uint16]*rrSet {
+	var released map[string]map[uint16]*rrSet
+	for domain, st := range d.names {
+		penalty := st.decayed(now, d.config.HalfLife)
+		switch {
+		case st.suppressed && penalty < float64(d.config.Reuse):
+			if released == nil {
+				released = make(map[string]map[uint16]*rrSet)
+			}
+			released[domain] = st.pending
+			st.suppressed = false
+			st.pending = nil
+			d.suppressed--
+			dampeningEvents.WithLabelValues(d.zone, "released").Inc()
+			log.Infof("Dampening: %s is stable again after %v, applying its latest records",
+				domain, now.Sub(st.since).Round(time.Second))
+
+		case !st.suppressed && penalty < float64(d.config.Reuse)/2:
+			delete(d.names, domain)
+		}
+	}
+	suppressedNames.WithLabelValues(d.zone).Set(float64(d.suppressed))
+	return released
+}
+
+// apply dampens the replacement of the records served now by next, built
+// from currentSources and nextSources. The records of suppressed names are
+// kept in next.
+func (d *dampener) apply(current, next map[string]map[uint16]*rrSet, currentSources, nextSources map[string][]DNSRecord, now time.Time) {
+	for domain, sets := range next {
+		// A full snapshot builds new RR sets for every name, untracked names
+		// whose records did not change cannot flap
+		if d.names[domain] == nil && reflect.DeepEqual(currentSources[domain], nextSources[domain]) {
+			continue
+		}
+		if serve := d.observe(domain, current[domain], sets, now); !sameRRSets(serve, sets) {
+			if len(serve) == 0 {
+				delete(next, domain)
+			} else {
+				next[domain] = serve
+			}
+		}
+	}
+	for domain, sets := range current {
+		if _, ok := next[domain]; ok {
+			continue
+		}
+		if serve := d.observe(domain, sets, nil, now); len(serve) > 0 {
+			next[domain] = serve
+		}
+	}
+}
+
+// dampenedView describes a suppressed name for the webhook server.
+type dampenedView struct {
+	name    string
+	penalty float64
+	changes int
+	since   time.Time
+	until   time.Time // Release if the name does not change again
+}
+
+// views returns the suppressed names sorted by name.
+func (d *dampener) views(now time.Time) []dampenedView {
+	var views []dampenedView
+	for domain, st := range d.names {
+		if !st.suppressed {
+			continue
+		}
+		penalty := st.decayed(now, d.config.HalfLife)
+		wait := math.Log2(penalty/float64(d.config.Reuse)) * float64(d.config.HalfLife)
+		views = append(views, dampenedView{
+			name:    domain,
+			penalty: penalty,
+			changes: st.changes,
+			since:   st.since,
+			until:   now.Add(time.Duration(max(wait, 0))),
+		})
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].name < views[j].name })
+	return views
+}
+
+// sameRRSets reports whether a and b hold the same RR sets.
+func sameRRSets(a, b map[uint16]*rrSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for qtype, set := range a {
+		if b[qtype] != set {
+			return false
+		}
+	}
+	return true
+}
+
+// recordsState describes what the records of a name answer with: their IPs
+// and weights, or failover CNAME, and failover targets. TTLs and other
+// settings are left out, a change to them does not count as a flap.
+func recordsState(sets map[uint16]*rrSet) string {
+	qtypes := make([]int, 0, len(sets))
+	for qtype := range sets {
+		qtypes = append(qtypes, int(qtype))
+	}
+	sort.Ints(qtypes)
+
+	var b strings.Builder
+	for _, qtype := range qtypes {
+		set := sets[uint16(qtype)]
+		answers := make([]string, len(set.rrs))
+		for i, rr := range set.rrs {
+			answers[i] = strings.TrimPrefix(rr.String(), rr.Header().String())
+			if set.weights != nil {
+				answers[i] += fmt.Sprintf("/%d", set.weights[i])
+			}
+		}
+		sort.Strings(answers)
+		fmt.Fprintf(&b, "%s %s", dns.TypeToString[uint16(qtype)], strings.Join(answers, ","))
+		for _, name := range set.failoverNames() {
+			b.WriteString(" " + name)
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// RunDampening applies the held back records of suppressed names once their
+// penalty has decayed, until ctx is canceled.
+func (c *RecordCache) RunDampening(ctx context.Context) {
+	ticker := time.NewTicker(dampeningReleaseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.releaseDampened(now)
+		}
+	}
+}
+
+// releaseDampened applies the held back records of names that are stable
+// again.
+func (c *RecordCache) releaseDampened(now time.Time) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	released := c.dampener.release(now)
+	if len(released) == 0 {
+		return
+	}
+	for domain, sets := range released {
+		if len(sets) == 0 {
+			delete(c.records, domain)
+		} else {
+			c.records[domain] = sets
+		}
+	}
+	c.updatedAt = now
+	c.generation++
+	c.updateCacheSizeMetric()
+}
+
+// setRecords replaces the RR sets of domain (nil = remove), unless dampening
+// holds the change back. c.mu must be held for writing.
+func (c *RecordCache) setRecords(domain string, sets map[uint16]*rrSet, now time.Time) {
+	if c.dampener != nil {
+		sets = c.dampener.observe(domain, c.records[domain], sets, now)
+	}
+	if len(sets) == 0 {
+		delete(c.records, domain)
+	} else {
+		c.records[domain] = sets
+	}
+}
+
+// suppressed returns the names whose changes are held back by dampening.
+func (c *RecordCache) suppressed() []dampenedView {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.dampener == nil {
+		return nil
+	}
+	return c.dampener.views(time.Now())
+}
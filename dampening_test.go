@@ -0,0 +1,213 @@
+package elchi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cachedIPs returns the IPs the cache answers for an A query of qname.
+func cachedIPs(cache *RecordCache, qname string) []string {
+	var ips []string
+	for _, rr := range cache.Get(qname, dns.TypeA) {
+		ips = append(ips, rrIP(rr))
+	}
+	return ips
+}
+
+func TestDampening_Notify(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.dampener = newDampener(cache.zone, *defaultDampening())
+	cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: []DNSRecord{
+		{Name: "flappy.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		{Name: "stable.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+	}}, 300)
+	flap := func(ip string) {
+		t.Helper()
+		if err := cache.Update([]DNSRecord{{Name: "flappy.gslb.elchi", Type: "A", IPs: []string{ip}}}, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flap("192.168.1.20")
+	flap("192.168.1.10")
+	if got := cachedIPs(cache, "flappy.gslb.elchi."); !slices.Equal(got, []string{"192.168.1.10"}) {
+		t.Fatalf("Expected changes below the threshold to be applied, got %v", got)
+	}
+
+	// The third change crosses the suppress threshold
+	flap("192.168.1.20")
+	if got := cachedIPs(cache, "flappy.gslb.elchi."); !slices.Equal(got, []string{"192.168.1.10"}) {
+		t.Errorf("Expected the suppressed name to keep its records, got %v", got)
+	}
+	flap("192.168.1.30")
+	suppressed := cache.suppressed()
+	if len(suppressed) != 1 || suppressed[0].name != "flappy.gslb.elchi." || suppressed[0].changes != 4 {
+		t.Fatalf("Unexpected suppressed names %+v", suppressed)
+	}
+	if !suppressed[0].until.After(time.Now().Add(defaultDampeningHalfLife)) {
+		t.Errorf("Expected a release after more than one half-life, got %v", suppressed[0].until)
+	}
+
+	// Other names are not held back
+	if err := cache.Update([]DNSRecord{{Name: "stable.gslb.elchi", Type: "A", IPs: []string{"192.168.2.20"}}}, 300); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedIPs(cache, "stable.gslb.elchi."); !slices.Equal(got, []string{"192.168.2.20"}) {
+		t.Errorf("Expected the stable name to change, got %v", got)
+	}
+
+	// Not yet stable
+	cache.releaseDampened(time.Now().Add(defaultDampeningHalfLife))
+	if got := cachedIPs(cache, "flappy.gslb.elchi."); !slices.Equal(got, []string{"192.168.1.10"}) {
+		t.Errorf("Expected the name to stay suppressed, got %v", got)
+	}
+
+	// The latest records are applied once the penalty has decayed
+	generation := cache.Generation()
+	cache.releaseDampened(time.Now().Add(defaultDampeningMaxSuppress))
+	if got := cachedIPs(cache, "flappy.gslb.elchi."); !slices.Equal(got, []string{"192.168.1.30"}) {
+		t.Errorf("Expected the latest records after the release, got %v", got)
+	}
+	if cache.Generation() == generation {
+		t.Error("Expected the release to change the cache generation")
+	}
+	if len(cache.suppressed()) != 0 {
+		t.Error("Expected no suppressed names after the release")
+	}
+}
+
+func TestDampening_Snapshot(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.dampener = newDampener(cache.zone, *defaultDampening())
+	cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: []DNSRecord{
+		{Name: "flappy.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		{Name: "stable.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+	}}, 300)
+	stable := DNSRecord{Name: "stable.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}}
+	load := func(version string, records ...DNSRecord) {
+		t.Helper()
+		if err := cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: version, Records: records}, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Removing and adding back a name are changes too
+	load("v2", stable)
+	load("v3", stable, DNSRecord{Name: "flappy.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}})
+	load("v4", stable)
+	if got := cachedIPs(cache, "flappy.gslb.elchi."); !slices.Equal(got, []string{"192.168.1.10"}) {
+		t.Fatalf("Expected the suppressed name to stay, got %v", got)
+	}
+	if hash := cache.GetVersionHash(); hash != "v4" {
+		t.Errorf("Expected the version hash of the received snapshot, got %s", hash)
+	}
+
+	// The same records on every sync are no change
+	load("v4", stable)
+	if suppressed := cache.suppressed(); len(suppressed) != 1 || suppressed[0].changes != 3 {
+		t.Fatalf("Unexpected suppressed names %+v", suppressed)
+	}
+
+	// Delta syncs keep the name untouched
+	if err := cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v4",
+		VersionHash: "v5",
+		Records:     []DNSRecord{{Name: "new.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}}},
+	}, 300); err != nil {
+		t.Fatalf("ApplyDelta failed: %v", err)
+	}
+	if suppressed := cache.suppressed(); len(suppressed) != 1 || suppressed[0].changes != 3 {
+		t.Errorf("Expected the delta not to count as a change, got %+v", suppressed)
+	}
+
+	// The name was removed last, so it goes away on release
+	cache.releaseDampened(time.Now().Add(defaultDampeningMaxSuppress))
+	if cache.HasName("flappy.gslb.elchi.") {
+		t.Error("Expected the removed name to go away after the release")
+	}
+	if !cache.HasName("new.gslb.elchi.") {
+		t.Error("Expected the delta to be applied")
+	}
+}
+
+func TestRecordsState(t *testing.T) {
+	state := func(record DNSRecord) string {
+		t.Helper()
+		set, err := buildRRSet(record, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recordsState(map[uint16]*rrSet{set.rrs[0].Header().Rrtype: set})
+	}
+	base := state(DNSRecord{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10", "192.168.1.11"}})
+
+	tests := []struct {
+		name   string
+		record DNSRecord
+		same   bool
+	}{
+		{"reordered IPs", DNSRecord{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.11", "192.168.1.10"}}, true},
+		{"other TTL", DNSRecord{Name: "app.gslb.elchi", Type: "A", TTL: 60, IPs: []string{"192.168.1.10", "192.168.1.11"}}, true},
+		{"other IP", DNSRecord{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10", "192.168.1.12"}}, false},
+		{"weighted", DNSRecord{Name: "app.gslb.elchi", Type: "A", Endpoints: []Endpoint{{IP: "192.168.1.10", Weight: 2}, {IP: "192.168.1.11"}}}, false},
+		{"failed over", DNSRecord{Name: "app.gslb.elchi", Type: "A", Failover: FailoverTargets{"eu.gslb.elchi"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := state(tt.record) == base; got != tt.same {
+				t.Errorf("Expected same state %v, got %v", tt.same, got)
+			}
+		})
+	}
+}
+
+func TestHandleRecords_Suppressed(t *testing.T) {
+	e := &Elchi{
+		Zone:   "gslb.elchi.",
+		Secret: "test-secret",
+		TTL:    300,
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.dampener = newDampener(e.cache.zone, *defaultDampening())
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: []DNSRecord{
+		{Name: "flappy.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+	}}, 300)
+	e.syncStatus = &SyncStatus{lastSyncStatus: "initial"}
+	for _, ip := range []string{"192.168.1.20", "192.168.1.10", "192.168.1.20"} {
+		if err := e.cache.Update([]DNSRecord{{Name: "flappy.gslb.elchi", Type: "A", IPs: []string{ip}}}, 300); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := NewWebhookServer(e, ":8053")
+
+	get := func(query string) RecordsResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/records"+query, nil)
+		req.Header.Set("X-Elchi-Secret", "test-secret")
+		rr := httptest.NewRecorder()
+		ws.authMiddleware(ws.handleRecords)(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+		var resp RecordsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return resp
+	}
+
+	resp := get("")
+	if len(resp.Suppressed) != 1 || resp.Suppressed[0].Name != "flappy.gslb.elchi" || resp.Suppressed[0].Changes != 3 {
+		t.Errorf("Unexpected suppressed names %+v", resp.Suppressed)
+	}
+	if resp := get("?name=stable"); len(resp.Suppressed) != 0 {
+		t.Errorf("Expected the name filter to apply to suppressed names, got %+v", resp.Suppressed)
+	}
+}
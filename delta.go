@@ -0,0 +1,203 @@
+package elchi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+)
+
+// errDeltaBaseMismatch is returned when a delta was computed against other
+// records than the ones in the cache.
+var errDeltaBaseMismatch = errors.New("delta base hash does not match the cache")
+
+// isDelta reports whether the response is a delta rather than a full record
+// list.
+func (r *DNSChangesResponse) isDelta() bool {
+	return r.BaseHash != ""
+}
+
+// ApplyDelta applies a delta to the cache. Deletes remove all records of
+// their name and type, then every record in changes.Records replaces the
+// records of its name and type. Only the touched names are rebuilt. The
+// delta must be based on the current version hash, else the cache is left
+// alone and errDeltaBaseMismatch is returned.
+func (c *RecordCache) ApplyDelta(changes *DNSChangesResponse, defaultTTL uint32) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// Writers are serialized, so the copies stay current while the delta is
+	// built without blocking queries
+	c.mu.RLock()
+	base := c.versionHash
+	records := maps.Clone(c.records)
+	sources := maps.Clone(c.sources)
+	c.mu.RUnlock()
+
+	if changes.BaseHash != base {
+		return fmt.Errorf("%w: delta from %s, cache at %s", errDeltaBaseMismatch, changes.BaseHash, base)
+	}
+
+	touched := make(map[string]bool)
+	remove := func(name, recordType string) {
+		domain := normalizeDomain(name)
+		sources[domain] = withoutType(sources[domain], recordType)
+		touched[domain] = true
+	}
+	for _, del := range changes.Deletes {
+		remove(del.Name, del.Type)
+	}
+	for _, record := range changes.Records {
+		remove(record.Name, record.Type)
+	}
+	for _, record := range changes.Records {
+		domain := normalizeDomain(record.Name)
+		if !c.inZone(domain) {
+			log.Warningf("Skipping record %s: not in zone %s", domain, c.zone)
+			continue
+		}
+		sources[domain] = append(sources[domain], record)
+	}
+
+	// Rebuild the touched names into fresh maps, the current ones are shared
+	// with the live cache
+	for domain := range touched {
+		delete(records, domain)
+		if len(sources[domain]) == 0 {
+			delete(sources, domain)
+			continue
+		}
+		for _, record := range sources[domain] {
+			addRecord(records, domain, record, defaultTTL)
+		}
+	}
+
+	if loop := findFailoverLoop(records); loop != nil {
+		return fmt.Errorf("failover loop in delta: %s", strings.Join(loop, " -> "))
+	}
+
+	// A canonical version hash covers all records after the delta, but only
+	// the records of the touched names have to be encoded again
+	var canonical *canonicalRecords
+	if isCanonicalHash(changes.VersionHash) {
+		var removed, added []DNSRecord
+		for domain := range touched {
+			removed = append(removed, c.sources[domain]...)
+			added = append(added, sources[domain]...)
+		}
+		var err error
+		if canonical, err = c.canonicalAfter(removed, added); err != nil {
+			return err
+		}
+		if err := checkVersionHash(changes.VersionHash, canonical.sum()); err != nil {
+			return err
+		}
+	}
+
+	recordCount, err := c.guardedReplace(records, sources, changes.VersionHash)
+	if err != nil {
+		return err
+	}
+	c.canonical = canonical
+
+	log.Infof("Delta applied: %d upserts, %d deletes, %d names rebuilt (total RRs: %d)",
+		len(changes.Records), len(changes.Deletes), len(touched), recordCount)
+	return nil
+}
+
+// Snapshot returns the records the cache was built from, with the current
+// version hash. Names are sorted, records of one name keep their order.
+func (c *RecordCache) Snapshot() *DNSSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return &DNSSnapshot{
+		Zone:        strings.TrimSuffix(c.zone, "."),
+		VersionHash: c.versionHash,
+		Records:     sortedRecords(c.sources),
+	}
+}
+
+// sortedRecords returns the records of sources sorted by name. Records of
+// one name keep their order.
+func sortedRecords(sources map[string][]DNSRecord) []DNSRecord {
+	domains := make([]string, 0, len(sources))
+	for domain := range sources {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var records []DNSRecord
+	for _, domain := range domains {
+		records = append(records, sources[domain]...)
+	}
+	return records
+}
+
+// canonicalAfter returns the canonical encodings of the cached records with
+// removed replaced by added. The encodings of the cached records are built on
+// the first delta with a canonical hash and kept for the next one.
+// c.writeMu must be held.
+func (c *RecordCache) canonicalAfter(removed, added []DNSRecord) (*canonicalRecords, error) {
+	if c.canonical == nil {
+		current, err := newCanonicalRecords(c.sources)
+		if err != nil {
+			return nil, err
+		}
+		c.canonical = current
+	}
+	return c.canonical.apply(removed, added)
+}
+
+// withoutType returns a new slice with the records of another type than
+// recordType.
+func withoutType(records []DNSRecord, recordType string) []DNSRecord {
+	var kept []DNSRecord
+	for _, record := range records {
+		if !strings.EqualFold(record.Type, recordType) {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
+
+// applyChanges loads a changes response into the cache: a delta on top of
+// the cached records when it has a base hash, else the full record list.
+func (e *Elchi) applyChanges(changes *DNSChangesResponse) error {
+	if !changes.isDelta() {
+		return e.applySnapshot(&DNSSnapshot{
+			Zone:        changes.Zone,
+			VersionHash: changes.VersionHash,
+			Records:     changes.Records,
+			Signature:   changes.Signature,
+		})
+	}
+
+	if err := e.cache.ApplyDelta(changes, e.TTL); err != nil {
+		return err
+	}
+	deltaSyncs.WithLabelValues(e.Zone, "applied").Inc()
+	e.persistCacheLater()
+	return nil
+}
+
+// loadChanges applies a changes response, fetching a full snapshot instead
+// when a delta does not fit the cached records or does not produce the
+// records of its version hash.
+func (e *Elchi) loadChanges(ctx context.Context, changes *DNSChangesResponse) error {
+	err := e.applyChanges(changes)
+	switch {
+	case errors.Is(err, errDeltaBaseMismatch):
+	case changes.isDelta() && isHashMismatch(err):
+		integrityErrors.WithLabelValues(e.Zone).Inc()
+	default:
+		return err
+	}
+
+	log.Warningf("%v, fetching full snapshot", err)
+	deltaSyncs.WithLabelValues(e.Zone, "fallback").Inc()
+	_, _, err = e.loadSnapshot(ctx)
+	return err
+}
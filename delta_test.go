@@ -0,0 +1,249 @@
+package elchi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestApplyDelta(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+			{Name: "dual.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+			{Name: "dual.gslb.elchi", Type: "AAAA", IPs: []string{"2001:db8::10"}},
+			{Name: "sorry.gslb.elchi", Type: "A", Failover: FailoverTargets{"sorry.static-elchi"}},
+		},
+	}, 300)
+	untouched := cache.lookup("app.gslb.elchi.", dns.TypeA)
+
+	err := cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: "v2",
+		Records: []DNSRecord{
+			{Name: "dual.gslb.elchi", Type: "A", IPs: []string{"192.168.2.20"}},
+			{Name: "new.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}},
+			{Name: "new.other.elchi", Type: "A", IPs: []string{"192.168.4.10"}},
+		},
+		Deletes: []DeleteRecord{{Name: "sorry.gslb.elchi", Type: "A"}},
+	}, 300)
+	if err != nil {
+		t.Fatalf("ApplyDelta failed: %v", err)
+	}
+
+	if hash := cache.GetVersionHash(); hash != "v2" {
+		t.Errorf("Expected hash v2, got %s", hash)
+	}
+	if got := cache.Get("dual.gslb.elchi.", dns.TypeA); len(got) != 1 || rrIP(got[0]) != "192.168.2.20" {
+		t.Errorf("Expected the upsert to replace dual A, got %v", got)
+	}
+	if got := cache.Get("dual.gslb.elchi.", dns.TypeAAAA); len(got) != 1 {
+		t.Errorf("Expected dual AAAA to be kept, got %v", got)
+	}
+	if got := cache.Get("new.gslb.elchi.", dns.TypeA); len(got) != 1 {
+		t.Errorf("Expected the new record, got %v", got)
+	}
+	if cache.HasName("new.other.elchi.") {
+		t.Error("Expected the out of zone record to be skipped")
+	}
+	// The failover-only record is a CNAME set, deleting its A record removes it
+	if cache.HasName("sorry.gslb.elchi.") {
+		t.Error("Expected the deleted failover record to be gone")
+	}
+	if cache.lookup("app.gslb.elchi.", dns.TypeA) != untouched {
+		t.Error("Expected names outside the delta not to be rebuilt")
+	}
+}
+
+func TestApplyDelta_BaseMismatch(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+
+	err := cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v0",
+		VersionHash: "v2",
+		Deletes:     []DeleteRecord{{Name: "app.gslb.elchi", Type: "A"}},
+	}, 300)
+	if !errors.Is(err, errDeltaBaseMismatch) {
+		t.Fatalf("Expected errDeltaBaseMismatch, got %v", err)
+	}
+	if cache.GetVersionHash() != "v1" || !cache.HasName("app.gslb.elchi.") {
+		t.Error("Expected the cache to be left alone")
+	}
+}
+
+func TestApplyDelta_FailoverLoop(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+
+	err := cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: "v2",
+		Records: []DNSRecord{
+			{Name: "a.gslb.elchi", Type: "A", Failover: FailoverTargets{"b.gslb.elchi"}},
+			{Name: "b.gslb.elchi", Type: "A", Failover: FailoverTargets{"a.gslb.elchi"}},
+		},
+	}, 300)
+	if err == nil {
+		t.Fatal("Expected error for a failover loop")
+	}
+	if cache.GetVersionHash() != "v1" || cache.HasName("a.gslb.elchi.") {
+		t.Error("Expected the cache to be left alone")
+	}
+}
+
+func TestRecordCache_Snapshot(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+			{Name: "dual.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+			{Name: "dual.gslb.elchi", Type: "AAAA", IPs: []string{"2001:db8::10"}},
+		},
+	}, 300)
+	if err := cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: "v2",
+		Deletes:     []DeleteRecord{{Name: "dual.gslb.elchi", Type: "AAAA"}},
+	}, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cache built from the snapshot matches the delta result
+	snapshot := cache.Snapshot()
+	if snapshot.VersionHash != "v2" || len(snapshot.Records) != 2 {
+		t.Fatalf("Expected 2 records at v2, got %d at %s", len(snapshot.Records), snapshot.VersionHash)
+	}
+	rebuilt := NewRecordCache("gslb.elchi.")
+	if err := rebuilt.ReplaceFromSnapshot(snapshot, 300); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.RRCount() != cache.RRCount() || rebuilt.HasName("dual.gslb.elchi.") != cache.HasName("dual.gslb.elchi.") {
+		t.Errorf("Expected the same cache from the snapshot, got %d RRs, want %d", rebuilt.RRCount(), cache.RRCount())
+	}
+}
+
+func TestPerformSync_Delta(t *testing.T) {
+	var snapshots int
+	base := "v1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dns/snapshot":
+			snapshots++
+			_ = json.NewEncoder(w).Encode(DNSSnapshot{
+				Zone:        "gslb.elchi",
+				VersionHash: "v3",
+				Records:     []DNSRecord{{Name: "full.gslb.elchi", Type: "A", IPs: []string{"192.168.9.10"}}},
+			})
+		case "/dns/changes":
+			if r.URL.Query().Get("delta") != "true" {
+				t.Errorf("Expected delta support to be announced, got %q", r.URL.Query().Get("delta"))
+			}
+			_ = json.NewEncoder(w).Encode(DNSChangesResponse{
+				Zone:        "gslb.elchi",
+				BaseHash:    base,
+				VersionHash: "v2",
+				Records:     []DNSRecord{{Name: "new.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}}},
+			})
+		}
+	}))
+	defer server.Close()
+
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, syncStatus: &SyncStatus{}}
+	e.client = NewElchiClient([]string{server.URL}, e.Zone, "test-secret", "", nil, 5*time.Second, nil)
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+
+	if !e.performSync() {
+		t.Fatal("Expected the delta sync to succeed")
+	}
+	if e.cache.GetVersionHash() != "v2" || !e.cache.HasName("new.gslb.elchi.") || !e.cache.HasName("app.gslb.elchi.") {
+		t.Errorf("Expected the delta on top of v1, got hash %s", e.cache.GetVersionHash())
+	}
+	if snapshots != 0 {
+		t.Errorf("Expected no snapshot fetch, got %d", snapshots)
+	}
+
+	// A delta from another base falls back to the full snapshot
+	base = "v0"
+	if !e.performSync() {
+		t.Fatal("Expected the fallback sync to succeed")
+	}
+	if e.cache.GetVersionHash() != "v3" || !e.cache.HasName("full.gslb.elchi.") || e.cache.HasName("app.gslb.elchi.") {
+		t.Errorf("Expected the full snapshot v3, got hash %s", e.cache.GetVersionHash())
+	}
+	if snapshots != 1 {
+		t.Errorf("Expected one snapshot fetch, got %d", snapshots)
+	}
+}
+
+func TestDelta_Persisted(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, PersistPath: t.TempDir() + "/snapshot.json"}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+			{Name: "dual.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+			{Name: "dual.gslb.elchi", Type: "AAAA", IPs: []string{"2001:db8::10"}},
+		},
+	}, 300)
+
+	err := e.loadChanges(context.Background(), &DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: "v2",
+		Deletes:     []DeleteRecord{{Name: "app.gslb.elchi", Type: "A"}},
+	})
+	if err != nil {
+		t.Fatalf("loadChanges failed: %v", err)
+	}
+
+	// The write is held back, so a burst of deltas rewrites the file once
+	if saved, _ := readPersistedSnapshot(e.PersistPath); saved != nil {
+		t.Fatalf("Expected the delta not to be persisted right away, got %+v", saved)
+	}
+	e.flushPersist()
+
+	saved, err := readPersistedSnapshot(e.PersistPath)
+	if err != nil || saved.VersionHash != "v2" || len(saved.Records) != 2 {
+		t.Errorf("Expected 2 persisted records at v2, got %+v, %v", saved, err)
+	}
+	if e.cancelPersist() {
+		t.Error("Expected no write to be pending after the flush")
+	}
+}
@@ -0,0 +1,123 @@
+package elchi
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// regionSubnet maps a client subnet to a region name.
+type regionSubnet struct {
+	prefix netip.Prefix
+	region string
+}
+
+// clientRegionTable maps client subnets to regions for EDNS Client Subnet (ECS)
+// aware answers. Lookups return the longest matching prefix.
+type clientRegionTable struct {
+	subnets []regionSubnet // sorted by prefix length, longest first
+}
+
+// add registers a client subnet (in CIDR notation) for the given region.
+func (t *clientRegionTable) add(region, cidr string) error {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %w", cidr, err)
+	}
+
+	t.subnets = append(t.subnets, regionSubnet{prefix: prefix.Masked(), region: region})
+
+	// Keep the most specific prefixes first so match returns the longest one
+	sort.SliceStable(t.subnets, func(i, j int) bool {
+		return t.subnets[i].prefix.Bits() > t.subnets[j].prefix.Bits()
+	})
+	return nil
+}
+
+// match returns the region and prefix length of the most specific subnet
+// containing addr.
+func (t *clientRegionTable) match(addr netip.Addr) (region string, bits int, ok bool) {
+	if t == nil || !addr.IsValid() {
+		return "", 0, false
+	}
+	addr = addr.Unmap()
+	for _, s := range t.subnets {
+		if s.prefix.Contains(addr) {
+			return s.region, s.prefix.Bits(), true
+		}
+	}
+	return "", 0, false
+}
+
+// clientSubnet returns the ECS option of the request (if any) and the client
+// address to use for region matching. Without ECS, the resolver's source
+// address is used. An ECS option with a source prefix length of 0 means the
+// client opted out of subnet-based answers, so no address is returned.
+func clientSubnet(state request.Request) (*dns.EDNS0_SUBNET, netip.Addr) {
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			ecs, ok := o.(*dns.EDNS0_SUBNET)
+			if !ok {
+				continue
+			}
+			if ecs.SourceNetmask == 0 {
+				return ecs, netip.Addr{}
+			}
+			addr, _ := netip.AddrFromSlice(ecs.Address)
+			return ecs, addr.Unmap()
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(net.ParseIP(state.IP()))
+	return nil, addr.Unmap()
+}
+
+// selectRegional picks the regional subset of the RR set for the client and
+// returns it together with the ECS scope prefix length for the answer.
+func (e *Elchi) selectRegional(set *rrSet, ecs *dns.EDNS0_SUBNET, client netip.Addr) (*rrSet, uint8) {
+	if !set.regional() {
+		// Same answer for everybody
+		return set, 0
+	}
+
+	region, bits, ok := e.clientRegions.match(client)
+	if !ok {
+		regionalAnswers.WithLabelValues(e.Zone, "none").Inc()
+		// The answer is only valid for the subnet the client sent
+		if ecs != nil {
+			return set, ecs.SourceNetmask
+		}
+		return set, 0
+	}
+
+	regionalAnswers.WithLabelValues(e.Zone, region).Inc()
+	return set.forRegion(region), uint8(bits) //nolint:gosec // Prefix length is at most 128
+}
+
+// setResponseEDNS mirrors the request's OPT record into the response and, when
+// the request carried an ECS option, echoes it back with the given scope
+// prefix length so downstream resolvers cache the answer for the right subnet.
+func setResponseEDNS(m *dns.Msg, r *dns.Msg, ecs *dns.EDNS0_SUBNET, scope uint8) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	m.SetEdns0(opt.UDPSize(), opt.Do())
+	if ecs == nil {
+		return
+	}
+
+	echo := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		SourceScope:   scope,
+		Address:       ecs.Address,
+	}
+	m.IsEdns0().Option = append(m.IsEdns0().Option, echo)
+}
@@ -0,0 +1,223 @@
+package elchi
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientRegionTable_Match(t *testing.T) {
+	table := &clientRegionTable{}
+	for _, entry := range []struct{ region, cidr string }{
+		{"avrupa", "10.0.0.0/8"},
+		{"asya", "10.10.0.0/16"},
+		{"asya", "2001:db8:10::/48"},
+	} {
+		if err := table.add(entry.region, entry.cidr); err != nil {
+			t.Fatalf("add(%s, %s) failed: %v", entry.region, entry.cidr, err)
+		}
+	}
+
+	tests := []struct {
+		addr       string
+		wantRegion string
+		wantBits   int
+		wantOK     bool
+	}{
+		{"10.10.1.1", "asya", 16, true},         // most specific subnet wins
+		{"10.20.1.1", "avrupa", 8, true},        // only the /8 matches
+		{"::ffff:10.20.1.1", "avrupa", 8, true}, // IPv4-mapped IPv6
+		{"2001:db8:10::1", "asya", 48, true},
+		{"192.168.1.1", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			region, bits, ok := table.match(netip.MustParseAddr(tt.addr))
+			if region != tt.wantRegion || bits != tt.wantBits || ok != tt.wantOK {
+				t.Errorf("match(%s) = (%q, %d, %v), want (%q, %d, %v)",
+					tt.addr, region, bits, ok, tt.wantRegion, tt.wantBits, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestClientRegionTable_NilTable(t *testing.T) {
+	var table *clientRegionTable
+	if _, _, ok := table.match(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Error("Expected no match on nil table")
+	}
+}
+
+// newECSQuery builds an A query carrying an EDNS Client Subnet option.
+func newECSQuery(qname, subnet string, sourceBits uint8) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: sourceBits,
+		Address:       net.ParseIP(subnet).To4(),
+	})
+	return m
+}
+
+// answerIPs returns the sorted A record addresses of a response.
+func answerIPs(m *dns.Msg) []string {
+	var ips []string
+	for _, rr := range m.Answer {
+		if ip := rrIP(rr); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// responseECS returns the ECS option of a response, or nil.
+func responseECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+func TestServeDNS_ECS_RegionalAnswer(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, clientRegions: &clientRegionTable{}}
+	if err := e.clientRegions.add("asya", "10.10.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.clientRegions.add("avrupa", "10.20.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "geo1",
+		Records: []DNSRecord{
+			{
+				Name: "app.gslb.elchi",
+				Type: "A",
+				TTL:  30,
+				IPs:  []string{"192.168.1.10", "192.168.1.11", "192.168.2.10"},
+				IPRegions: map[string]string{
+					"192.168.1.10": "asya",
+					"192.168.1.11": "asya",
+					"192.168.2.10": "avrupa",
+				},
+			},
+		},
+	}, 300)
+
+	tests := []struct {
+		name      string
+		subnet    string
+		wantIPs   []string
+		wantScope uint8
+	}{
+		{"asya client", "10.10.5.0", []string{"192.168.1.10", "192.168.1.11"}, 16},
+		{"avrupa client", "10.20.5.0", []string{"192.168.2.10"}, 16},
+		{"unknown client", "172.16.5.0", []string{"192.168.1.10", "192.168.1.11", "192.168.2.10"}, 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &testResponseWriter{}
+			code, err := e.ServeDNS(context.Background(), rec, newECSQuery("app.gslb.elchi.", tt.subnet, 24))
+			if err != nil || code != dns.RcodeSuccess {
+				t.Fatalf("ServeDNS = (%d, %v), want success", code, err)
+			}
+
+			got := answerIPs(rec.msg)
+			if len(got) != len(tt.wantIPs) {
+				t.Fatalf("Expected IPs %v, got %v", tt.wantIPs, got)
+			}
+			for i := range got {
+				if got[i] != tt.wantIPs[i] {
+					t.Errorf("Expected IPs %v, got %v", tt.wantIPs, got)
+				}
+			}
+
+			ecs := responseECS(rec.msg)
+			if ecs == nil {
+				t.Fatal("Expected ECS option in response")
+			}
+			if ecs.SourceScope != tt.wantScope {
+				t.Errorf("Expected scope /%d, got /%d", tt.wantScope, ecs.SourceScope)
+			}
+			if ecs.SourceNetmask != 24 {
+				t.Errorf("Expected source prefix /24 echoed, got /%d", ecs.SourceNetmask)
+			}
+		})
+	}
+}
+
+func TestServeDNS_ECS_SourceAddressFallback(t *testing.T) {
+	// testResponseWriter reports 127.0.0.1 as the resolver address
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, clientRegions: &clientRegionTable{}}
+	if err := e.clientRegions.add("local", "127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "geo1",
+		Records: []DNSRecord{
+			{
+				Name:      "app.gslb.elchi",
+				Type:      "A",
+				IPs:       []string{"192.168.1.10", "192.168.1.11", "192.168.2.10"},
+				IPRegions: map[string]string{"192.168.1.10": "asya", "192.168.2.10": "avrupa"},
+			},
+		},
+	}, 300)
+
+	// No IPs in region "local", so the full pool is returned
+	msg := query(t, e, "app.gslb.elchi.", dns.TypeA)
+	if got := answerIPs(msg); len(got) != 3 {
+		t.Errorf("Expected full pool of 3 IPs, got %v", got)
+	}
+	if msg.IsEdns0() != nil {
+		t.Error("Expected no OPT record for a non-EDNS query")
+	}
+}
+
+func TestServeDNS_ECS_NonRegionalRecord(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, clientRegions: &clientRegionTable{}}
+	if err := e.clientRegions.add("asya", "10.10.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "geo1",
+		Records: []DNSRecord{
+			{Name: "plain.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}},
+		},
+	}, 300)
+
+	rec := &testResponseWriter{}
+	if _, err := e.ServeDNS(context.Background(), rec, newECSQuery("plain.gslb.elchi.", "10.10.5.0", 24)); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+
+	// Same answer for every client, so scope must be 0
+	ecs := responseECS(rec.msg)
+	if ecs == nil {
+		t.Fatal("Expected ECS option in response")
+	}
+	if ecs.SourceScope != 0 {
+		t.Errorf("Expected scope /0, got /%d", ecs.SourceScope)
+	}
+}
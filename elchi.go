@@ -2,6 +2,11 @@ package elchi
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -13,15 +18,18 @@ import (
 
 var log = clog.NewWithPlugin("elchi")
 
+// maxCNAMEDepth is the maximum number of in-zone CNAMEs followed for one query.
+const maxCNAMEDepth = 8
+
 // Elchi is the main plugin structure.
 type Elchi struct {
 	Next plugin.Handler
 	Fall fall.F
 
 	// Configuration
-	Endpoint      string
+	Endpoints     []string // Controller base URLs, tried in order until one answers
 	Zone          string
-	Secret        string
+	Secret        string // Shared secret for requests to the controller and to the webhook
 	TTL           uint32
 	SyncInterval  time.Duration
 	Timeout       time.Duration
@@ -30,12 +38,81 @@ type Elchi struct {
 	TLSSkipVerify bool     // Skip TLS certificate verification (insecure, for self-signed certs)
 	NodeIP        string   // Node IP address sent to controller for identification
 	Regions       []string // Region filter for DNS records (empty or ["all"] = no filter)
+	AnswerOrder   string   // Order of A/AAAA answers: "fixed", "random" or "round_robin"
+	MaxAnswers    int      // Maximum number of A/AAAA RRs per answer (0 = unlimited)
+
+	// ColdStartPolicy is how queries are answered before the first snapshot
+	// is loaded: "servfail", "refused", "fallthrough" or "nxdomain". The
+	// directive defaults to "servfail"; "" answers like "nxdomain".
+	ColdStartPolicy string
+	// StartupWait is how long InitClient retries the initial snapshot before serving (0 = don't wait)
+	StartupWait time.Duration
+	// PersistPath is the file the last applied snapshot is saved to and loaded from at startup ("" = disabled)
+	PersistPath string
+	// AuthMode is how controller and webhook requests are authenticated: "hmac", "compat" or "legacy" ("" = compat)
+	AuthMode string
+	// AuthSkew is the accepted clock difference for signed requests (0 = 5m)
+	AuthSkew time.Duration
+	// Watch keeps a long-poll or SSE watch on the controller open for instant updates
+	Watch bool
+	// TrustedKeys are the Ed25519 keys snapshots, changes and /notify records must be signed with (empty = unsigned)
+	TrustedKeys []ed25519.PublicKey
+	// StrictHash rejects snapshots and changes whose version_hash is not a canonical hash of the records
+	StrictHash bool
+	// MaxResponseSize is the largest decoded snapshot, changes or watch response read from the controller (0 = 64MiB)
+	MaxResponseSize int64
+	// Encoding is the preferred encoding of controller responses: "json" or "protobuf" ("" = json)
+	Encoding string
+	// Guard holds the limits snapshots and changes must stay within to replace the records (nil = disabled)
+	Guard *GuardLimits
+	// SecretFile is a file with the shared secret, read again when it changes
+	SecretFile string
+	// ControllerSecret and ControllerSecretFile set the secret of requests to the controller
+	// instead of the shared one
+	ControllerSecret     string
+	ControllerSecretFile string
+	// WebhookSecrets and WebhookSecretFile set the secrets accepted by the webhook instead of
+	// the shared one, several during a rotation
+	WebhookSecrets    []string
+	WebhookSecretFile string
+	// SecretGrace is how long secrets removed from a secret file stay accepted by the webhook
+	SecretGrace time.Duration
+	// Dampening holds back changes to names whose records change too often (nil = disabled)
+	Dampening *DampeningConfig
+	// TLSCA, TLSCert and TLSKey are PEM files for verifying the controller against a
+	// private CA and presenting a client certificate, reloaded when they change
+	TLSCA   string
+	TLSCert string
+	TLSKey  string
+	// TLSServerName is the name verified in the controller certificate ("" = endpoint host)
+	TLSServerName string
+
+	// HealthCheck holds the default local health check for record IPs (nil = disabled)
+	HealthCheck *HealthCheck
+	// FailbackDelay is how long a failed over record must be healthy before switching back
+	FailbackDelay time.Duration
+
+	// SOA configures the zone's SOA record, NameServers its apex NS records (empty = SOA MName)
+	SOA         SOAConfig
+	NameServers []string
+
+	// clientRegions maps client subnets to regions for ECS-aware answers (nil = disabled)
+	clientRegions *clientRegionTable
+
+	// Secrets of requests to the controller and to the webhook, set by InitClient
+	controllerSecrets *secretSource
+	webhookSecrets    *secretSource
 
 	// Client and cache
 	client        *ElchiClient
 	cache         *RecordCache
 	syncStatus    *SyncStatus
 	webhookServer *WebhookServer
+	healthChecker *HealthChecker
+
+	// Pending write of the cache after deltas (nil = none), see persistCacheLater
+	persistMu    sync.Mutex
+	persistTimer *time.Timer
 
 	// Lifecycle management
 	shutdownCtx    context.Context
@@ -60,34 +137,61 @@ func (e *Elchi) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	// Track request
 	requestCount.WithLabelValues(e.Zone, qtypeStr).Inc()
 
+	// Don't answer authoritatively from a cache that has never been loaded
+	if e.ColdStartPolicy != "" && e.ColdStartPolicy != coldStartNXDOMAIN && e.cache.GetVersionHash() == "" {
+		return e.serveColdStart(ctx, w, r)
+	}
+
 	log.Debugf("Query for %s (type: %s)", qname, qtypeStr)
 
+	// Client subnet from ECS (or resolver address) for regional answers
+	ecs, client := clientSubnet(state)
+	var scope uint8
+
 	// Get pre-built dns.RR objects from cache
-	var rrs []dns.RR
+	var rrs, extra []dns.RR
 
 	// Check for records based on query type
+	supported := true
 	switch qtype {
-	case dns.TypeA, dns.TypeAAAA:
-		// For A/AAAA queries, check if there's a CNAME first (failover scenario)
-		cnameRRs := e.cache.Get(qname, dns.TypeCNAME)
-		if len(cnameRRs) > 0 {
-			// CNAME exists, return it instead of A/AAAA
-			// This is the failover case (enabled=false)
-			rrs = cnameRRs
-			log.Debugf("Found CNAME for %s, returning CNAME instead of %s", qname, qtypeStr)
+	case dns.TypeSOA, dns.TypeNS:
+		// Only the apex has SOA/NS records
+		if qname != e.Zone {
+			supported = false
+			break
+		}
+		if qtype == dns.TypeSOA {
+			rrs = []dns.RR{e.soa()}
 		} else {
-			// No CNAME, look for A/AAAA records
-			rrs = e.cache.Get(qname, qtype)
+			rrs = e.nsRecords()
+			extra = e.glue(rrs)
 		}
+	case dns.TypeA, dns.TypeAAAA:
+		rrs, scope = e.resolveAddress(qname, qtype, ecs, client)
 	case dns.TypeCNAME:
-		// Explicit CNAME query
-		rrs = e.cache.Get(qname, dns.TypeCNAME)
+		// Explicit CNAME query, the target is picked as for an A query
+		if set := e.cache.lookup(qname, dns.TypeCNAME); set != nil {
+			rrs = []dns.RR{e.staticFailover(set, dns.TypeA)}
+		}
 	default:
-		// Unsupported type, pass to next plugin
-		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
+		// Unsupported type
+		supported = false
 	}
 
 	if len(rrs) == 0 {
+		// The name exists with other types, answer NODATA instead of NXDOMAIN
+		// so resolvers do not cache the whole name as missing
+		if qname == e.Zone || e.cache.HasName(qname) {
+			cacheMisses.WithLabelValues(e.Zone, qtypeStr).Inc()
+			log.Debugf("No %s records for %s, returning NODATA", qtypeStr, qname)
+			return e.writeNegative(w, r, dns.RcodeSuccess, ecs)
+		}
+
+		if !supported {
+			// Unsupported type for a name we don't have, pass to next plugin
+			return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
+		}
+
 		// No records found, track cache miss
 		cacheMisses.WithLabelValues(e.Zone, qtypeStr).Inc()
 		log.Debugf("No records found for %s", qname)
@@ -98,13 +202,7 @@ func (e *Elchi) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		}
 
 		// No fallthrough - return NXDOMAIN
-		m := new(dns.Msg)
-		m.SetRcode(r, dns.RcodeNameError)
-		m.Authoritative = true
-		if err := w.WriteMsg(m); err != nil {
-			log.Errorf("Failed to write NXDOMAIN response: %v", err)
-		}
-		return dns.RcodeNameError, nil
+		return e.writeNegative(w, r, dns.RcodeNameError, ecs)
 	}
 
 	// Track cache hit
@@ -115,6 +213,8 @@ func (e *Elchi) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
 	m.Answer = rrs
+	m.Extra = extra
+	setResponseEDNS(m, r, ecs, scope)
 
 	log.Debugf("Returning %d records for %s", len(m.Answer), qname)
 	if err := w.WriteMsg(m); err != nil {
@@ -123,6 +223,75 @@ func (e *Elchi) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	return dns.RcodeSuccess, nil
 }
 
+// writeNegative writes an authoritative NXDOMAIN or NODATA (NOERROR without
+// answers) response, with the SOA in the authority section for negative caching.
+func (e *Elchi) writeNegative(w dns.ResponseWriter, r *dns.Msg, rcode int, ecs *dns.EDNS0_SUBNET) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.Authoritative = true
+
+	// Resolvers cache the answer for the TTL of the SOA, which must not
+	// exceed its minimum (RFC 2308 section 3)
+	soa := e.soa()
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	m.Ns = []dns.RR{soa}
+	setResponseEDNS(m, r, ecs, 0)
+	if err := w.WriteMsg(m); err != nil {
+		log.Errorf("Failed to write %s response: %v", dns.RcodeToString[rcode], err)
+	}
+	return rcode, nil
+}
+
+// resolveAddress answers an A/AAAA query. A CNAME to a name in the zone is
+// followed, up to maxCNAMEDepth CNAMEs, and the records of the target are
+// appended to the answer, so resolvers do not have to ask again.
+func (e *Elchi) resolveAddress(qname string, qtype uint16, ecs *dns.EDNS0_SUBNET, client netip.Addr) ([]dns.RR, uint8) {
+	var answer []dns.RR
+	var scope uint8
+	name := qname
+	for depth := 0; ; depth++ {
+		rrs, s := e.lookupAddress(name, qtype, ecs, client)
+		answer = append(answer, rrs...)
+		scope = max(scope, s)
+
+		if len(rrs) != 1 {
+			return answer, scope
+		}
+		cname, ok := rrs[0].(*dns.CNAME)
+		if !ok || !dns.IsSubDomain(e.Zone, cname.Target) {
+			return answer, scope
+		}
+		if depth == maxCNAMEDepth {
+			log.Warningf("CNAME chain of %s is longer than %d, not following %s", qname, maxCNAMEDepth, cname.Target)
+			return answer, scope
+		}
+		name = cname.Target
+	}
+}
+
+// lookupAddress returns the A/AAAA records or the CNAME that answer a query
+// for name, without following the CNAME.
+func (e *Elchi) lookupAddress(name string, qtype uint16, ecs *dns.EDNS0_SUBNET, client netip.Addr) ([]dns.RR, uint8) {
+	// Check if there's a CNAME first (failover scenario)
+	if set := e.cache.lookup(name, dns.TypeCNAME); set != nil {
+		// CNAME exists, return it instead of A/AAAA
+		// This is the failover case (enabled=false)
+		log.Debugf("Found CNAME for %s, returning CNAME instead of %s", name, dns.TypeToString[qtype])
+		return []dns.RR{e.staticFailover(set, qtype)}, 0
+	}
+	if cname := e.failoverTarget(e.healthChecker.failover(name, qtype), qtype); cname != nil {
+		// All IPs are unhealthy, fail over to the first failover target with healthy records
+		log.Debugf("All IPs of %s are unhealthy, returning failover CNAME", name)
+		return []dns.RR{cname}, 0
+	}
+	if set := e.cache.lookup(name, qtype); set != nil {
+		// No CNAME, pick the healthy A/AAAA records serving the client's region
+		selected, scope := e.selectRegional(set, ecs, client)
+		return e.selectAnswer(e.healthySet(set, selected)), scope
+	}
+	return nil, 0
+}
+
 // Name implements the plugin.Handler interface.
 func (e *Elchi) Name() string {
 	return "elchi"
@@ -139,13 +308,43 @@ func (e *Elchi) Ready() bool {
 
 // InitClient initializes the Elchi backend client and starts the background sync.
 func (e *Elchi) InitClient() error {
-	e.client = NewElchiClient(e.Endpoint, e.Zone, e.Secret, e.NodeIP, e.Regions, e.Timeout, e.TLSSkipVerify)
+	tlsConfig, err := newControllerTLS(e.TLSCA, e.TLSCert, e.TLSKey, e.TLSServerName, e.TLSSkipVerify)
+	if err != nil {
+		return fmt.Errorf("invalid controller TLS config: %w", err)
+	}
+	if err := e.loadSecrets(); err != nil {
+		return fmt.Errorf("invalid secret: %w", err)
+	}
+	e.client = NewElchiClient(e.Endpoints, e.Zone, e.Secret, e.NodeIP, e.Regions, e.Timeout, tlsConfig)
+	e.client.secrets = e.controllerSecrets
+	if e.AuthMode != "" {
+		e.client.authMode = e.AuthMode
+	}
+	e.client.strictHash = e.StrictHash
+	e.client.trusted = e.TrustedKeys
+	if e.Encoding != "" {
+		e.client.encoding = e.Encoding
+	}
+	if e.MaxResponseSize > 0 {
+		e.client.maxSize = e.MaxResponseSize
+	}
 	e.cache = NewRecordCache(e.Zone)
+	e.cache.guard = e.Guard
+	if e.Dampening != nil {
+		e.cache.dampener = newDampener(e.Zone, *e.Dampening)
+	}
 	e.syncStatus = &SyncStatus{lastSyncStatus: "initial"}
 
 	// Create shutdown context for graceful termination
 	e.shutdownCtx, e.shutdownCancel = context.WithCancel(context.Background())
 
+	// Start local health checks if enabled. The checker is set before the
+	// webhook server starts, whose /health endpoint reads it.
+	if e.HealthCheck != nil {
+		e.healthChecker = NewHealthChecker(e.Zone, e.cache, e.HealthCheck, e.FailbackDelay)
+		go e.healthChecker.Run(e.shutdownCtx)
+	}
+
 	// Start webhook server if enabled
 	if e.WebhookEnable {
 		e.webhookServer = NewWebhookServer(e, e.WebhookAddr)
@@ -154,36 +353,77 @@ func (e *Elchi) InitClient() error {
 		}
 	}
 
-	// Attempt initial snapshot fetch
-	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	// Serve the last known good snapshot right away if one was persisted.
+	// The background sync then checks the controller for changes against its
+	// hash without holding up startup.
+	persisted := e.PersistPath != "" && e.loadPersistedSnapshot()
+
+	// Attempt initial snapshot fetch, retrying until the startup deadline if configured
+	deadline := time.Now().Add(e.StartupWait)
+	for e.cache.syncHash() == "" && !e.loadInitialSnapshot() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			if e.StartupWait > 0 {
+				log.Warningf("No snapshot loaded within startup_wait %v, starting with an empty cache (cold_start_policy %s)",
+					e.StartupWait, e.ColdStartPolicy)
+			}
+			break
+		}
+		time.Sleep(min(wait, startupRetryInterval))
+	}
+
+	// Start background sync goroutine with shutdown context
+	go e.backgroundSync(persisted)
+	if e.Watch {
+		go e.watchChanges()
+	}
+	if e.cache.dampener != nil {
+		go e.cache.RunDampening(e.shutdownCtx)
+	}
+
+	return nil
+}
+
+// loadInitialSnapshot makes one attempt to fetch and load the initial
+// snapshot and reports whether it succeeded.
+func (e *Elchi) loadInitialSnapshot() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), e.client.syncTimeout())
 	defer cancel()
 
-	snapshot, err := e.client.FetchSnapshot(ctx)
+	snapshot, count, err := e.loadSnapshot(ctx)
 	if err != nil {
 		// Log warning but don't fail - backend might not be ready yet
 		log.Warningf("Initial snapshot fetch failed: %v (will retry in background)", err)
-		e.syncStatus.Update("failed", err)
-	} else {
-		if err := e.cache.ReplaceFromSnapshot(snapshot, e.TTL); err != nil {
-			log.Errorf("Failed to load initial snapshot: %v", err)
-			e.syncStatus.Update("failed", err)
-		} else {
-			log.Infof("Initial snapshot loaded: %d records, hash=%s",
-				len(snapshot.Records), snapshot.VersionHash)
-			e.syncStatus.Update("success", nil)
+		switch {
+		case isHashMismatch(err):
+			integrityErrors.WithLabelValues(e.Zone).Inc()
+		case errors.Is(err, errBadSignature):
+			signatureErrors.WithLabelValues(e.Zone, "sync").Inc()
 		}
+		e.syncStatus.Update("failed", err)
+		return false
 	}
 
-	// Start background sync goroutine with shutdown context
-	go e.backgroundSync()
-
-	return nil
+	log.Infof("Initial snapshot loaded: %d records, hash=%s",
+		count, snapshot.VersionHash)
+	e.syncStatus.Update("success", nil)
+	return true
 }
 
-// It respects the shutdown context for graceful termination.
-func (e *Elchi) backgroundSync() {
-	ticker := time.NewTicker(e.SyncInterval)
-	defer ticker.Stop()
+// backgroundSync syncs with the controller until shutdown. Syncs are spread
+// by the sync scheduler: jittered sync_interval while they succeed, fast
+// retries with exponential backoff after failures.
+// With checkNow the first sync runs right away, e.g. to catch up on a
+// persisted snapshot. It respects the shutdown context for graceful
+// termination.
+func (e *Elchi) backgroundSync(checkNow bool) {
+	scheduler := newSyncScheduler(e.SyncInterval)
+	delay := scheduler.first(e.cache.GetVersionHash() != "")
+	if checkNow {
+		delay = 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
 	for {
 		select {
@@ -192,86 +432,83 @@ func (e *Elchi) backgroundSync() {
 			log.Info("Background sync shutting down gracefully")
 			return
 
-		case <-ticker.C:
-			e.performSync()
+		case <-timer.C:
+			timer.Reset(scheduler.next(e.performSync()))
 		}
 	}
 }
 
 // performSync executes a single sync cycle with proper context management.
-func (e *Elchi) performSync() {
-	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+// It reports whether the sync succeeded; a guard rejection counts as success
+// for scheduling.
+func (e *Elchi) performSync() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), e.client.syncTimeout())
 	defer cancel()
 
-	currentHash := e.cache.GetVersionHash()
+	since := e.cache.syncHash()
 
-	if currentHash == "" {
+	if since == "" {
 		// No snapshot yet, try to fetch initial
 		log.Debug("No snapshot yet, attempting initial fetch")
 
 		// Track sync duration
 		start := time.Now()
-		snapshot, err := e.client.FetchSnapshot(ctx)
+		snapshot, count, err := e.loadSnapshot(ctx)
 		syncDuration.WithLabelValues(e.Zone, "snapshot").Observe(time.Since(start).Seconds())
 
 		if err != nil {
-			log.Warningf("Snapshot fetch failed: %v", err)
-			syncErrors.WithLabelValues(e.Zone, "snapshot").Inc()
-			e.syncStatus.Update("failed", err)
-			return
-		}
-
-		if err := e.cache.ReplaceFromSnapshot(snapshot, e.TTL); err != nil {
-			log.Errorf("Failed to load snapshot: %v", err)
-			syncErrors.WithLabelValues(e.Zone, "snapshot").Inc()
-			e.syncStatus.Update("failed", err)
-		} else {
-			log.Infof("Snapshot loaded: %d records, hash=%s",
-				len(snapshot.Records), snapshot.VersionHash)
-			e.syncStatus.Update("success", nil)
+			log.Warningf("Snapshot load failed: %v", err)
+			return e.syncFailed("snapshot", err)
 		}
-		return
+		log.Infof("Snapshot loaded: %d records, hash=%s",
+			count, snapshot.VersionHash)
+		e.syncStatus.Update("success", nil)
+		return true
 	}
 
 	// Have a snapshot, check for changes
-	log.Debugf("Checking for changes since hash=%s", currentHash)
+	log.Debugf("Checking for changes since hash=%s", since)
 
 	// Track sync duration
 	start := time.Now()
-	changes, err := e.client.CheckChanges(ctx, currentHash)
+	changes, err := e.client.CheckChanges(ctx, since)
 	syncDuration.WithLabelValues(e.Zone, "changes").Observe(time.Since(start).Seconds())
 
 	if err != nil {
 		log.Warningf("Change check failed: %v", err)
-		syncErrors.WithLabelValues(e.Zone, "changes").Inc()
-		e.syncStatus.Update("failed", err)
-		return
+		return e.syncFailed("changes", err)
 	}
 
 	if changes.Unchanged {
+		if rejection := e.cache.confirmQuarantine(since); rejection != nil {
+			log.Debugf("Quarantined snapshot %s is still current", since)
+			e.syncStatus.Update("failed", rejection)
+			return true
+		}
 		log.Debug("No changes detected")
 		e.syncStatus.Update("success", nil)
-		return
+		return true
 	}
 
 	log.Infof("Changes detected, new hash=%s", changes.VersionHash)
 
-	// Build snapshot from changes response
-	snapshot := &DNSSnapshot{
-		Zone:        changes.Zone,
-		VersionHash: changes.VersionHash,
-		Records:     changes.Records,
+	if err := e.loadChanges(ctx, changes); err != nil {
+		log.Errorf("Failed to load changes: %v", err)
+		return e.syncFailed("changes", err)
 	}
+	log.Infof("Cache updated: %d RRs, hash=%s",
+		e.cache.RRCount(), e.cache.GetVersionHash())
+	e.syncStatus.Update("success", nil)
+	return true
+}
 
-	if err := e.cache.ReplaceFromSnapshot(snapshot, e.TTL); err != nil {
-		log.Errorf("Failed to load updated snapshot: %v", err)
-		syncErrors.WithLabelValues(e.Zone, "changes").Inc()
-		e.syncStatus.Update("failed", err)
-	} else {
-		log.Infof("Cache updated: %d records, hash=%s",
-			len(snapshot.Records), snapshot.VersionHash)
-		e.syncStatus.Update("success", nil)
-	}
+// syncFailed records a failed sync and reports whether the scheduler should
+// still wait the full interval. A guard rejection is not retried sooner, the
+// controller would only send the same records again.
+func (e *Elchi) syncFailed(syncType string, err error) bool {
+	e.countSyncError(syncType, err)
+	e.syncStatus.Update("failed", err)
+	return isGuardRejection(err)
 }
 
 // Shutdown performs graceful shutdown of the plugin.
@@ -284,6 +521,9 @@ func (e *Elchi) Shutdown() error {
 		e.shutdownCancel()
 	}
 
+	// Write the records of deltas that are held back
+	e.flushPersist()
+
 	// Stop webhook server if running
 	if e.webhookServer != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -234,6 +234,135 @@ func TestReady(t *testing.T) {
 	}
 }
 
+func TestServeDNS_FollowsInZoneCNAME(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "test123",
+		Records: []DNSRecord{
+			{Name: "asya.gslb.elchi", Type: "A", Failover: FailoverTargets{"avrupa.gslb.elchi"}},
+			{Name: "avrupa.gslb.elchi", Type: "A", Failover: FailoverTargets{"amerika.gslb.elchi"}},
+			{Name: "amerika.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}},
+			{Name: "remote.gslb.elchi", Type: "A", Failover: FailoverTargets{"service.other-gslb.elchi"}},
+		},
+	}, 300)
+
+	m := new(dns.Msg)
+	m.SetQuestion("asya.gslb.elchi.", dns.TypeA)
+	rec := &testResponseWriter{}
+	if _, err := e.ServeDNS(context.Background(), rec, m); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+
+	// Both CNAMEs come first, followed by the A record of the final target
+	want := []string{"avrupa.gslb.elchi.", "amerika.gslb.elchi.", "192.168.3.10"}
+	if len(rec.msg.Answer) != len(want) {
+		t.Fatalf("Expected %d answers, got %v", len(want), rec.msg.Answer)
+	}
+	for i, rr := range rec.msg.Answer {
+		got := rrIP(rr)
+		if cname, ok := rr.(*dns.CNAME); ok {
+			got = cname.Target
+		}
+		if got != want[i] {
+			t.Errorf("Answer %d: expected %s, got %s", i, want[i], got)
+		}
+	}
+
+	// Targets outside the zone are left to the resolver
+	m = new(dns.Msg)
+	m.SetQuestion("remote.gslb.elchi.", dns.TypeA)
+	rec = &testResponseWriter{}
+	if _, err := e.ServeDNS(context.Background(), rec, m); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if len(rec.msg.Answer) != 1 {
+		t.Errorf("Expected only the CNAME for an out-of-zone target, got %v", rec.msg.Answer)
+	}
+}
+
+func TestServeDNS_CNAMEDepthLimit(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+
+	// Loops are rejected in snapshots, but /notify updates can still build one
+	e.cache.Update([]DNSRecord{
+		{Name: "a.gslb.elchi", Type: "A", Failover: FailoverTargets{"b.gslb.elchi"}},
+		{Name: "b.gslb.elchi", Type: "A", Failover: FailoverTargets{"a.gslb.elchi"}},
+	}, 300)
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.gslb.elchi.", dns.TypeA)
+	rec := &testResponseWriter{}
+	if _, err := e.ServeDNS(context.Background(), rec, m); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if len(rec.msg.Answer) != maxCNAMEDepth+1 {
+		t.Errorf("Expected %d CNAMEs, got %d", maxCNAMEDepth+1, len(rec.msg.Answer))
+	}
+}
+
+func TestServeDNS_NODATA(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "test123",
+		Records: []DNSRecord{
+			{Name: "listener1.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+
+	// Fallthrough only applies to names we don't have
+	e.Fall.SetZonesFromArgs(nil)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"AAAA on A-only name", dns.TypeAAAA},
+		{"CNAME on A-only name", dns.TypeCNAME},
+		{"MX record", dns.TypeMX},
+		{"TXT record", dns.TypeTXT},
+		{"NS below apex", dns.TypeNS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion("listener1.gslb.elchi.", tt.qtype)
+			rec := &testResponseWriter{}
+			code, err := e.ServeDNS(context.Background(), rec, m)
+			if err != nil {
+				t.Fatalf("ServeDNS failed: %v", err)
+			}
+
+			if code != dns.RcodeSuccess || rec.msg == nil || rec.msg.Rcode != dns.RcodeSuccess {
+				t.Fatalf("Expected NOERROR, got rcode %d", code)
+			}
+			if !rec.msg.Authoritative || len(rec.msg.Answer) != 0 {
+				t.Errorf("Expected authoritative empty answer, got %v", rec.msg.Answer)
+			}
+			if len(rec.msg.Ns) != 1 || rec.msg.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("Expected SOA in authority section, got %v", rec.msg.Ns)
+			}
+		})
+	}
+}
+
+// query runs a query against the plugin and returns the response.
+func query(t *testing.T, e *Elchi, qname string, qtype uint16) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	rec := &testResponseWriter{}
+	if _, err := e.ServeDNS(context.Background(), rec, m); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	return rec.msg
+}
+
 // testResponseWriter is a mock dns.ResponseWriter for testing.
 type testResponseWriter struct {
 	msg *dns.Msg
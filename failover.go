@@ -0,0 +1,194 @@
+package elchi
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultFailbackDelay is how long a failed over record must have healthy
+	// IPs again before answers switch back from the failover CNAME.
+	defaultFailbackDelay = 30 * time.Second
+
+	// maxFailoverDepth limits how many failover hops are followed when
+	// checking whether a target has healthy records.
+	maxFailoverDepth = 8
+)
+
+// recordKey identifies a record in the cache.
+type recordKey struct {
+	name  string
+	qtype uint16
+}
+
+// failoverState tracks whether a record has been failed over to its
+// failover target because all of its IPs are unhealthy.
+type failoverState struct {
+	set          *rrSet
+	active       bool      // answering with the failover CNAME
+	healthySince time.Time // when IPs became healthy again while active (zero = still down)
+}
+
+// failover returns the failover CNAMEs of the record if it is currently
+// failed over, or nil.
+func (h *HealthChecker) failover(qname string, qtype uint16) []dns.RR {
+	if h == nil || h.activeFailovers.Load() == 0 {
+		// Fast path, nothing is failed over
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	st, ok := h.failovers[recordKey{name: normalizeDomain(qname), qtype: qtype}]
+	if !ok || !st.active {
+		return nil
+	}
+	return st.set.failover
+}
+
+// syncFailovers tracks the records with a failover target in the cache.
+// State of records that are still present is kept across cache updates, so a
+// sync during an outage does not switch answers back. Must be called while
+// holding the mutex lock.
+func (h *HealthChecker) syncFailovers() {
+	records := h.cache.failoverRecords()
+
+	for key, st := range h.failovers {
+		if set, ok := records[key]; ok {
+			st.set = set
+			continue
+		}
+		if st.active {
+			h.activeFailovers.Add(-1)
+		}
+		delete(h.failovers, key)
+	}
+
+	for key, set := range records {
+		if _, ok := h.failovers[key]; !ok {
+			h.failovers[key] = &failoverState{set: set}
+		}
+	}
+
+	failedOverRecords.WithLabelValues(h.zone).Set(float64(h.activeFailovers.Load()))
+}
+
+// evaluateFailovers switches records to their failover target when all of
+// their IPs are unhealthy, and back once they have been healthy for the
+// failback delay.
+func (h *HealthChecker) evaluateFailovers(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key, st := range h.failovers {
+		allDown := h.filterLocked(st.set) == nil
+
+		switch {
+		case !st.active && allDown:
+			st.active = true
+			st.healthySince = time.Time{}
+			h.activeFailovers.Add(1)
+			failoverEvents.WithLabelValues(h.zone, "failover").Inc()
+			log.Warningf("Failover: all IPs of %s (%s) are unhealthy, failing over to %s",
+				key.name, dns.TypeToString[key.qtype], strings.Join(st.set.failoverNames(), ", "))
+
+		case st.active && allDown:
+			// Still down (or down again), restart the failback delay
+			st.healthySince = time.Time{}
+
+		case st.active:
+			if st.healthySince.IsZero() {
+				st.healthySince = now
+				log.Infof("Failover: %s (%s) has healthy IPs again, failing back in %v",
+					key.name, dns.TypeToString[key.qtype], h.failbackDelay)
+			}
+			if now.Sub(st.healthySince) >= h.failbackDelay {
+				st.active = false
+				h.activeFailovers.Add(-1)
+				failoverEvents.WithLabelValues(h.zone, "recovery").Inc()
+				log.Infof("Failover: %s (%s) recovered, answering with its own IPs again",
+					key.name, dns.TypeToString[key.qtype])
+			}
+		}
+	}
+
+	failedOverRecords.WithLabelValues(h.zone).Set(float64(h.activeFailovers.Load()))
+}
+
+// failedOver returns the names of the records currently failed over by this
+// node (for /health endpoint).
+func (h *HealthChecker) failedOver() []string {
+	if h == nil || h.activeFailovers.Load() == 0 {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var names []string
+	for key, st := range h.failovers {
+		if st.active {
+			names = append(names, strings.TrimSuffix(key.name, ".")+" "+dns.TypeToString[key.qtype])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failoverTarget returns the CNAME to the first target of the chain that has
+// healthy records, or nil if none has.
+func (e *Elchi) failoverTarget(chain []dns.RR, qtype uint16) dns.RR {
+	return e.pickFailover(chain, qtype, 0)
+}
+
+// staticFailover returns the CNAME answer of a record without IPs: the first
+// target with healthy records, or the preferred target if none has.
+func (e *Elchi) staticFailover(set *rrSet, qtype uint16) dns.RR {
+	if len(set.failover) > 1 {
+		if cname := e.failoverTarget(set.failover, qtype); cname != nil {
+			return cname
+		}
+	}
+	return set.rrs[0]
+}
+
+// pickFailover implements failoverTarget, following at most
+// maxFailoverDepth hops through targets that fail over themselves.
+func (e *Elchi) pickFailover(chain []dns.RR, qtype uint16, depth int) dns.RR {
+	for _, rr := range chain {
+		if e.hasHealthyRecords(rr.(*dns.CNAME).Target, qtype, depth) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// hasHealthyRecords reports whether a failover target can be answered with
+// healthy records. Names outside the zone are not in the cache, so they are
+// assumed to be healthy.
+func (e *Elchi) hasHealthyRecords(name string, qtype uint16, depth int) bool {
+	if !dns.IsSubDomain(e.Zone, name) {
+		return true
+	}
+	if depth >= maxFailoverDepth {
+		return false
+	}
+
+	// A target without IPs is healthy if its own failover targets are
+	if set := e.cache.lookup(name, dns.TypeCNAME); set != nil {
+		return e.pickFailover(set.failover, qtype, depth+1) != nil
+	}
+
+	set := e.cache.lookup(name, qtype)
+	if set == nil {
+		return false
+	}
+	if e.healthChecker.filter(set) != nil {
+		return true
+	}
+	return e.pickFailover(set.failover, qtype, depth+1) != nil
+}
@@ -0,0 +1,300 @@
+package elchi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// failoverTarget returns the CNAME target of the answer, or "" if the answer
+// does not start with a CNAME.
+func failoverTarget(msg *dns.Msg) string {
+	if len(msg.Answer) == 0 {
+		return ""
+	}
+	if cname, ok := msg.Answer[0].(*dns.CNAME); ok {
+		return cname.Target
+	}
+	return ""
+}
+
+func TestFailover_AllIPsDown(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10", "192.168.1.11"}, Failover: FailoverTargets{"app.backup-gslb.elchi"}},
+		},
+	}, 300)
+	h := NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	e.healthChecker = h
+
+	// A canceled context adds the targets without probing them
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+	now := time.Now()
+
+	// One IP down is handled by filtering, not failover
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	h.evaluateFailovers(now)
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "" {
+		t.Fatalf("Expected no failover with a healthy IP left, got CNAME to %s", target)
+	}
+
+	reportProbe(t, h, "192.168.1.11", probeErr)
+	reportProbe(t, h, "192.168.1.11", probeErr)
+	h.evaluateFailovers(now)
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "app.backup-gslb.elchi." {
+		t.Fatalf("Expected CNAME to app.backup-gslb.elchi., got %q", target)
+	}
+	if got := h.failedOver(); len(got) != 1 || got[0] != "app.gslb.elchi A" {
+		t.Errorf("Expected [app.gslb.elchi A] failed over, got %v", got)
+	}
+}
+
+func TestFailover_FailbackDelay(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10", "192.168.1.11"}, Failover: FailoverTargets{"app.backup-gslb.elchi"}},
+		},
+	}, 300)
+	h := NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	e.healthChecker = h
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+	now := time.Now()
+
+	for _, ip := range []string{"192.168.1.10", "192.168.1.11"} {
+		reportProbe(t, h, ip, probeErr)
+		reportProbe(t, h, ip, probeErr)
+	}
+	h.evaluateFailovers(now)
+
+	// A recovered IP does not switch answers back right away
+	reportProbe(t, h, "192.168.1.10", nil)
+	reportProbe(t, h, "192.168.1.10", nil)
+	h.evaluateFailovers(now.Add(time.Second))
+	if failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)) == "" {
+		t.Fatal("Expected failover to hold during the failback delay")
+	}
+
+	// Going down again restarts the delay
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	h.evaluateFailovers(now.Add(2 * time.Second))
+	reportProbe(t, h, "192.168.1.10", nil)
+	reportProbe(t, h, "192.168.1.10", nil)
+	h.evaluateFailovers(now.Add(3 * time.Second))
+	h.evaluateFailovers(now.Add(3*time.Second + defaultFailbackDelay - time.Second))
+	if failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)) == "" {
+		t.Fatal("Expected failover to hold after flapping")
+	}
+
+	h.evaluateFailovers(now.Add(3*time.Second + defaultFailbackDelay))
+	msg := query(t, e, "app.gslb.elchi.", dns.TypeA)
+	if got := answerIPs(msg); len(got) != 1 || got[0] != "192.168.1.10" {
+		t.Errorf("Expected [192.168.1.10] after failback, got %v", got)
+	}
+	if h.activeFailovers.Load() != 0 {
+		t.Errorf("Expected no active failovers, got %d", h.activeFailovers.Load())
+	}
+}
+
+func TestFailover_NoTargetFailsOpen(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+	h := NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	e.healthChecker = h
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	h.evaluateFailovers(time.Now())
+
+	if got := answerIPs(query(t, e, "app.gslb.elchi.", dns.TypeA)); len(got) != 1 {
+		t.Errorf("Expected the full set without a failover target, got %v", got)
+	}
+}
+
+func TestFailover_SurvivesCacheUpdate(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10", "192.168.1.11"}, Failover: FailoverTargets{"app.backup-gslb.elchi"}},
+		},
+	}, 300)
+	h := NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	e.healthChecker = h
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+
+	for _, ip := range []string{"192.168.1.10", "192.168.1.11"} {
+		reportProbe(t, h, ip, probeErr)
+		reportProbe(t, h, ip, probeErr)
+	}
+	h.evaluateFailovers(time.Now())
+
+	// A sync with the same IPs must not switch answers back
+	e.cache.Update([]DNSRecord{{
+		Name:     "app.gslb.elchi",
+		Type:     "A",
+		TTL:      60,
+		IPs:      []string{"192.168.1.10", "192.168.1.11"},
+		Failover: FailoverTargets{"app.backup-gslb.elchi"},
+	}}, 300)
+	h.reconcile(ctx)
+
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "app.backup-gslb.elchi." {
+		t.Errorf("Expected failover to survive the update, got %q", target)
+	}
+
+	// Dropping the failover target ends the failover
+	e.cache.Update([]DNSRecord{{
+		Name: "app.gslb.elchi",
+		Type: "A",
+		IPs:  []string{"192.168.1.10", "192.168.1.11"},
+	}}, 300)
+	h.reconcile(ctx)
+	if h.activeFailovers.Load() != 0 {
+		t.Errorf("Expected no active failovers, got %d", h.activeFailovers.Load())
+	}
+}
+
+func TestFailover_ChainPicksFirstHealthyTarget(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}, Failover: FailoverTargets{"europe.gslb.elchi", "us.gslb.elchi", "sorry.static-elchi"}},
+			{Name: "europe.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+			{Name: "us.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}},
+		},
+	}, 300)
+	h := NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	e.healthChecker = h
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+
+	down := func(ip string) {
+		reportProbe(t, h, ip, probeErr)
+		reportProbe(t, h, ip, probeErr)
+	}
+
+	down("192.168.1.10")
+	h.evaluateFailovers(time.Now())
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "europe.gslb.elchi." {
+		t.Errorf("Expected CNAME to europe.gslb.elchi., got %q", target)
+	}
+
+	// The failover site is down too, skip to the next one
+	down("192.168.2.10")
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "us.gslb.elchi." {
+		t.Errorf("Expected CNAME to us.gslb.elchi., got %q", target)
+	}
+
+	// Targets outside the zone cannot be checked and are used as they are
+	down("192.168.3.10")
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "sorry.static-elchi." {
+		t.Errorf("Expected CNAME to sorry.static-elchi., got %q", target)
+	}
+}
+
+func TestFailover_StaticChain(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", Failover: FailoverTargets{"europe.gslb.elchi", "us.gslb.elchi"}},
+			{Name: "europe.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+			{Name: "us.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}},
+		},
+	}, 300)
+	h := NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	e.healthChecker = h
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "europe.gslb.elchi." {
+		t.Errorf("Expected CNAME to europe.gslb.elchi., got %q", target)
+	}
+
+	reportProbe(t, h, "192.168.2.10", probeErr)
+	reportProbe(t, h, "192.168.2.10", probeErr)
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "us.gslb.elchi." {
+		t.Errorf("Expected CNAME to us.gslb.elchi., got %q", target)
+	}
+
+	// With no healthy target left, the preferred one is returned
+	reportProbe(t, h, "192.168.3.10", probeErr)
+	reportProbe(t, h, "192.168.3.10", probeErr)
+	if target := failoverTarget(query(t, e, "app.gslb.elchi.", dns.TypeA)); target != "europe.gslb.elchi." {
+		t.Errorf("Expected CNAME to europe.gslb.elchi., got %q", target)
+	}
+}
+
+func TestFailover_NoHealthyTargetFailsOpen(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}, Failover: FailoverTargets{"europe.gslb.elchi"}},
+			{Name: "europe.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+		},
+	}, 300)
+	h := NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	e.healthChecker = h
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+
+	for _, ip := range []string{"192.168.1.10", "192.168.2.10"} {
+		reportProbe(t, h, ip, probeErr)
+		reportProbe(t, h, ip, probeErr)
+	}
+	h.evaluateFailovers(time.Now())
+
+	// Following the CNAME would not help, so the record's own IPs are served
+	if got := answerIPs(query(t, e, "app.gslb.elchi.", dns.TypeA)); len(got) != 1 || got[0] != "192.168.1.10" {
+		t.Errorf("Expected [192.168.1.10], got %v", got)
+	}
+}
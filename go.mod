@@ -5,8 +5,10 @@ go 1.25.1
 require (
 	github.com/coredns/caddy v1.1.4-0.20250930002214-15135a999495
 	github.com/coredns/coredns v1.14.3
+	github.com/klauspost/compress v1.18.4
 	github.com/miekg/dns v1.1.72
 	github.com/prometheus/client_golang v1.23.2
+	google.golang.org/protobuf v1.36.11
 )
 
 require (
@@ -34,5 +36,4 @@ require (
 	golang.org/x/tools v0.42.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20260401024825-9d38bb4040a9 // indirect
 	google.golang.org/grpc v1.80.0 // indirect
-	google.golang.org/protobuf v1.36.11 // indirect
 )
@@ -0,0 +1,288 @@
+package elchi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Guard limits, named like the options of the guard directive.
+const (
+	guardMaxRemoved   = "max_removed"
+	guardMaxIPChanges = "max_ip_changes"
+	guardMinRecords   = "min_records"
+)
+
+// GuardLimits are safety limits for replacing the cached records, so a
+// controller bug that sends an empty or half-empty record list cannot take
+// every name off the air at once. Zero disables a limit.
+type GuardLimits struct {
+	MaxRemoved   float64 // Largest share of the cached names new records may remove, in percent
+	MaxIPChanges float64 // Largest share of the cached IPs new records may remove or replace, in percent
+	MinRecords   int     // Fewest records new records must have
+}
+
+// guardError is returned when new records exceed a guard limit. They are
+// quarantined instead of applied.
+type guardError struct {
+	limit  string // guardMaxRemoved, guardMaxIPChanges or guardMinRecords
+	reason string
+}
+
+func (e *guardError) Error() string {
+	return "snapshot quarantined: " + e.reason
+}
+
+// isGuardRejection reports whether err is, or wraps, a guard rejection.
+func isGuardRejection(err error) bool {
+	var rejection *guardError
+	return errors.As(err, &rejection)
+}
+
+// errNoQuarantine is returned when there is no quarantined snapshot to apply.
+var errNoQuarantine = errors.New("no snapshot in quarantine")
+
+// errQuarantineChanged is returned when the quarantined snapshot is not the
+// one an operator asked to apply.
+var errQuarantineChanged = errors.New("quarantined snapshot has changed")
+
+// check compares new records with the cached ones and returns the first
+// limit they exceed. The share limits only apply once the cache has records.
+func (g *GuardLimits) check(current, next map[string][]DNSRecord) *guardError {
+	count := 0
+	for _, records := range next {
+		count += len(records)
+	}
+	if g.MinRecords > 0 && count < g.MinRecords {
+		return &guardError{
+			limit:  guardMinRecords,
+			reason: fmt.Sprintf("%d records, min_records is %d", count, g.MinRecords),
+		}
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	if g.MaxRemoved > 0 {
+		removed := 0
+		for domain := range current {
+			if len(next[domain]) == 0 {
+				removed++
+			}
+		}
+		if share := percent(removed, len(current)); share > g.MaxRemoved {
+			return &guardError{
+				limit: guardMaxRemoved,
+				reason: fmt.Sprintf("%d of %d names removed (%.1f%%), max_removed is %g%%",
+					removed, len(current), share, g.MaxRemoved),
+			}
+		}
+	}
+
+	if g.MaxIPChanges > 0 {
+		before, after := recordIPs(current), recordIPs(next)
+		changed := 0
+		for ip := range before {
+			if !after[ip] {
+				changed++
+			}
+		}
+		if share := percent(changed, len(before)); share > g.MaxIPChanges {
+			return &guardError{
+				limit: guardMaxIPChanges,
+				reason: fmt.Sprintf("%d of %d IPs removed or replaced (%.1f%%), max_ip_changes is %g%%",
+					changed, len(before), share, g.MaxIPChanges),
+			}
+		}
+	}
+	return nil
+}
+
+// percent returns n as a percentage of total (0 for an empty total).
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// recordIPs returns the name, type and IP of every IP in sources.
+func recordIPs(sources map[string][]DNSRecord) map[string]bool {
+	ips := make(map[string]bool)
+	for domain, records := range sources {
+		for i := range records {
+			recordType := strings.ToUpper(records[i].Type)
+			for _, ep := range records[i].endpoints() {
+				ips[domain+" "+recordType+" "+ep.IP] = true
+			}
+		}
+	}
+	return ips
+}
+
+// quarantine holds records rejected by the guard until they are force-applied
+// or the controller sends records that pass.
+type quarantine struct {
+	versionHash string
+	rejection   *guardError
+	since       time.Time // First rejection of this version
+	rejections  int       // Syncs that found this version still current
+	records     map[string]map[uint16]*rrSet
+	sources     map[string][]DNSRecord
+}
+
+// quarantineView describes the quarantined snapshot for the webhook server.
+type quarantineView struct {
+	versionHash  string
+	limit        string
+	reason       string
+	since        time.Time
+	rejections   int
+	removedNames []string // Cached names the quarantined records do not have
+	records      []DNSRecord
+}
+
+// guardedReplace replaces the records of the cache if they pass the guard,
+// else quarantines them. It returns the number of RRs in the cache.
+// c.writeMu must be held.
+func (c *RecordCache) guardedReplace(records map[string]map[uint16]*rrSet, sources map[string][]DNSRecord, versionHash string) (int, error) {
+	if c.guard != nil {
+		// Writers hold writeMu, so c.sources does not change under us
+		if rejection := c.guard.check(c.sources, sources); rejection != nil {
+			c.quarantineRecords(records, sources, versionHash, rejection)
+			return 0, rejection
+		}
+	}
+	return c.replace(records, sources, versionHash), nil
+}
+
+// replace atomically replaces the records of the cache, holding back changes
+// to names suppressed by dampening, and drops a quarantined snapshot.
+// c.writeMu must be held.
+func (c *RecordCache) replace(records map[string]map[uint16]*rrSet, sources map[string][]DNSRecord, versionHash string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.dampener != nil {
+		c.dampener.apply(c.records, records, c.sources, sources, now)
+	}
+	c.records = records
+	c.sources = sources
+	c.canonical = nil
+	c.versionHash = versionHash
+	c.updatedAt = now
+	c.generation++
+	if c.quarantine != nil {
+		c.quarantine = nil
+		snapshotQuarantined.WithLabelValues(c.zone).Set(0)
+	}
+	return c.updateCacheSizeMetric()
+}
+
+// quarantineRecords keeps rejected records for inspection. c.writeMu must be
+// held.
+func (c *RecordCache) quarantineRecords(records map[string]map[uint16]*rrSet, sources map[string][]DNSRecord, versionHash string, rejection *guardError) {
+	guardRejections.WithLabelValues(c.zone, rejection.limit).Inc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q := &quarantine{
+		versionHash: versionHash,
+		rejection:   rejection,
+		since:       time.Now(),
+		rejections:  1,
+		records:     records,
+		sources:     sources,
+	}
+	if c.quarantine != nil && c.quarantine.versionHash == versionHash {
+		q.since = c.quarantine.since
+		q.rejections = c.quarantine.rejections + 1
+	} else {
+		// Only log new versions, the controller keeps sending a rejected one
+		log.Warningf("Quarantined snapshot %s: %s, keeping %s", versionHash, rejection.reason, c.versionHash)
+	}
+	c.quarantine = q
+	snapshotQuarantined.WithLabelValues(c.zone).Set(1)
+}
+
+// syncHash returns the version hash to check the controller for changes
+// against. While a snapshot is quarantined that is its version, so the
+// rejected records are only downloaded again once the controller has a new
+// version.
+func (c *RecordCache) syncHash() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.quarantine != nil {
+		return c.quarantine.versionHash
+	}
+	return c.versionHash
+}
+
+// confirmQuarantine counts a sync that found the quarantined version still
+// current and returns its rejection, or nil if versionHash is not quarantined.
+func (c *RecordCache) confirmQuarantine(versionHash string) *guardError {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q := c.quarantine
+	if q == nil || q.versionHash != versionHash {
+		return nil
+	}
+	q.rejections++
+	return q.rejection
+}
+
+// quarantined returns the quarantined snapshot, if there is one.
+func (c *RecordCache) quarantined() (quarantineView, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	q := c.quarantine
+	if q == nil {
+		return quarantineView{}, false
+	}
+	view := quarantineView{
+		versionHash: q.versionHash,
+		limit:       q.rejection.limit,
+		reason:      q.rejection.reason,
+		since:       q.since,
+		rejections:  q.rejections,
+		records:     sortedRecords(q.sources),
+	}
+	for domain := range c.sources {
+		if len(q.sources[domain]) == 0 {
+			view.removedNames = append(view.removedNames, domain)
+		}
+	}
+	sort.Strings(view.removedNames)
+	return view, true
+}
+
+// ApplyQuarantined replaces the records of the cache with the quarantined
+// ones, bypassing the guard. versionHash must be the version hash of the
+// quarantined snapshot, so only the inspected records are applied. It returns
+// the number of RRs in the cache.
+func (c *RecordCache) ApplyQuarantined(versionHash string) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// Only writers change the quarantine, and they hold writeMu
+	q := c.quarantine
+	if q == nil {
+		return 0, errNoQuarantine
+	}
+	if q.versionHash != versionHash {
+		return 0, fmt.Errorf("%w: quarantined version is %s", errQuarantineChanged, q.versionHash)
+	}
+
+	recordCount := c.replace(q.records, q.sources, q.versionHash)
+	log.Warningf("Quarantined snapshot %s force-applied (%s), total RRs: %d",
+		q.versionHash, q.rejection.reason, recordCount)
+	return recordCount, nil
+}
@@ -0,0 +1,301 @@
+package elchi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// guardTestRecords has four names with one IP each.
+var guardTestRecords = []DNSRecord{
+	{Name: "app1.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+	{Name: "app2.gslb.elchi", Type: "A", IPs: []string{"192.168.1.20"}},
+	{Name: "app3.gslb.elchi", Type: "A", IPs: []string{"192.168.1.30"}},
+	{Name: "app4.gslb.elchi", Type: "A", IPs: []string{"192.168.1.40"}},
+}
+
+func TestGuardLimits_Check(t *testing.T) {
+	sources := func(records ...DNSRecord) map[string][]DNSRecord {
+		m := make(map[string][]DNSRecord)
+		for _, record := range records {
+			m[record.Name] = append(m[record.Name], record)
+		}
+		return m
+	}
+	current := sources(guardTestRecords...)
+	moved := DNSRecord{Name: "app1.gslb.elchi", Type: "A", IPs: []string{"10.0.0.10"}}
+
+	tests := []struct {
+		name    string
+		guard   GuardLimits
+		current map[string][]DNSRecord
+		next    map[string][]DNSRecord
+		want    string
+	}{
+		{"unchanged", GuardLimits{MaxRemoved: 10, MaxIPChanges: 10, MinRecords: 4}, current, current, ""},
+		{"one of four removed", GuardLimits{MaxRemoved: 25}, current, sources(guardTestRecords[1:]...), ""},
+		{"two of four removed", GuardLimits{MaxRemoved: 25}, current, sources(guardTestRecords[2:]...), guardMaxRemoved},
+		{"everything removed", GuardLimits{MaxRemoved: 50}, current, sources(), guardMaxRemoved},
+		{"one IP replaced", GuardLimits{MaxIPChanges: 25}, current, sources(moved, guardTestRecords[1], guardTestRecords[2], guardTestRecords[3]), ""},
+		{"IPs replaced", GuardLimits{MaxIPChanges: 20}, current, sources(moved, guardTestRecords[1], guardTestRecords[2], guardTestRecords[3]), guardMaxIPChanges},
+		{"too few records", GuardLimits{MinRecords: 5}, current, current, guardMinRecords},
+		{"first snapshot", GuardLimits{MaxRemoved: 1, MaxIPChanges: 1}, nil, sources(guardTestRecords[0]), ""},
+		{"empty first snapshot", GuardLimits{MinRecords: 1}, nil, sources(), guardMinRecords},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if rejection := tt.guard.check(tt.current, tt.next); rejection != nil {
+				got = rejection.limit
+			}
+			if got != tt.want {
+				t.Errorf("check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuard_QuarantinesSnapshot(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: guardTestRecords}, 300)
+	cache.guard = &GuardLimits{MaxRemoved: 25}
+
+	err := cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v2", Records: guardTestRecords[:1]}, 300)
+	if !isGuardRejection(err) {
+		t.Fatalf("Expected a guard rejection, got %v", err)
+	}
+	if hash := cache.GetVersionHash(); hash != "v1" {
+		t.Errorf("Expected the cache to stay at v1, got %s", hash)
+	}
+	if !cache.HasName("app4.gslb.elchi.") {
+		t.Error("Expected the cached records to stay in use")
+	}
+
+	q, ok := cache.quarantined()
+	if !ok {
+		t.Fatal("Expected a quarantined snapshot")
+	}
+	if q.versionHash != "v2" || q.limit != guardMaxRemoved || q.rejections != 1 || len(q.records) != 1 {
+		t.Errorf("Unexpected quarantine %+v", q)
+	}
+	if len(q.removedNames) != 3 || q.removedNames[0] != "app2.gslb.elchi." {
+		t.Errorf("Unexpected removed names %v", q.removedNames)
+	}
+
+	// The controller keeps sending the same version on every sync
+	_ = cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v2", Records: guardTestRecords[:1]}, 300)
+	if again, _ := cache.quarantined(); again.rejections != 2 || !again.since.Equal(q.since) {
+		t.Errorf("Expected the second rejection of v2 to be counted, got %+v", again)
+	}
+
+	// A snapshot that passes replaces the records and drops the quarantine
+	if err := cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v3", Records: guardTestRecords[1:]}, 300); err != nil {
+		t.Fatalf("ReplaceFromSnapshot failed: %v", err)
+	}
+	if _, ok := cache.quarantined(); ok {
+		t.Error("Expected the quarantine to be dropped")
+	}
+	if hash := cache.GetVersionHash(); hash != "v3" {
+		t.Errorf("Expected v3, got %s", hash)
+	}
+}
+
+func TestGuard_QuarantinesDelta(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: guardTestRecords}, 300)
+	cache.guard = &GuardLimits{MaxRemoved: 25}
+
+	err := cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: "v2",
+		Deletes:     []DeleteRecord{{Name: "app1.gslb.elchi", Type: "A"}, {Name: "app2.gslb.elchi", Type: "A"}},
+	}, 300)
+	if !isGuardRejection(err) {
+		t.Fatalf("Expected a guard rejection, got %v", err)
+	}
+	if !cache.HasName("app1.gslb.elchi.") {
+		t.Error("Expected the rejected delta not to be applied")
+	}
+}
+
+func TestApplyQuarantined(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: guardTestRecords}, 300)
+	cache.guard = &GuardLimits{MinRecords: 2}
+
+	if _, err := cache.ApplyQuarantined("v2"); !errors.Is(err, errNoQuarantine) {
+		t.Errorf("Expected errNoQuarantine, got %v", err)
+	}
+
+	_ = cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v2", Records: guardTestRecords[:1]}, 300)
+	if _, err := cache.ApplyQuarantined("v3"); !errors.Is(err, errQuarantineChanged) {
+		t.Errorf("Expected errQuarantineChanged, got %v", err)
+	}
+
+	count, err := cache.ApplyQuarantined("v2")
+	if err != nil {
+		t.Fatalf("ApplyQuarantined failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 RR, got %d", count)
+	}
+	if hash := cache.GetVersionHash(); hash != "v2" {
+		t.Errorf("Expected v2, got %s", hash)
+	}
+	if cache.HasName("app2.gslb.elchi.") {
+		t.Error("Expected the quarantined records to replace the cache")
+	}
+	if _, ok := cache.quarantined(); ok {
+		t.Error("Expected the quarantine to be dropped")
+	}
+}
+
+func TestHandleQuarantine(t *testing.T) {
+	e := &Elchi{
+		Zone:   "gslb.elchi.",
+		Secret: "test-secret",
+		TTL:    300,
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: guardTestRecords}, 300)
+	e.cache.guard = &GuardLimits{MaxRemoved: 50}
+	e.syncStatus = &SyncStatus{lastSyncStatus: "initial"}
+	ws := NewWebhookServer(e, ":8053")
+
+	get := func() QuarantineResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/quarantine", nil)
+		req.Header.Set("X-Elchi-Secret", "test-secret")
+		rr := httptest.NewRecorder()
+		ws.authMiddleware(ws.handleQuarantine)(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+		var resp QuarantineResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return resp
+	}
+	apply := func(secret, versionHash string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/quarantine/apply?version_hash="+versionHash, nil)
+		req.Header.Set("X-Elchi-Secret", secret)
+		rr := httptest.NewRecorder()
+		ws.authMiddleware(ws.handleQuarantineApply)(rr, req)
+		return rr
+	}
+
+	if resp := get(); resp.Quarantined || resp.CurrentHash != "v1" {
+		t.Errorf("Expected no quarantine, got %+v", resp)
+	}
+	if rr := apply("test-secret", "v2"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 without a quarantine, got %d", rr.Code)
+	}
+
+	_ = e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v2"}, 300)
+	resp := get()
+	if !resp.Quarantined || resp.VersionHash != "v2" || resp.Limit != guardMaxRemoved || len(resp.RemovedNames) != 4 || resp.Count != 0 {
+		t.Errorf("Unexpected quarantine %+v", resp)
+	}
+
+	if rr := apply("wrong-secret", "v2"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with a wrong secret, got %d", rr.Code)
+	}
+	if rr := apply("test-secret", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a version hash, got %d", rr.Code)
+	}
+	if rr := apply("test-secret", "v1"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for another version, got %d", rr.Code)
+	}
+	if e.cache.GetVersionHash() != "v1" {
+		t.Fatal("Expected the cache to stay at v1")
+	}
+
+	rr := apply("test-secret", "v2")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if e.cache.GetVersionHash() != "v2" || e.cache.HasName("app1.gslb.elchi.") {
+		t.Error("Expected the quarantined snapshot to be applied")
+	}
+}
+
+func TestIsGuardRejection(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: guardTestRecords}, 300)
+	cache.guard = &GuardLimits{MinRecords: 5}
+	err := cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v2", Records: guardTestRecords}, 300)
+	if !isGuardRejection(fmt.Errorf("sync: %w", err)) {
+		t.Errorf("Expected a wrapped guard rejection, got %v", err)
+	}
+	if isGuardRejection(errors.New("connection refused")) {
+		t.Error("Expected other errors not to be guard rejections")
+	}
+}
+
+func TestPerformSync_QuarantinedVersion(t *testing.T) {
+	var changesFetched int
+	version := "v2"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if since := r.URL.Query().Get("since"); since == version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		changesFetched++
+		records := guardTestRecords[:1]
+		if version == "v3" {
+			records = guardTestRecords[1:]
+		}
+		_ = json.NewEncoder(w).Encode(DNSChangesResponse{Zone: "gslb.elchi", VersionHash: version, Records: records})
+	}))
+	defer server.Close()
+
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, syncStatus: &SyncStatus{}}
+	e.client = NewElchiClient([]string{server.URL}, e.Zone, "test-secret", "", nil, 5*time.Second, nil)
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: guardTestRecords}, 300)
+	e.cache.guard = &GuardLimits{MaxRemoved: 25}
+
+	// A rejection waits for the next interval instead of being retried
+	if !e.performSync() {
+		t.Fatal("Expected a guard rejection to count as done for scheduling")
+	}
+	if _, status, _ := e.syncStatus.Get(); status != "failed" {
+		t.Errorf("Expected the rejection to be reported as failed, got %s", status)
+	}
+
+	// The rejected version is not downloaded again while the controller keeps it
+	for range 2 {
+		if !e.performSync() {
+			t.Fatal("Expected the sync to succeed")
+		}
+	}
+	if changesFetched != 1 {
+		t.Errorf("Expected the rejected records to be fetched once, got %d", changesFetched)
+	}
+	q, ok := e.cache.quarantined()
+	if !ok || q.versionHash != "v2" || q.rejections != 3 {
+		t.Errorf("Expected v2 to stay quarantined with 3 syncs counted, got %+v", q)
+	}
+	if _, status, _ := e.syncStatus.Get(); status != "failed" {
+		t.Errorf("Expected the quarantine to keep the sync failed, got %s", status)
+	}
+
+	// A new version is fetched and applied
+	version = "v3"
+	if !e.performSync() {
+		t.Fatal("Expected the new version to be applied")
+	}
+	if changesFetched != 2 || e.cache.GetVersionHash() != "v3" {
+		t.Errorf("Expected v3 after a second fetch, got %s after %d fetches", e.cache.GetVersionHash(), changesFetched)
+	}
+	if _, ok := e.cache.quarantined(); ok {
+		t.Error("Expected the quarantine to be dropped")
+	}
+}
@@ -0,0 +1,434 @@
+package elchi
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health check types.
+const (
+	healthCheckTCP   = "tcp"
+	healthCheckHTTP  = "http"
+	healthCheckHTTPS = "https"
+)
+
+// Health check defaults.
+const (
+	defaultHealthInterval   = 10 * time.Second // Default probe interval
+	defaultHealthTimeout    = 2 * time.Second  // Default probe timeout
+	defaultHealthRise       = 2                // Consecutive successes to mark an IP healthy
+	defaultHealthFall       = 3                // Consecutive failures to mark an IP unhealthy
+	defaultHealthPath       = "/"              // Default HTTP(S) request path
+	healthReconcileInterval = time.Second      // How often cache changes are picked up
+)
+
+// HealthCheck configures active probing of record IPs. It is used for the
+// health_check directive (zone-wide defaults) and for per-record overrides in
+// snapshots, where empty fields fall back to the directive.
+type HealthCheck struct {
+	Type           string `json:"type,omitempty"`            // "tcp", "http" or "https"
+	Port           int    `json:"port,omitempty"`            // Port to probe on each IP
+	Path           string `json:"path,omitempty"`            // HTTP(S) request path (default "/")
+	ExpectedStatus int    `json:"expected_status,omitempty"` // Expected HTTP status (0 = any 2xx)
+	Interval       string `json:"interval,omitempty"`        // Probe interval, e.g. "10s"
+	Timeout        string `json:"timeout,omitempty"`         // Probe timeout, e.g. "2s"
+	Rise           int    `json:"rise,omitempty"`            // Consecutive successes to mark an IP healthy
+	Fall           int    `json:"fall,omitempty"`            // Consecutive failures to mark an IP unhealthy
+}
+
+// key returns an identity for the check settings ("" for nil).
+func (h *HealthCheck) key() string {
+	if h == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d%s|%d|%s|%s|%d|%d",
+		h.Type, h.Port, h.Path, h.ExpectedStatus, h.Interval, h.Timeout, h.Rise, h.Fall)
+}
+
+// healthProbe is a fully resolved health check.
+type healthProbe struct {
+	kind     string
+	port     int
+	path     string
+	status   int
+	interval time.Duration
+	timeout  time.Duration
+	rise     int
+	fall     int
+}
+
+// resolveHealthCheck merges a per-record check with the defaults and applies
+// built-in defaults for anything left empty. It fails if the result has no
+// type or port, in which case the IPs are not probed.
+func resolveHealthCheck(check, defaults *HealthCheck) (healthProbe, error) {
+	merged := HealthCheck{}
+	if defaults != nil {
+		merged = *defaults
+	}
+	if check != nil {
+		if check.Type != "" {
+			merged.Type = check.Type
+		}
+		if check.Port != 0 {
+			merged.Port = check.Port
+		}
+		if check.Path != "" {
+			merged.Path = check.Path
+		}
+		if check.ExpectedStatus != 0 {
+			merged.ExpectedStatus = check.ExpectedStatus
+		}
+		if check.Interval != "" {
+			merged.Interval = check.Interval
+		}
+		if check.Timeout != "" {
+			merged.Timeout = check.Timeout
+		}
+		if check.Rise != 0 {
+			merged.Rise = check.Rise
+		}
+		if check.Fall != 0 {
+			merged.Fall = check.Fall
+		}
+	}
+
+	p := healthProbe{
+		kind:     merged.Type,
+		port:     merged.Port,
+		path:     merged.Path,
+		status:   merged.ExpectedStatus,
+		interval: defaultHealthInterval,
+		timeout:  defaultHealthTimeout,
+		rise:     max(merged.Rise, 1),
+		fall:     max(merged.Fall, 1),
+	}
+	if merged.Rise == 0 {
+		p.rise = defaultHealthRise
+	}
+	if merged.Fall == 0 {
+		p.fall = defaultHealthFall
+	}
+	if p.path == "" {
+		p.path = defaultHealthPath
+	}
+
+	switch p.kind {
+	case healthCheckTCP, healthCheckHTTP, healthCheckHTTPS:
+	case "":
+		return p, fmt.Errorf("missing health check type")
+	default:
+		return p, fmt.Errorf("unsupported health check type: %s", p.kind)
+	}
+	if p.port < 1 || p.port > 65535 {
+		return p, fmt.Errorf("invalid health check port: %d", p.port)
+	}
+
+	var err error
+	if merged.Interval != "" {
+		if p.interval, err = time.ParseDuration(merged.Interval); err != nil || p.interval <= 0 {
+			return p, fmt.Errorf("invalid health check interval: %s", merged.Interval)
+		}
+	}
+	if merged.Timeout != "" {
+		if p.timeout, err = time.ParseDuration(merged.Timeout); err != nil || p.timeout <= 0 {
+			return p, fmt.Errorf("invalid health check timeout: %s", merged.Timeout)
+		}
+	}
+	return p, nil
+}
+
+// healthKey identifies a probed IP. The same IP can be probed with different
+// checks when it belongs to several records.
+type healthKey struct {
+	addr  netip.Addr
+	check string // HealthCheck.key() of the record ("" = health_check directive)
+}
+
+// healthTarget tracks the probe state of one IP.
+type healthTarget struct {
+	key       healthKey
+	probe     healthProbe
+	healthy   bool
+	successes int
+	failures  int
+	cancel    context.CancelFunc
+}
+
+// HealthChecker actively probes the IPs in the record cache and tracks which
+// ones are down, so they can be left out of answers without touching the cache.
+type HealthChecker struct {
+	zone          string
+	cache         *RecordCache
+	defaults      *HealthCheck
+	failbackDelay time.Duration
+	httpClient    *http.Client
+
+	mu              sync.RWMutex
+	targets         map[healthKey]*healthTarget
+	failovers       map[recordKey]*failoverState // records with a failover target
+	downCount       atomic.Int32                 // number of unhealthy targets, read without the lock on the query path
+	activeFailovers atomic.Int32                 // number of failed over records, read without the lock on the query path
+	generation      uint64                       // cache generation the targets were built from
+}
+
+// NewHealthChecker creates a health checker for the IPs in the cache.
+// Records with a failover target switch to it while all of their IPs are
+// unhealthy, and switch back after failbackDelay of recovered health.
+func NewHealthChecker(zone string, cache *RecordCache, defaults *HealthCheck, failbackDelay time.Duration) *HealthChecker {
+	return &HealthChecker{
+		zone:          zone,
+		cache:         cache,
+		defaults:      defaults,
+		failbackDelay: failbackDelay,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				// Backends are probed by IP, so certificates cannot be verified against a name
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // Health probes only check availability
+				DisableKeepAlives: true,                                  // Every probe opens a fresh connection
+			},
+			// Evaluate redirects as responses instead of following them
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		targets:   make(map[healthKey]*healthTarget),
+		failovers: make(map[recordKey]*failoverState),
+	}
+}
+
+// Run keeps the probed targets in sync with the cache and evaluates record
+// failovers until ctx is canceled.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(healthReconcileInterval)
+	defer ticker.Stop()
+
+	h.reconcile(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("Health checker shutting down gracefully")
+			return
+		case now := <-ticker.C:
+			h.reconcile(ctx)
+			h.evaluateFailovers(now)
+		}
+	}
+}
+
+// reconcile starts probing new IPs and stops probing IPs that left the cache.
+func (h *HealthChecker) reconcile(ctx context.Context) {
+	generation := h.cache.Generation()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if generation == h.generation && h.generation != 0 {
+		return
+	}
+	h.generation = generation
+
+	wanted := make(map[healthKey]healthProbe)
+	for key, check := range h.cache.healthTargets() {
+		probe, err := resolveHealthCheck(check, h.defaults)
+		if err != nil {
+			// No usable check for this IP (e.g. no type or port configured)
+			if check != nil {
+				log.Warningf("Skipping health check for %s: %v", key.addr, err)
+			}
+			continue
+		}
+		wanted[key] = probe
+	}
+
+	// Stop probing IPs that are gone
+	for key, t := range h.targets {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		t.cancel()
+		if !t.healthy {
+			h.downCount.Add(-1)
+		}
+		delete(h.targets, key)
+	}
+
+	// Start probing new IPs, assumed healthy until proven otherwise
+	for key, probe := range wanted {
+		if _, ok := h.targets[key]; ok {
+			continue
+		}
+		targetCtx, cancel := context.WithCancel(ctx)
+		t := &healthTarget{key: key, probe: probe, healthy: true, cancel: cancel}
+		h.targets[key] = t
+		go h.runTarget(targetCtx, t)
+	}
+
+	unhealthyEndpoints.WithLabelValues(h.zone).Set(float64(h.downCount.Load()))
+	h.syncFailovers()
+}
+
+// runTarget probes one IP at its interval until ctx is canceled.
+func (h *HealthChecker) runTarget(ctx context.Context, t *healthTarget) {
+	// Spread the first probes over the interval to avoid bursts after a snapshot load
+	delay := time.Duration(rand.Int64N(int64(t.probe.interval))) //nolint:gosec // Jitter does not need a CSPRNG
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		err := h.probe(ctx, t.key.addr, t.probe)
+		if ctx.Err() != nil {
+			return
+		}
+		h.report(t, err)
+		timer.Reset(t.probe.interval)
+	}
+}
+
+// probe runs a single health check against addr.
+func (h *HealthChecker) probe(ctx context.Context, addr netip.Addr, p healthProbe) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	hostPort := net.JoinHostPort(addr.String(), strconv.Itoa(p.port))
+
+	if p.kind == healthCheckTCP {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", hostPort)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.kind+"://"+hostPort+p.path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "elchi-healthcheck")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if p.status == 0 {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+	if resp.StatusCode != p.status {
+		return fmt.Errorf("unexpected status code %d (expected %d)", resp.StatusCode, p.status)
+	}
+	return nil
+}
+
+// report applies a probe result to the target, flipping its state once the
+// rise or fall threshold is reached. Results for targets that reconcile
+// already removed are dropped.
+func (h *HealthChecker) report(t *healthTarget, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.targets[t.key] != t {
+		return
+	}
+	if err == nil {
+		healthChecks.WithLabelValues(h.zone, "success").Inc()
+		t.successes++
+		t.failures = 0
+		if !t.healthy && t.successes >= t.probe.rise {
+			t.healthy = true
+			h.downCount.Add(-1)
+			log.Infof("Health check: %s is healthy again after %d successful probes", t.key.addr, t.successes)
+		}
+	} else {
+		healthChecks.WithLabelValues(h.zone, "failure").Inc()
+		t.failures++
+		t.successes = 0
+		log.Debugf("Health check for %s failed: %v", t.key.addr, err)
+		if t.healthy && t.failures >= t.probe.fall {
+			t.healthy = false
+			h.downCount.Add(1)
+			log.Warningf("Health check: %s is unhealthy after %d failed probes: %v", t.key.addr, t.failures, err)
+		}
+	}
+
+	unhealthyEndpoints.WithLabelValues(h.zone).Set(float64(h.downCount.Load()))
+}
+
+// filter returns the healthy part of the set: the set itself if all of its
+// IPs are healthy, a trimmed copy if some are down, or nil if all are down.
+func (h *HealthChecker) filter(set *rrSet) *rrSet {
+	if h == nil || h.downCount.Load() == 0 {
+		// Fast path, nothing is down
+		return set
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.filterLocked(set)
+}
+
+// filterLocked is filter without the fast path.
+// Must be called while holding the mutex lock.
+func (h *HealthChecker) filterLocked(set *rrSet) *rrSet {
+	var healthy *rrSet
+	for i, rr := range set.rrs {
+		t, ok := h.targets[healthKey{addr: rrAddr(rr), check: set.checkKey}]
+		if ok && !t.healthy {
+			if healthy == nil {
+				healthy = set.subset(i)
+			}
+			continue
+		}
+		if healthy != nil {
+			healthy.add(rr, set.weight(i))
+		}
+	}
+
+	if healthy == nil {
+		return set
+	}
+	if len(healthy.rrs) == 0 {
+		return nil
+	}
+	return healthy
+}
+
+// healthySet drops unhealthy IPs from the set selected for the client. If
+// every IP of the client's region is down, the healthy IPs of the full set
+// are used instead. If no IP is healthy at all, the selected set is returned
+// unchanged: answering with possibly dead IPs beats answering with nothing.
+func (e *Elchi) healthySet(full, selected *rrSet) *rrSet {
+	if healthy := e.healthChecker.filter(selected); healthy != nil {
+		return healthy
+	}
+	if selected != full {
+		if healthy := e.healthChecker.filter(full); healthy != nil {
+			return healthy
+		}
+	}
+	log.Debugf("All IPs of %s are unhealthy, answering with the full set", selected.rrs[0].Header().Name)
+	return selected
+}
@@ -0,0 +1,257 @@
+package elchi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolveHealthCheck(t *testing.T) {
+	defaults := &HealthCheck{Type: "http", Port: 8080, Path: "/healthz", Interval: "5s", Rise: 1}
+
+	tests := []struct {
+		name    string
+		check   *HealthCheck
+		want    healthProbe
+		wantErr bool
+	}{
+		{
+			name:  "defaults only",
+			check: nil,
+			want:  healthProbe{kind: "http", port: 8080, path: "/healthz", interval: 5 * time.Second, timeout: defaultHealthTimeout, rise: 1, fall: defaultHealthFall},
+		},
+		{
+			name:  "record overrides",
+			check: &HealthCheck{Type: "tcp", Port: 443, Timeout: "500ms", Fall: 5},
+			want:  healthProbe{kind: "tcp", port: 443, path: "/healthz", interval: 5 * time.Second, timeout: 500 * time.Millisecond, rise: 1, fall: 5},
+		},
+		{
+			name:    "unsupported type",
+			check:   &HealthCheck{Type: "icmp"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid interval",
+			check:   &HealthCheck{Interval: "often"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveHealthCheck(tt.check, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveHealthCheck() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("resolveHealthCheck() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveHealthCheck_NoTypeOrPort(t *testing.T) {
+	// Without a directive default, records lacking their own check are not probed
+	if _, err := resolveHealthCheck(nil, &HealthCheck{}); err == nil {
+		t.Error("Expected error for check without type")
+	}
+	if _, err := resolveHealthCheck(&HealthCheck{Type: "tcp"}, nil); err == nil {
+		t.Error("Expected error for check without port")
+	}
+}
+
+func TestHealthChecker_Probe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	addr := netip.MustParseAddr("127.0.0.1")
+
+	// A closed port for failing TCP probes
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	h := NewHealthChecker("gslb.elchi.", NewRecordCache("gslb.elchi."), nil, defaultFailbackDelay)
+	tests := []struct {
+		name    string
+		probe   healthProbe
+		wantErr bool
+	}{
+		{"tcp open", healthProbe{kind: "tcp", port: port, timeout: time.Second}, false},
+		{"tcp closed", healthProbe{kind: "tcp", port: closedPort, timeout: time.Second}, true},
+		{"http 2xx", healthProbe{kind: "http", port: port, path: "/", timeout: time.Second}, false},
+		{"http 503", healthProbe{kind: "http", port: port, path: "/down", timeout: time.Second}, true},
+		{"http expected 503", healthProbe{kind: "http", port: port, path: "/down", status: 503, timeout: time.Second}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.probe(context.Background(), addr, tt.probe)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// reportProbe feeds a probe result for ip into the health checker.
+func reportProbe(t *testing.T, h *HealthChecker, ip string, err error) {
+	t.Helper()
+	target, ok := h.targets[healthKey{addr: netip.MustParseAddr(ip)}]
+	if !ok {
+		t.Fatalf("No health check target for %s", ip)
+	}
+	h.report(target, err)
+}
+
+func TestHealthChecker_RiseFall(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10", "192.168.1.11"}},
+		},
+	}, 300)
+	h := NewHealthChecker("gslb.elchi.", cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+
+	// A canceled context adds the targets without probing them
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+
+	set := cache.lookup("app.gslb.elchi.", dns.TypeA)
+	probeErr := errors.New("connection refused")
+
+	// One failure is below the fall threshold of 2
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	if got := h.filter(set); got != set {
+		t.Fatal("Expected IP to stay healthy after a single failure")
+	}
+
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	healthy := h.filter(set)
+	if healthy == nil || len(healthy.rrs) != 1 || rrIP(healthy.rrs[0]) != "192.168.1.11" {
+		t.Fatalf("Expected only 192.168.1.11 to be healthy, got %+v", healthy)
+	}
+
+	// Default rise threshold of 2 successes brings it back
+	reportProbe(t, h, "192.168.1.10", nil)
+	if got := h.filter(set); got == set {
+		t.Fatal("Expected IP to stay unhealthy after a single success")
+	}
+	reportProbe(t, h, "192.168.1.10", nil)
+	if got := h.filter(set); got != set {
+		t.Error("Expected IP to be healthy again")
+	}
+}
+
+func TestHealthChecker_ReconcileRemovesTargets(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+	h := NewHealthChecker("gslb.elchi.", cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+
+	probeErr := errors.New("timeout")
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	reportProbe(t, h, "192.168.1.10", probeErr)
+	if h.downCount.Load() != 1 {
+		t.Fatalf("Expected 1 unhealthy target, got %d", h.downCount.Load())
+	}
+
+	// The IP leaves the cache, so its state must be dropped
+	cache.Update([]DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.20"}}}, 300)
+	h.reconcile(ctx)
+
+	if h.downCount.Load() != 0 {
+		t.Errorf("Expected no unhealthy targets, got %d", h.downCount.Load())
+	}
+	if len(h.targets) != 1 {
+		t.Errorf("Expected 1 target, got %d", len(h.targets))
+	}
+}
+
+func TestHealthChecker_ReportAfterRemoval(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+	h := NewHealthChecker("gslb.elchi.", cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.reconcile(ctx)
+	target := h.targets[healthKey{addr: netip.MustParseAddr("192.168.1.10")}]
+
+	// The probes finish after reconcile removed the target
+	cache.Update([]DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.20"}}}, 300)
+	h.reconcile(ctx)
+	probeErr := errors.New("timeout")
+	h.report(target, probeErr)
+	h.report(target, probeErr)
+
+	if h.downCount.Load() != 0 {
+		t.Errorf("Expected no unhealthy targets, got %d", h.downCount.Load())
+	}
+	if !target.healthy {
+		t.Error("Expected the removed target to be left alone")
+	}
+}
+
+func TestServeDNS_ExcludesUnhealthyIPs(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10", "192.168.1.11"}},
+		},
+	}, 300)
+	e.healthChecker = NewHealthChecker(e.Zone, e.cache, &HealthCheck{Type: "tcp", Port: 80, Fall: 2}, defaultFailbackDelay)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.healthChecker.reconcile(ctx)
+	probeErr := errors.New("connection refused")
+
+	reportProbe(t, e.healthChecker, "192.168.1.10", probeErr)
+	reportProbe(t, e.healthChecker, "192.168.1.10", probeErr)
+	if got := answerIPs(query(t, e, "app.gslb.elchi.", dns.TypeA)); len(got) != 1 || got[0] != "192.168.1.11" {
+		t.Errorf("Expected [192.168.1.11], got %v", got)
+	}
+
+	// With every IP down, the full set is served rather than nothing
+	reportProbe(t, e.healthChecker, "192.168.1.11", probeErr)
+	reportProbe(t, e.healthChecker, "192.168.1.11", probeErr)
+	if got := answerIPs(query(t, e, "app.gslb.elchi.", dns.TypeA)); len(got) != 2 {
+		t.Errorf("Expected full set of 2 IPs when all are down, got %v", got)
+	}
+}
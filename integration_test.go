@@ -38,10 +38,10 @@ func TestIntegration_FullLifecycle(t *testing.T) {
 	// Create plugin instance
 	e := &Elchi{
 		Zone:         "gslb.elchi.",
-		Endpoint:     server.URL,
+		Endpoints:    []string{server.URL},
 		Secret:       "test-secret",
 		cache:        NewRecordCache("gslb.elchi."),
-		client:       NewElchiClient(server.URL, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, false),
+		client:       NewElchiClient([]string{server.URL}, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, nil),
 		SyncInterval: 100 * time.Millisecond,
 		TTL:          300,
 		Next:         test.NextHandler(dns.RcodeSuccess, nil),
@@ -179,13 +179,13 @@ func TestIntegration_ErrorRecovery(t *testing.T) {
 
 	// Create plugin instance
 	e := &Elchi{
-		Zone:     "gslb.elchi.",
-		Endpoint: server.URL,
-		Secret:   "test-secret",
-		cache:    NewRecordCache("gslb.elchi."),
-		client:   NewElchiClient(server.URL, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, false),
-		TTL:      300,
-		Next:     test.NextHandler(dns.RcodeSuccess, nil),
+		Zone:      "gslb.elchi.",
+		Endpoints: []string{server.URL},
+		Secret:    "test-secret",
+		cache:     NewRecordCache("gslb.elchi."),
+		client:    NewElchiClient([]string{server.URL}, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, nil),
+		TTL:       300,
+		Next:      test.NextHandler(dns.RcodeSuccess, nil),
 	}
 
 	// Fetch initial snapshot
@@ -308,13 +308,13 @@ func TestIntegration_ConcurrentQueries(t *testing.T) {
 
 	// Create plugin instance
 	e := &Elchi{
-		Zone:     "gslb.elchi.",
-		Endpoint: server.URL,
-		Secret:   "test-secret",
-		cache:    NewRecordCache("gslb.elchi."),
-		client:   NewElchiClient(server.URL, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, false),
-		TTL:      300,
-		Next:     test.NextHandler(dns.RcodeSuccess, nil),
+		Zone:      "gslb.elchi.",
+		Endpoints: []string{server.URL},
+		Secret:    "test-secret",
+		cache:     NewRecordCache("gslb.elchi."),
+		client:    NewElchiClient([]string{server.URL}, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, nil),
+		TTL:       300,
+		Next:      test.NextHandler(dns.RcodeSuccess, nil),
 	}
 
 	// Fetch initial snapshot
@@ -391,13 +391,13 @@ func TestIntegration_MultiZone(t *testing.T) {
 
 	// Create plugin instance
 	e := &Elchi{
-		Zone:     "gslb.elchi.",
-		Endpoint: server.URL,
-		Secret:   "test-secret",
-		cache:    NewRecordCache("gslb.elchi."),
-		client:   NewElchiClient(server.URL, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, false),
-		TTL:      300,
-		Next:     test.NextHandler(dns.RcodeSuccess, nil),
+		Zone:      "gslb.elchi.",
+		Endpoints: []string{server.URL},
+		Secret:    "test-secret",
+		cache:     NewRecordCache("gslb.elchi."),
+		client:    NewElchiClient([]string{server.URL}, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, nil),
+		TTL:       300,
+		Next:      test.NextHandler(dns.RcodeSuccess, nil),
 	}
 
 	// Fetch initial snapshot
@@ -457,7 +457,7 @@ func TestIntegration_ChangesNotModified(t *testing.T) {
 	defer server.Close()
 
 	// Create client
-	client := NewElchiClient(server.URL, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, false)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi.", "test-secret", "", nil, 10*time.Second, nil)
 
 	// Fetch initial snapshot
 	ctx := context.Background()
@@ -504,8 +504,8 @@ func (mc *mockController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mc.mu.RLock()
 	defer mc.mu.RUnlock()
 
-	// Check authentication
-	if r.Header.Get("X-Elchi-Secret") != "test-secret" {
+	// Check authentication, signed or with the legacy header
+	if newRequestVerifier(authCompat, newSecretSource("test-secret"), 0).verify(r, time.Now()) != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
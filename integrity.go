@@ -0,0 +1,249 @@
+package elchi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// canonicalHashPrefix marks a version hash that is the canonical hash of the
+// records, see recordsHash. Other version hashes are opaque to the plugin.
+const canonicalHashPrefix = "sha256:"
+
+// hashMismatchError is returned when the records of a snapshot or change do
+// not match their version hash.
+type hashMismatchError struct {
+	versionHash string
+	computed    string
+}
+
+func (e *hashMismatchError) Error() string {
+	if !isCanonicalHash(e.versionHash) {
+		return fmt.Sprintf("version_hash %s is not a canonical hash", e.versionHash)
+	}
+	return fmt.Sprintf("records do not match version_hash %s (computed %s)", e.versionHash, e.computed)
+}
+
+// isHashMismatch reports whether err is, or wraps, a hash mismatch.
+func isHashMismatch(err error) bool {
+	var mismatch *hashMismatchError
+	return errors.As(err, &mismatch)
+}
+
+// isCanonicalHash reports whether a version hash can be verified against the
+// records.
+func isCanonicalHash(versionHash string) bool {
+	return strings.HasPrefix(versionHash, canonicalHashPrefix)
+}
+
+// recordsHash returns the canonical hash of records: "sha256:" and the hex
+// SHA-256 of the JSON array of the records, each encoded with the record
+// schema of the plugin and sorted by their encoding. The order the records
+// arrive in does not change the hash.
+func recordsHash(records []DNSRecord) (string, error) {
+	return canonicalHash(records)
+}
+
+// canonicalHash hashes items the way recordsHash hashes records.
+func canonicalHash[T any](items []T) (string, error) {
+	var h canonicalHasher
+	for i := range items {
+		if err := h.add(&items[i]); err != nil {
+			return "", fmt.Errorf("failed to encode item %d: %w", i, err)
+		}
+	}
+	return h.sum(), nil
+}
+
+// canonicalHasher computes a canonical hash of items added one at a time, so
+// records can be hashed while they are decoded. The canonical hash sorts the
+// encodings, so it keeps the encoding of every item until sum is called: a
+// streamed snapshot whose records are verified still holds about its encoded
+// size in memory, bounded by max_response_size.
+type canonicalHasher struct {
+	encoded [][]byte
+}
+
+// add adds the JSON encoding of item.
+func (h *canonicalHasher) add(item any) error {
+	data, err := canonicalEncoding(item)
+	if err != nil {
+		return err
+	}
+	h.encoded = append(h.encoded, data)
+	return nil
+}
+
+// sum returns the canonical hash of the items added so far.
+func (h *canonicalHasher) sum() string {
+	sortEncodings(h.encoded)
+	return sumEncodings(h.encoded)
+}
+
+// canonicalEncoding returns the encoding of item the canonical hash sorts.
+func canonicalEncoding(item any) ([]byte, error) {
+	// A record without IPs is hashed with "ips":null, whether the list was
+	// null, missing or empty, as the protobuf encoding cannot tell them apart
+	if r, ok := item.(*DNSRecord); ok && r.IPs != nil && len(r.IPs) == 0 {
+		record := *r
+		record.IPs = nil
+		item = &record
+	}
+	return json.Marshal(item)
+}
+
+// sortEncodings sorts encodings into the order of the canonical hash.
+func sortEncodings(encoded [][]byte) {
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+}
+
+// sumEncodings returns the canonical hash of sorted encodings.
+func sumEncodings(encoded [][]byte) string {
+	sum := sha256.New()
+	sum.Write([]byte("["))
+	for i, data := range encoded {
+		if i > 0 {
+			sum.Write([]byte(","))
+		}
+		sum.Write(data)
+	}
+	sum.Write([]byte("]"))
+	return canonicalHashPrefix + hex.EncodeToString(sum.Sum(nil))
+}
+
+// canonicalRecords holds the sorted encodings of the cached records, so the
+// canonical hash after a delta only needs the records of the names the delta
+// touches to be encoded. It is never modified, apply returns a new one.
+type canonicalRecords struct {
+	encoded [][]byte
+}
+
+// newCanonicalRecords encodes every record of sources.
+func newCanonicalRecords(sources map[string][]DNSRecord) (*canonicalRecords, error) {
+	var h canonicalHasher
+	for _, records := range sources {
+		for i := range records {
+			if err := h.add(&records[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sortEncodings(h.encoded)
+	return &canonicalRecords{encoded: h.encoded}, nil
+}
+
+// apply returns the encodings with the records of removed taken out and the
+// records of added put in. Every removed record must be in r.
+func (r *canonicalRecords) apply(removed, added []DNSRecord) (*canonicalRecords, error) {
+	var out, in canonicalHasher
+	for i := range removed {
+		if err := out.add(&removed[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range added {
+		if err := in.add(&added[i]); err != nil {
+			return nil, err
+		}
+	}
+	sortEncodings(out.encoded)
+	sortEncodings(in.encoded)
+
+	// Merge the three sorted lists in one pass
+	merged := make([][]byte, 0, len(r.encoded)-len(out.encoded)+len(in.encoded))
+	j, k := 0, 0
+	for _, data := range r.encoded {
+		if j < len(out.encoded) && bytes.Equal(out.encoded[j], data) {
+			j++
+			continue
+		}
+		for k < len(in.encoded) && bytes.Compare(in.encoded[k], data) <= 0 {
+			merged = append(merged, in.encoded[k])
+			k++
+		}
+		merged = append(merged, data)
+	}
+	if j < len(out.encoded) {
+		return nil, fmt.Errorf("removed record %s is not in the cache", out.encoded[j])
+	}
+	merged = append(merged, in.encoded[k:]...)
+	return &canonicalRecords{encoded: merged}, nil
+}
+
+// sum returns the canonical hash of the records.
+func (r *canonicalRecords) sum() string {
+	return sumEncodings(r.encoded)
+}
+
+// verifyRecordsHash checks records against a canonical version hash. Opaque
+// version hashes are accepted unless strict is set.
+func verifyRecordsHash(versionHash string, records []DNSRecord, strict bool) error {
+	if !strict && !isCanonicalHash(versionHash) {
+		return nil
+	}
+	computed, err := recordsHash(records)
+	if err != nil {
+		return err
+	}
+	return checkVersionHash(versionHash, computed)
+}
+
+// checkVersionHash compares a version hash with the computed canonical hash
+// of the records.
+func checkVersionHash(versionHash, computed string) error {
+	if computed != versionHash {
+		return &hashMismatchError{versionHash: versionHash, computed: computed}
+	}
+	return nil
+}
+
+// needsRecordsHash reports whether the records of a response with the
+// version hash have to be hashed: to verify a canonical version hash, to
+// reject an opaque one with strict_hash, or to check the signature.
+func (c *ElchiClient) needsRecordsHash(versionHash string) bool {
+	return isCanonicalHash(versionHash) || c.strictHash || len(c.trusted) > 0
+}
+
+// verifyChanges checks the signature of a changes response and the records
+// of a full one against its version hash. Deltas are verified by ApplyDelta
+// against the records they produce.
+func (c *ElchiClient) verifyChanges(changes *DNSChangesResponse) error {
+	if changes.Unchanged {
+		return nil
+	}
+	if err := c.trusted.verifyChanges(changes); err != nil {
+		return err
+	}
+	if changes.isDelta() {
+		if c.strictHash && !isCanonicalHash(changes.VersionHash) {
+			return &hashMismatchError{versionHash: changes.VersionHash}
+		}
+		return nil
+	}
+	return verifyRecordsHash(changes.VersionHash, changes.Records, c.strictHash)
+}
+
+// countSyncError counts a failed sync of the given type, or of type
+// "integrity" when records did not match their version hash, "signature"
+// when they were not signed by a trusted key, or "guard" when they were
+// quarantined.
+func (e *Elchi) countSyncError(syncType string, err error) {
+	switch {
+	case isGuardRejection(err):
+		syncType = "guard"
+	case isHashMismatch(err):
+		integrityErrors.WithLabelValues(e.Zone).Inc()
+		syncType = "integrity"
+	case errors.Is(err, errBadSignature):
+		signatureErrors.WithLabelValues(e.Zone, "sync").Inc()
+		syncType = "signature"
+	}
+	syncErrors.WithLabelValues(e.Zone, syncType).Inc()
+}
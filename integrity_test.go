@@ -0,0 +1,263 @@
+package elchi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustRecordsHash returns the canonical hash of records.
+func mustRecordsHash(t *testing.T, records []DNSRecord) string {
+	t.Helper()
+	hash, err := recordsHash(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestRecordsHash(t *testing.T) {
+	records := []DNSRecord{
+		{Name: "app.gslb.elchi", Type: "A", TTL: 60, IPs: []string{"192.168.1.10", "192.168.1.11"}},
+		{Name: "app.gslb.elchi", Type: "AAAA", IPs: []string{"2001:db8::10"}},
+		{Name: "eu.gslb.elchi", Type: "A", Failover: FailoverTargets{"us.gslb.elchi"}},
+	}
+	hash := mustRecordsHash(t, records)
+	if !strings.HasPrefix(hash, "sha256:") || len(hash) != len("sha256:")+64 {
+		t.Fatalf("Unexpected hash format %q", hash)
+	}
+
+	// The order of the records does not matter
+	reordered := []DNSRecord{records[2], records[0], records[1]}
+	if got := mustRecordsHash(t, reordered); got != hash {
+		t.Errorf("Expected the same hash for reordered records, got %s and %s", got, hash)
+	}
+
+	// Any change to a record does, including the order of its IPs
+	changed := []DNSRecord{records[0], records[1], records[2]}
+	changed[0].IPs = []string{"192.168.1.11", "192.168.1.10"}
+	if got := mustRecordsHash(t, changed); got == hash {
+		t.Error("Expected a different hash for reordered IPs")
+	}
+	if got := mustRecordsHash(t, records[:2]); got == hash {
+		t.Error("Expected a different hash for a missing record")
+	}
+}
+
+func TestCanonicalRecords_Apply(t *testing.T) {
+	app := DNSRecord{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}
+	eu := DNSRecord{Name: "eu.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}}
+	us := DNSRecord{Name: "us.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}}
+	current, err := newCanonicalRecords(map[string][]DNSRecord{"app.gslb.elchi.": {app}, "eu.gslb.elchi.": {eu}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := current.sum(), mustRecordsHash(t, []DNSRecord{app, eu}); got != want {
+		t.Fatalf("Expected %s, got %s", want, got)
+	}
+
+	// Replace a record and add one, the sum matches a full hash
+	changed := app
+	changed.IPs = []string{"192.168.1.20"}
+	next, err := current.apply([]DNSRecord{app}, []DNSRecord{changed, us})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := next.sum(), mustRecordsHash(t, []DNSRecord{eu, us, changed}); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if got, want := current.sum(), mustRecordsHash(t, []DNSRecord{app, eu}); got != want {
+		t.Error("Expected apply to leave the encodings alone")
+	}
+
+	// Removing a record that is not there is an error
+	if _, err := next.apply([]DNSRecord{app}, nil); err == nil {
+		t.Error("Expected an error for a missing record")
+	}
+}
+
+func TestVerifyRecordsHash(t *testing.T) {
+	records := []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}
+	hash := mustRecordsHash(t, records)
+
+	tests := []struct {
+		name        string
+		versionHash string
+		records     []DNSRecord
+		strict      bool
+		wantErr     bool
+	}{
+		{"canonical", hash, records, false, false},
+		{"canonical strict", hash, records, true, false},
+		{"truncated", hash, nil, false, true},
+		{"opaque", "v1", records, false, false},
+		{"opaque strict", "v1", records, true, true},
+		{"wrong canonical", "sha256:" + strings.Repeat("0", 64), records, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyRecordsHash(tt.versionHash, tt.records, tt.strict)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyRecordsHash() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !isHashMismatch(err) {
+				t.Errorf("Expected a hash mismatch error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchSnapshot_HashMismatch(t *testing.T) {
+	records := []DNSRecord{
+		{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		{Name: "web.gslb.elchi", Type: "A", IPs: []string{"192.168.1.20"}},
+	}
+	hash := mustRecordsHash(t, records)
+
+	// A proxy dropped the last record
+	served := records
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(DNSSnapshot{Zone: "gslb.elchi", VersionHash: hash, Records: served})
+	}))
+	defer server.Close()
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+
+	if _, err := client.FetchSnapshot(context.Background()); err != nil {
+		t.Fatalf("FetchSnapshot failed for intact records: %v", err)
+	}
+
+	served = records[:1]
+	_, err := client.FetchSnapshot(context.Background())
+	if !isHashMismatch(err) {
+		t.Fatalf("Expected a hash mismatch error, got %v", err)
+	}
+}
+
+func TestCheckChanges_StrictHash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(DNSChangesResponse{
+			Zone:        "gslb.elchi",
+			VersionHash: "v2",
+			Records:     []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+		})
+	}))
+	defer server.Close()
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+
+	// Opaque version hashes are accepted unless strict_hash is set
+	if _, err := client.CheckChanges(context.Background(), "v1"); err != nil {
+		t.Fatalf("CheckChanges failed: %v", err)
+	}
+	client.strictHash = true
+	if _, err := client.CheckChanges(context.Background(), "v1"); !isHashMismatch(err) {
+		t.Errorf("Expected a hash mismatch error with strict_hash, got %v", err)
+	}
+}
+
+func TestApplyDelta_HashMismatch(t *testing.T) {
+	cache := NewRecordCache("gslb.elchi.")
+	cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+			{Name: "dual.gslb.elchi", Type: "A", IPs: []string{"192.168.2.10"}},
+		},
+	}, 300)
+	upsert := DNSRecord{Name: "new.gslb.elchi", Type: "A", IPs: []string{"192.168.3.10"}}
+
+	// The delta hash covers all records, a wrong one leaves the cache alone
+	err := cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: mustRecordsHash(t, []DNSRecord{upsert}),
+		Records:     []DNSRecord{upsert},
+	}, 300)
+	if !isHashMismatch(err) {
+		t.Fatalf("Expected a hash mismatch error, got %v", err)
+	}
+	if hash := cache.GetVersionHash(); hash != "v1" {
+		t.Errorf("Expected the cache to stay at v1, got %s", hash)
+	}
+	if cache.HasName("new.gslb.elchi.") {
+		t.Error("Expected the rejected delta not to be applied")
+	}
+
+	want := append(cache.Snapshot().Records, upsert)
+	err = cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: mustRecordsHash(t, want),
+		Records:     []DNSRecord{upsert},
+	}, 300)
+	if err != nil {
+		t.Fatalf("ApplyDelta failed: %v", err)
+	}
+	if !cache.HasName("new.gslb.elchi.") {
+		t.Error("Expected the verified delta to be applied")
+	}
+
+	// The next delta is checked against the encodings kept from this one
+	changed := upsert
+	changed.IPs = []string{"192.168.3.20"}
+	want = []DNSRecord{changed}
+	for _, record := range cache.Snapshot().Records {
+		if record.Name != upsert.Name {
+			want = append(want, record)
+		}
+	}
+	err = cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    cache.GetVersionHash(),
+		VersionHash: mustRecordsHash(t, want),
+		Records:     []DNSRecord{changed},
+	}, 300)
+	if err != nil {
+		t.Fatalf("ApplyDelta of the second delta failed: %v", err)
+	}
+}
+
+func TestLoadChanges_HashMismatchFallback(t *testing.T) {
+	records := []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.20"}}}
+	hash := mustRecordsHash(t, records)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(DNSSnapshot{Zone: "gslb.elchi", VersionHash: hash, Records: records})
+	}))
+	defer server.Close()
+
+	e := &Elchi{
+		Zone:   "gslb.elchi.",
+		TTL:    300,
+		client: NewElchiClient([]string{server.URL}, "gslb.elchi.", "test-secret", "", nil, 5*time.Second, nil),
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+
+	// The delta claims the controller's hash but produces other records
+	err := e.loadChanges(context.Background(), &DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: hash,
+		Records:     records,
+	})
+	if err != nil {
+		t.Fatalf("loadChanges failed: %v", err)
+	}
+	if got := e.cache.GetVersionHash(); got != hash {
+		t.Errorf("Expected the full snapshot at %s, got %s", hash, got)
+	}
+	if e.cache.HasName("dual.gslb.elchi.") {
+		t.Error("Expected the full snapshot to replace the cache")
+	}
+}
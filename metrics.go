@@ -47,7 +47,71 @@ var (
 		Subsystem: "elchi",
 		Name:      "sync_errors_total",
 		Help:      "Total number of backend sync errors.",
-	}, []string{"zone", "type"}) // type: "snapshot" or "changes"
+	}, []string{"zone", "type"}) // type: "snapshot", "changes", "watch", "integrity", "signature" or "guard"
+
+	// deltaSyncs counts delta changes applied, and deltas replaced by a full snapshot because their base hash did not match.
+	deltaSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "delta_syncs_total",
+		Help:      "Total number of delta changes applied or replaced by a full snapshot.",
+	}, []string{"zone", "result"}) // result: "applied" or "fallback"
+
+	// integrityErrors counts snapshots and changes rejected because their records did not match the version hash.
+	integrityErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "integrity_errors_total",
+		Help:      "Total number of snapshots and changes rejected because their records did not match the version hash.",
+	}, []string{"zone"})
+
+	// signatureErrors counts snapshots, changes, /notify requests and persisted snapshots rejected because they were not signed by a trusted key.
+	signatureErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "signature_errors_total",
+		Help:      "Total number of snapshots, changes and notify requests rejected because they were not signed by a trusted key.",
+	}, []string{"zone", "source"}) // source: "sync", "notify" or "persist"
+
+	// guardRejections counts snapshots, changes and deltas quarantined because they exceeded a guard limit.
+	guardRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "guard_rejections_total",
+		Help:      "Total number of snapshots and changes quarantined because they exceeded a guard limit.",
+	}, []string{"zone", "limit"}) // limit: "max_removed", "max_ip_changes" or "min_records"
+
+	// snapshotQuarantined is 1 while a snapshot rejected by the guard is quarantined.
+	snapshotQuarantined = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "snapshot_quarantined",
+		Help:      "Whether a snapshot rejected by the guard is quarantined (1) or not (0).",
+	}, []string{"zone"})
+
+	// watchUpdates counts changes loaded from the controller watch stream.
+	watchUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "watch_updates_total",
+		Help:      "Total number of changes loaded from the controller watch.",
+	}, []string{"zone"})
+
+	// controllerErrors counts failed requests per controller endpoint, including ones retried on another endpoint.
+	controllerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "controller_errors_total",
+		Help:      "Total number of failed requests per controller endpoint.",
+	}, []string{"zone", "endpoint"})
+
+	// circuitBreakerOpen is 1 while a controller endpoint's circuit breaker is open, until a request succeeds again.
+	circuitBreakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "circuit_breaker_open",
+		Help:      "Whether the circuit breaker of a controller endpoint is open after repeated server errors (1) or closed (0).",
+	}, []string{"zone", "endpoint"})
 
 	// cacheSize tracks the number of records in cache.
 	cacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -63,5 +127,77 @@ var (
 		Subsystem: "elchi",
 		Name:      "webhook_requests_total",
 		Help:      "Total number of webhook requests received.",
-	}, []string{"endpoint", "status"}) // endpoint: "health", "records", "update"; status: "success", "error", "unauthorized"
+	}, []string{"endpoint", "status"}) // endpoint: "health", "records", "notify", "quarantine"; status: "success", "error", "unauthorized"
+
+	// regionalAnswers counts answers for records with per-region IPs, by matched client region.
+	regionalAnswers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "regional_answers_total",
+		Help:      "Total number of answers selected by client region.",
+	}, []string{"zone", "region"}) // region: matched region or "none"
+
+	// healthChecks counts local health check probes.
+	healthChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "health_checks_total",
+		Help:      "Total number of local health check probes.",
+	}, []string{"zone", "result"}) // result: "success" or "failure"
+
+	// unhealthyEndpoints tracks the number of IPs currently marked unhealthy.
+	unhealthyEndpoints = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "unhealthy_endpoints",
+		Help:      "Number of record IPs currently marked unhealthy by local health checks.",
+	}, []string{"zone"})
+
+	// failoverEvents counts records switched to or back from their failover target by this node.
+	failoverEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "failover_events_total",
+		Help:      "Total number of local failovers and recoveries based on health checks.",
+	}, []string{"zone", "event"}) // event: "failover" or "recovery"
+
+	// failedOverRecords tracks the number of records currently failed over by this node.
+	failedOverRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "failed_over_records",
+		Help:      "Number of records currently answered with their failover target because all IPs are unhealthy.",
+	}, []string{"zone"})
+
+	// recordFlaps counts changes to the records of names tracked by flap dampening.
+	recordFlaps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "record_flaps_total",
+		Help:      "Total number of changes to the records of a name that added a dampening penalty.",
+	}, []string{"zone"})
+
+	// dampeningEvents counts names suppressed and released by flap dampening.
+	dampeningEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "dampening_events_total",
+		Help:      "Total number of names suppressed and released by flap dampening.",
+	}, []string{"zone", "event"}) // event: "suppressed" or "released"
+
+	// suppressedNames tracks the number of names whose changes are currently held back by flap dampening.
+	suppressedNames = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "suppressed_names",
+		Help:      "Number of names whose changes are held back by flap dampening.",
+	}, []string{"zone"})
+
+	// coldStartResponses counts queries answered by the cold start policy before the first snapshot.
+	coldStartResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "elchi",
+		Name:      "cold_start_responses_total",
+		Help:      "Total number of queries answered by the cold start policy before the first snapshot was loaded.",
+	}, []string{"zone", "policy"})
 )
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	dnsv1 "github.com/cloudnativeworks/elchi-gslb/proto/elchi/dns/v1"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
 )
 
 // DNSSnapshot represents the full DNS snapshot response
@@ -14,28 +29,43 @@ type DNSSnapshot struct {
 	Zone        string      `json:"zone"`
 	VersionHash string      `json:"version_hash"`
 	Records     []DNSRecord `json:"records"`
+	Signature   string      `json:"signature,omitempty"`
 }
 
-// DNSChangesResponse represents the response from the changes endpoint
+// DNSChangesResponse represents the response from the changes endpoint.
+// The mock always sends full snapshots, never deltas (base_hash, deletes).
 type DNSChangesResponse struct {
 	Unchanged   bool        `json:"unchanged"`
 	Zone        string      `json:"zone,omitempty"`
 	VersionHash string      `json:"version_hash,omitempty"`
 	Records     []DNSRecord `json:"records,omitempty"`
+	Signature   string      `json:"signature,omitempty"`
 }
 
 // DNSRecord represents a single DNS record
 type DNSRecord struct {
-	Name     string   `json:"name"`
-	Type     string   `json:"type"`
-	TTL      uint32   `json:"ttl"`
-	IPs      []string `json:"ips"`
-	Failover string   `json:"failover,omitempty"`
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	TTL       uint32     `json:"ttl"`
+	IPs       []string   `json:"ips"`
+	Failover  string     `json:"failover,omitempty"`
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+}
+
+// Endpoint represents a single weighted IP of a DNS record
+type Endpoint struct {
+	IP     string `json:"ip"`
+	Weight uint32 `json:"weight,omitempty"`
+	Region string `json:"region,omitempty"`
 }
 
+// mockSecret is the shared secret, must match the secret in Corefile.
+const mockSecret = "test-secret-key"
+
+// mockSnapshot is served by all endpoints. Its version hash is set to the
+// canonical hash of the records at startup.
 var mockSnapshot = DNSSnapshot{
-	Zone:        "gslb.elchi",
-	VersionHash: "mock-v1-" + time.Now().Format("20060102150405"),
+	Zone: "gslb.elchi",
 	Records: []DNSRecord{
 		{
 			Name: "listener1.gslb.elchi",
@@ -59,7 +89,7 @@ var mockSnapshot = DNSSnapshot{
 			Name:     "asia.gslb.elchi",
 			Type:     "A",
 			TTL:      20,
-			IPs:      []string{}, // Empty IPs triggers failover
+			IPs:      nil, // No IPs triggers failover
 			Failover: "europe.gslb.elchi",
 		},
 		{
@@ -68,12 +98,35 @@ var mockSnapshot = DNSSnapshot{
 			TTL:  20,
 			IPs:  []string{"10.20.1.30", "10.20.1.31"},
 		},
+		{
+			Name: "weighted.gslb.elchi",
+			Type: "A",
+			TTL:  30,
+			Endpoints: []Endpoint{
+				{IP: "10.10.1.20", Weight: 80},
+				{IP: "10.20.1.30", Weight: 20},
+			},
+		},
 	},
 }
 
 func main() {
+	mockSnapshot.VersionHash = canonicalHash(mockSnapshot.Records)
+
+	// Sign the snapshot for the trusted_keys directive if a key is given
+	if seed := os.Getenv("MOCK_SIGNING_KEY"); seed != "" {
+		raw, err := base64.StdEncoding.DecodeString(seed)
+		if err != nil || len(raw) != ed25519.SeedSize {
+			log.Fatalf("MOCK_SIGNING_KEY must be a base64 Ed25519 seed of %d bytes", ed25519.SeedSize)
+		}
+		key := ed25519.NewKeyFromSeed(raw)
+		mockSnapshot.Signature = signSnapshot(key, mockSnapshot)
+		fmt.Printf("Signing snapshots, trusted key: %s\n", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	}
+
 	http.HandleFunc("/dns/snapshot", handleSnapshot)
 	http.HandleFunc("/dns/changes", handleChanges)
+	http.HandleFunc("/dns/watch", handleWatch)
 	http.HandleFunc("/health", handleHealth)
 
 	addr := ":1052"
@@ -81,6 +134,7 @@ func main() {
 	fmt.Printf("Endpoints:\n")
 	fmt.Printf("   GET  %s/dns/snapshot?zone=gslb.elchi\n", addr)
 	fmt.Printf("   GET  %s/dns/changes?zone=gslb.elchi&since=xyz\n", addr)
+	fmt.Printf("   GET  %s/dns/watch?zone=gslb.elchi&since=xyz\n", addr)
 	fmt.Printf("   GET  %s/health\n", addr)
 	fmt.Printf("\n")
 
@@ -92,8 +146,7 @@ func main() {
 
 func handleSnapshot(w http.ResponseWriter, r *http.Request) {
 	// Check authentication
-	secret := r.Header.Get("X-Elchi-Secret")
-	if secret != "test-secret-key" {
+	if !authorized(r) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -116,16 +169,12 @@ func handleSnapshot(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Snapshot requested for zone: %s", zone)
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(mockSnapshot); err != nil {
-		log.Printf("Failed to encode snapshot: %v", err)
-	}
+	writeResponse(w, r, &mockSnapshot)
 }
 
 func handleChanges(w http.ResponseWriter, r *http.Request) {
 	// Check authentication
-	secret := r.Header.Get("X-Elchi-Secret")
-	if secret != "test-secret-key" {
+	if !authorized(r) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -167,14 +216,228 @@ func handleChanges(w http.ResponseWriter, r *http.Request) {
 		Zone:        mockSnapshot.Zone,
 		VersionHash: mockSnapshot.VersionHash,
 		Records:     mockSnapshot.Records,
+		Signature:   mockSnapshot.Signature,
 	}
 
 	log.Printf("Changes found, returning new snapshot")
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Failed to encode changes: %v", err)
+	writeResponse(w, r, &resp)
+}
+
+// protobufMediaType is the media type of the protobuf encoding, see
+// proto/elchi/dns/v1/dns.proto.
+const protobufMediaType = "application/vnd.elchi.dns.v1+protobuf"
+
+// protoMessage is a response that can be encoded as protobuf.
+type protoMessage interface {
+	toProto() proto.Message
+}
+
+// writeResponse writes v as protobuf when the request accepts it, else as
+// JSON, compressed with zstd or gzip when the request accepts it.
+func writeResponse(w http.ResponseWriter, r *http.Request, v protoMessage) {
+	protobuf := strings.Contains(r.Header.Get("Accept"), protobufMediaType)
+	if protobuf {
+		w.Header().Set("Content-Type", protobufMediaType)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+
+	var out io.Writer = w
+	accept := r.Header.Get("Accept-Encoding")
+	switch {
+	case strings.Contains(accept, "zstd"):
+		w.Header().Set("Content-Encoding", "zstd")
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			log.Printf("Failed to create zstd writer: %v", err)
+			return
+		}
+		defer func() { _ = zw.Close() }()
+		out = zw
+	case strings.Contains(accept, "gzip"):
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		defer func() { _ = gw.Close() }()
+		out = gw
+	}
+
+	if protobuf {
+		data, err := proto.Marshal(v.toProto())
+		if err != nil {
+			log.Printf("Failed to encode response: %v", err)
+			return
+		}
+		if _, err := out.Write(data); err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+		return
+	}
+	if err := json.NewEncoder(out).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// toProto converts the snapshot to an elchi.dns.v1.Snapshot.
+func (s *DNSSnapshot) toProto() proto.Message {
+	return &dnsv1.Snapshot{
+		Zone:        s.Zone,
+		VersionHash: s.VersionHash,
+		Records:     recordsToProto(s.Records),
+		Signature:   s.Signature,
+	}
+}
+
+// toProto converts the response to an elchi.dns.v1.Changes.
+func (c *DNSChangesResponse) toProto() proto.Message {
+	return &dnsv1.Changes{
+		Unchanged:   c.Unchanged,
+		Zone:        c.Zone,
+		VersionHash: c.VersionHash,
+		Records:     recordsToProto(c.Records),
+		Signature:   c.Signature,
+	}
+}
+
+// recordsToProto converts records to elchi.dns.v1.Record messages.
+func recordsToProto(records []DNSRecord) []*dnsv1.Record {
+	msgs := make([]*dnsv1.Record, 0, len(records))
+	for _, r := range records {
+		msg := &dnsv1.Record{
+			Name: r.Name,
+			Type: r.Type,
+			Ttl:  r.TTL,
+			Ips:  r.IPs,
+		}
+		if r.Failover != "" {
+			msg.Failover = []string{r.Failover}
+		}
+		for _, ep := range r.Endpoints {
+			msg.Endpoints = append(msg.Endpoints, &dnsv1.Endpoint{Ip: ep.IP, Weight: ep.Weight, Region: ep.Region})
+		}
+		msgs = append(msgs, msg)
 	}
+	return msgs
+}
+
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	// Check authentication
+	if !authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	zone := strings.TrimSuffix(r.URL.Query().Get("zone"), ".")
+	if zone != strings.TrimSuffix(mockSnapshot.Zone, ".") {
+		http.Error(w, "Unknown zone", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	since := r.URL.Query().Get("since")
+	log.Printf("Watch opened for zone: %s, since: %s", zone, since)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// The mock data never changes, so only a stale node gets an event
+	if since != mockSnapshot.VersionHash {
+		data, err := json.Marshal(DNSChangesResponse{
+			Zone:        mockSnapshot.Zone,
+			VersionHash: mockSnapshot.VersionHash,
+			Records:     mockSnapshot.Records,
+			Signature:   mockSnapshot.Signature,
+		})
+		if err != nil {
+			log.Printf("Failed to encode changes: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "event: changes\nid: %s\ndata: %s\n\n", mockSnapshot.VersionHash, data)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Watch closed")
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// canonicalHash returns the canonical hash of the items, which the plugin
+// verifies: the SHA-256 of the JSON array of the items sorted by their
+// encoding. The mock record types encode like the plugin's for the mock data.
+func canonicalHash[T any](items []T) string {
+	encoded := make([][]byte, 0, len(items))
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			log.Fatalf("Failed to encode %v: %v", item, err)
+		}
+		encoded = append(encoded, data)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+
+	sum := sha256.Sum256([]byte("[" + string(bytes.Join(encoded, []byte(","))) + "]"))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// signSnapshot returns the Ed25519 signature of a snapshot, see trusted_keys
+// in the plugin README. Full changes responses share it.
+func signSnapshot(key ed25519.PrivateKey, snapshot DNSSnapshot) string {
+	message := strings.Join([]string{
+		"elchi-signature-v1",
+		"records",
+		strings.ToLower(strings.TrimSuffix(snapshot.Zone, ".")),
+		snapshot.VersionHash,
+		"", // base hash, the mock never sends deltas
+		canonicalHash(snapshot.Records),
+		canonicalHash([]struct{}{}), // no deletes
+	}, "\n")
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(message)))
+}
+
+// authorized accepts the legacy secret header or a valid HMAC signature
+// (auth directive). Nonces are not tracked, the mock does not guard against replays.
+func authorized(r *http.Request) bool {
+	sig := r.Header.Get("X-Elchi-Signature")
+	if sig == "" {
+		return r.Header.Get("X-Elchi-Secret") == mockSecret
+	}
+
+	timestamp := r.Header.Get("X-Elchi-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)).Abs() > 5*time.Minute {
+		return false
+	}
+
+	emptyBody := sha256.Sum256(nil)
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		hex.EncodeToString(emptyBody[:]),
+		timestamp,
+		r.Header.Get("X-Elchi-Nonce"),
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(mockSecret))
+	mac.Write([]byte(canonical))
+	return hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil))))
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
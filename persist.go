@@ -0,0 +1,230 @@
+package elchi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistDelay is how long writing the cache after a delta is held back, so a
+// burst of deltas rewrites the file once.
+const persistDelay = 10 * time.Second
+
+// applySnapshot replaces the cache with the snapshot and, if persist is
+// configured, writes it to disk as the last known good state.
+func (e *Elchi) applySnapshot(snapshot *DNSSnapshot) error {
+	if err := e.cache.ReplaceFromSnapshot(snapshot, e.TTL); err != nil {
+		return err
+	}
+	e.persistSnapshot(snapshot)
+	return nil
+}
+
+// loadSnapshot streams the full snapshot from the controller straight into a
+// new cache content, replaces the cache with it once the snapshot is verified
+// and persists the result. It returns the snapshot without its records and the
+// number of records it had.
+func (e *Elchi) loadSnapshot(ctx context.Context) (*DNSSnapshot, int, error) {
+	var builder *snapshotBuilder
+	var count int
+	var received []DNSRecord // Records as signed, only kept to persist them
+	keep := e.PersistPath != "" && e.persistSigned()
+	snapshot, err := e.client.StreamSnapshot(ctx, func() func(DNSRecord) {
+		// Every endpoint attempt starts over with an empty builder
+		builder = e.cache.newSnapshotBuilder(e.TTL)
+		count = 0
+		received = nil
+		return func(record DNSRecord) {
+			builder.add(record)
+			count++
+			if keep {
+				received = append(received, record)
+			}
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := builder.commit(snapshot.VersionHash); err != nil {
+		return nil, 0, err
+	}
+	if keep {
+		signed := *snapshot
+		signed.Records = received
+		e.persistSnapshot(&signed)
+	} else {
+		e.persistCache()
+	}
+	return snapshot, count, nil
+}
+
+// persistSigned reports whether only signed snapshots are persisted, which is
+// the case with trusted_keys.
+func (e *Elchi) persistSigned() bool {
+	return len(e.TrustedKeys) > 0
+}
+
+// persistCache writes the records in the cache to disk if persist is
+// configured. With trusted_keys the cache is not written: after a delta or
+// an operator action no signature covers its records, so the file keeps the
+// last signed snapshot.
+func (e *Elchi) persistCache() {
+	if e.PersistPath == "" {
+		return
+	}
+	if e.persistSigned() {
+		log.Debugf("Not persisting unsigned records, %s keeps the last signed snapshot", e.PersistPath)
+		return
+	}
+	e.persistSnapshot(e.cache.Snapshot())
+}
+
+// persistCacheLater writes the records in the cache to disk after
+// persistDelay, unless a write is already pending.
+func (e *Elchi) persistCacheLater() {
+	if e.PersistPath == "" || e.persistSigned() {
+		return
+	}
+	e.persistMu.Lock()
+	defer e.persistMu.Unlock()
+	if e.persistTimer == nil {
+		e.persistTimer = time.AfterFunc(persistDelay, e.flushPersist)
+	}
+}
+
+// flushPersist makes a pending write of the cache right away.
+func (e *Elchi) flushPersist() {
+	if e.cancelPersist() {
+		e.persistCache()
+	}
+}
+
+// cancelPersist drops a pending write of the cache and reports whether there
+// was one.
+func (e *Elchi) cancelPersist() bool {
+	e.persistMu.Lock()
+	defer e.persistMu.Unlock()
+	if e.persistTimer == nil {
+		return false
+	}
+	e.persistTimer.Stop()
+	e.persistTimer = nil
+	return true
+}
+
+// persistSnapshot writes the snapshot to disk if persist is configured. It
+// supersedes a pending write of the cache.
+func (e *Elchi) persistSnapshot(snapshot *DNSSnapshot) {
+	if e.PersistPath == "" {
+		return
+	}
+	e.cancelPersist()
+	if err := saveSnapshot(e.PersistPath, snapshot); err != nil {
+		// The cache is updated, only the next cold start loses out
+		log.Warningf("Failed to persist snapshot to %s: %v", e.PersistPath, err)
+	}
+}
+
+// loadPersistedSnapshot loads the snapshot persisted by a previous run into
+// the cache and reports whether it did.
+func (e *Elchi) loadPersistedSnapshot() bool {
+	snapshot, err := readPersistedSnapshot(e.PersistPath)
+	if err != nil {
+		log.Warningf("Ignoring persisted snapshot %s: %v", e.PersistPath, err)
+		return false
+	}
+	if snapshot == nil {
+		log.Infof("No persisted snapshot at %s", e.PersistPath)
+		return false
+	}
+	if snapshot.Zone != "" && normalizeDomain(snapshot.Zone) != e.Zone {
+		log.Warningf("Ignoring persisted snapshot %s: zone %s does not match %s", e.PersistPath, snapshot.Zone, e.Zone)
+		return false
+	}
+	if err := verifyRecordsHash(snapshot.VersionHash, snapshot.Records, e.StrictHash); err != nil {
+		log.Warningf("Ignoring persisted snapshot %s: %v", e.PersistPath, err)
+		return false
+	}
+	if e.persistSigned() {
+		// Anyone who can write the file must not get past trusted_keys
+		if err := verifyPersistedSignature(e.TrustedKeys, snapshot); err != nil {
+			log.Warningf("Ignoring persisted snapshot %s: %v", e.PersistPath, err)
+			signatureErrors.WithLabelValues(e.Zone, "persist").Inc()
+			return false
+		}
+	}
+	if err := e.cache.ReplaceFromSnapshot(snapshot, e.TTL); err != nil {
+		log.Warningf("Failed to load persisted snapshot %s: %v", e.PersistPath, err)
+		return false
+	}
+
+	log.Infof("Persisted snapshot loaded: %d records, hash=%s",
+		len(snapshot.Records), snapshot.VersionHash)
+	return true
+}
+
+// verifyPersistedSignature checks the signature of a persisted snapshot
+// against the trusted keys.
+func verifyPersistedSignature(keys trustedKeys, snapshot *DNSSnapshot) error {
+	recordsSum, err := recordsHash(snapshot.Records)
+	if err != nil {
+		return err
+	}
+	return keys.verifySnapshotSum(snapshot, recordsSum)
+}
+
+// saveSnapshot writes the snapshot to path atomically: it is written to a
+// temporary file in the same directory and renamed over path, so a crash never
+// leaves a partial file behind.
+func saveSnapshot(path string, snapshot *DNSSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return nil
+}
+
+// readPersistedSnapshot reads a snapshot written by saveSnapshot. It returns
+// nil without error if the file does not exist.
+func readPersistedSnapshot(path string) (*DNSSnapshot, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // Path comes from the Corefile
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot DNSSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if snapshot.VersionHash == "" {
+		return nil, fmt.Errorf("snapshot has no version hash")
+	}
+	return &snapshot, nil
+}
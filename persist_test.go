@@ -0,0 +1,277 @@
+package elchi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSaveSnapshot_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	snapshot := &DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "test.gslb.elchi", Type: "A", TTL: 60, IPs: []string{"192.168.1.10"}, Failover: FailoverTargets{"a.gslb.elchi", "b.gslb.elchi"}},
+		},
+	}
+
+	if err := saveSnapshot(path, snapshot); err != nil {
+		t.Fatalf("saveSnapshot failed: %v", err)
+	}
+	loaded, err := readPersistedSnapshot(path)
+	if err != nil {
+		t.Fatalf("readPersistedSnapshot failed: %v", err)
+	}
+	if loaded.VersionHash != "v1" || len(loaded.Records) != 1 || len(loaded.Records[0].Failover) != 2 {
+		t.Errorf("Unexpected snapshot after round trip: %+v", loaded)
+	}
+
+	// Only the snapshot itself is left, no temporary files
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 file in directory, got %d", len(entries))
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestLoadSnapshot_MissingOrInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	snapshot, err := readPersistedSnapshot(filepath.Join(dir, "missing.json"))
+	if snapshot != nil || err != nil {
+		t.Errorf("Expected nil snapshot without error for missing file, got %v, %v", snapshot, err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte(`{"zone": "gslb.elchi.", "records": [`), 0o600)
+	if _, err := readPersistedSnapshot(corrupt); err == nil {
+		t.Error("Expected error for truncated file")
+	}
+}
+
+func TestInitClient_PersistedSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := saveSnapshot(path, &DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records:     []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The controller is down at boot
+	controller := newMockController()
+	controller.setError(true)
+	server := httptest.NewServer(controller)
+	defer server.Close()
+
+	e := &Elchi{
+		Endpoints:       []string{server.URL},
+		Zone:            "gslb.elchi.",
+		Secret:          "test-secret",
+		TTL:             300,
+		SyncInterval:    time.Minute,
+		Timeout:         time.Second,
+		ColdStartPolicy: coldStartServfail,
+		PersistPath:     path,
+	}
+	if err := e.InitClient(); err != nil {
+		t.Fatalf("InitClient failed: %v", err)
+	}
+	defer e.Shutdown()
+
+	if msg := query(t, e, "test.gslb.elchi.", dns.TypeA); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected the persisted record to be served, got rcode %d", msg.Rcode)
+	}
+
+	// Once the controller is back, changes are applied and persisted
+	controller.setError(false)
+	controller.setSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v2",
+		Records:     []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.2.20"}}},
+	})
+	e.performSync()
+
+	saved, err := readPersistedSnapshot(path)
+	if err != nil || saved.VersionHash != "v2" {
+		t.Errorf("Expected persisted snapshot v2, got %+v, %v", saved, err)
+	}
+}
+
+func TestInitClient_PersistedSnapshotSyncsInBackground(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := saveSnapshot(path, &DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records:     []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newMockController()
+	controller.setSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v2",
+		Records:     []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.2.20"}}},
+	})
+	server := httptest.NewServer(controller)
+	defer server.Close()
+
+	e := &Elchi{
+		Endpoints:    []string{server.URL},
+		Zone:         "gslb.elchi.",
+		Secret:       "test-secret",
+		TTL:          300,
+		SyncInterval: time.Hour,
+		Timeout:      time.Second,
+		PersistPath:  path,
+	}
+	if err := e.InitClient(); err != nil {
+		t.Fatalf("InitClient failed: %v", err)
+	}
+	defer e.Shutdown()
+
+	// The first background sync runs right away instead of after sync_interval
+	deadline := time.Now().Add(5 * time.Second)
+	for e.cache.GetVersionHash() != "v2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the background sync to apply v2, got %s", e.cache.GetVersionHash())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInitClient_PersistedSnapshotOtherZone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	saveSnapshot(path, &DNSSnapshot{Zone: "other.elchi.", VersionHash: "v1"})
+
+	e := &Elchi{Zone: "gslb.elchi.", PersistPath: path, cache: NewRecordCache("gslb.elchi.")}
+	if e.loadPersistedSnapshot() {
+		t.Error("Expected snapshot of another zone to be ignored")
+	}
+}
+
+func TestLoadPersistedSnapshot_StrictHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	saveSnapshot(path, &DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records:     []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+	})
+
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, PersistPath: path, StrictHash: true, cache: NewRecordCache("gslb.elchi.")}
+	if e.loadPersistedSnapshot() {
+		t.Error("Expected an opaque version hash to be rejected with strict_hash")
+	}
+
+	e.StrictHash = false
+	if !e.loadPersistedSnapshot() {
+		t.Error("Expected an opaque version hash to be accepted without strict_hash")
+	}
+}
+
+func TestLoadPersistedSnapshot_TrustedKeys(t *testing.T) {
+	public, private := newSigningKey(t)
+	records := []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}
+	signed := DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records:     records,
+		Signature:   sign(t, private, signContextRecords, "gslb.elchi", "v1", "", records, nil),
+	}
+
+	tests := []struct {
+		name     string
+		snapshot func() DNSSnapshot
+		want     bool
+	}{
+		{"signed", func() DNSSnapshot { return signed }, true},
+		{"unsigned", func() DNSSnapshot {
+			s := signed
+			s.Signature = ""
+			return s
+		}, false},
+		{"records changed on disk", func() DNSSnapshot {
+			s := signed
+			s.Records = []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"203.0.113.66"}}}
+			return s
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			snapshot := tt.snapshot()
+			if err := saveSnapshot(path, &snapshot); err != nil {
+				t.Fatal(err)
+			}
+
+			e := &Elchi{Zone: "gslb.elchi.", TTL: 300, PersistPath: path, TrustedKeys: []ed25519.PublicKey{public}}
+			e.cache = NewRecordCache(e.Zone)
+			if got := e.loadPersistedSnapshot(); got != tt.want {
+				t.Errorf("loadPersistedSnapshot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSnapshot_PersistsSignature(t *testing.T) {
+	public, private := newSigningKey(t)
+	records := []DNSRecord{
+		{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		{Name: "other.example.com", Type: "A", IPs: []string{"192.168.1.20"}}, // Skipped, but signed
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(DNSSnapshot{
+			Zone:        "gslb.elchi",
+			VersionHash: "v1",
+			Records:     records,
+			Signature:   sign(t, private, signContextRecords, "gslb.elchi", "v1", "", records, nil),
+		})
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, PersistPath: path, TrustedKeys: []ed25519.PublicKey{public}}
+	e.cache = NewRecordCache(e.Zone)
+	e.client = NewElchiClient([]string{server.URL}, e.Zone, "test-secret", "", nil, 5*time.Second, nil)
+	e.client.trusted = e.TrustedKeys
+	if _, _, err := e.loadSnapshot(context.Background()); err != nil {
+		t.Fatalf("loadSnapshot failed: %v", err)
+	}
+
+	saved, err := readPersistedSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPersistedSignature(e.TrustedKeys, saved); err != nil {
+		t.Errorf("Expected the persisted snapshot to keep a valid signature: %v", err)
+	}
+
+	// No signature covers the records after a delta, the file keeps v1
+	err = e.cache.ApplyDelta(&DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		BaseHash:    "v1",
+		VersionHash: "v2",
+		Deletes:     []DeleteRecord{{Name: "test.gslb.elchi", Type: "A"}},
+	}, e.TTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.persistCache()
+	if saved, err := readPersistedSnapshot(path); err != nil || saved.VersionHash != "v1" {
+		t.Errorf("Expected the signed snapshot v1 to stay persisted, got %+v, %v", saved, err)
+	}
+}
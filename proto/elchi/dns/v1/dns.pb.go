@@ -0,0 +1,773 @@
+// Protobuf encoding of the Elchi DNS API, served as
+// application/vnd.elchi.dns.v1+protobuf next to the JSON encoding.
+//
+// Every message mirrors the JSON object of the same name field by field. The
+// Go code in dns.pb.go is generated from this file with protoc-gen-go (make
+// proto) and shared by the plugin and the mock controller. Fields are only
+// ever added, never renumbered; an incompatible change gets a new package and
+// media type version.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: elchi/dns/v1/dns.proto
+
+package dnsv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Response of GET /dns/snapshot.
+type Snapshot struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Zone        string                 `protobuf:"bytes,1,opt,name=zone,proto3" json:"zone,omitempty"`
+	VersionHash string                 `protobuf:"bytes,2,opt,name=version_hash,json=versionHash,proto3" json:"version_hash,omitempty"`
+	Records     []*Record              `protobuf:"bytes,3,rep,name=records,proto3" json:"records,omitempty"`
+	// Base64 Ed25519 signature of the controller (see trusted_keys).
+	Signature     string `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Snapshot) Reset() {
+	*x = Snapshot{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Snapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Snapshot) ProtoMessage() {}
+
+func (x *Snapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Snapshot.ProtoReflect.Descriptor instead.
+func (*Snapshot) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Snapshot) GetZone() string {
+	if x != nil {
+		return x.Zone
+	}
+	return ""
+}
+
+func (x *Snapshot) GetVersionHash() string {
+	if x != nil {
+		return x.VersionHash
+	}
+	return ""
+}
+
+func (x *Snapshot) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *Snapshot) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+// Response of GET /dns/changes and of a /dns/watch long-poll.
+type Changes struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Unchanged   bool                   `protobuf:"varint,1,opt,name=unchanged,proto3" json:"unchanged,omitempty"`
+	Zone        string                 `protobuf:"bytes,2,opt,name=zone,proto3" json:"zone,omitempty"`
+	VersionHash string                 `protobuf:"bytes,3,opt,name=version_hash,json=versionHash,proto3" json:"version_hash,omitempty"`
+	// Version hash a delta applies to, empty for a full record list.
+	BaseHash      string          `protobuf:"bytes,4,opt,name=base_hash,json=baseHash,proto3" json:"base_hash,omitempty"`
+	Records       []*Record       `protobuf:"bytes,5,rep,name=records,proto3" json:"records,omitempty"`
+	Deletes       []*DeleteRecord `protobuf:"bytes,6,rep,name=deletes,proto3" json:"deletes,omitempty"`
+	Signature     string          `protobuf:"bytes,7,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Changes) Reset() {
+	*x = Changes{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Changes) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Changes) ProtoMessage() {}
+
+func (x *Changes) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Changes.ProtoReflect.Descriptor instead.
+func (*Changes) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Changes) GetUnchanged() bool {
+	if x != nil {
+		return x.Unchanged
+	}
+	return false
+}
+
+func (x *Changes) GetZone() string {
+	if x != nil {
+		return x.Zone
+	}
+	return ""
+}
+
+func (x *Changes) GetVersionHash() string {
+	if x != nil {
+		return x.VersionHash
+	}
+	return ""
+}
+
+func (x *Changes) GetBaseHash() string {
+	if x != nil {
+		return x.BaseHash
+	}
+	return ""
+}
+
+func (x *Changes) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *Changes) GetDeletes() []*DeleteRecord {
+	if x != nil {
+		return x.Deletes
+	}
+	return nil
+}
+
+func (x *Changes) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+// Request body of POST /notify.
+type NotifyRequest struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Records   []*Record              `protobuf:"bytes,1,rep,name=records,proto3" json:"records,omitempty"`
+	Deletes   []*DeleteRecord        `protobuf:"bytes,2,rep,name=deletes,proto3" json:"deletes,omitempty"`
+	Signature string                 `protobuf:"bytes,3,opt,name=signature,proto3" json:"signature,omitempty"`
+	// Unix time in seconds the request was signed at (see trusted_keys).
+	Timestamp     int64 `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NotifyRequest) Reset() {
+	*x = NotifyRequest{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NotifyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NotifyRequest) ProtoMessage() {}
+
+func (x *NotifyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NotifyRequest.ProtoReflect.Descriptor instead.
+func (*NotifyRequest) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *NotifyRequest) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *NotifyRequest) GetDeletes() []*DeleteRecord {
+	if x != nil {
+		return x.Deletes
+	}
+	return nil
+}
+
+func (x *NotifyRequest) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+func (x *NotifyRequest) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+// Response of POST /notify.
+type NotifyResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Updated       int32                  `protobuf:"varint,2,opt,name=updated,proto3" json:"updated,omitempty"`
+	Deleted       int32                  `protobuf:"varint,3,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NotifyResponse) Reset() {
+	*x = NotifyResponse{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NotifyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NotifyResponse) ProtoMessage() {}
+
+func (x *NotifyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NotifyResponse.ProtoReflect.Descriptor instead.
+func (*NotifyResponse) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *NotifyResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *NotifyResponse) GetUpdated() int32 {
+	if x != nil {
+		return x.Updated
+	}
+	return 0
+}
+
+func (x *NotifyResponse) GetDeleted() int32 {
+	if x != nil {
+		return x.Deleted
+	}
+	return 0
+}
+
+type Record struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// "A" or "AAAA".
+	Type string   `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Ttl  uint32   `protobuf:"varint,3,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Ips  []string `protobuf:"bytes,4,rep,name=ips,proto3" json:"ips,omitempty"`
+	// Failover CNAME targets, most preferred first.
+	Failover      []string          `protobuf:"bytes,5,rep,name=failover,proto3" json:"failover,omitempty"`
+	IpRegions     map[string]string `protobuf:"bytes,6,rep,name=ip_regions,json=ipRegions,proto3" json:"ip_regions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Endpoints     []*Endpoint       `protobuf:"bytes,7,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+	MaxAnswers    int32             `protobuf:"varint,8,opt,name=max_answers,json=maxAnswers,proto3" json:"max_answers,omitempty"`
+	HealthCheck   *HealthCheck      `protobuf:"bytes,9,opt,name=health_check,json=healthCheck,proto3" json:"health_check,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Record) Reset() {
+	*x = Record{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Record) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Record) ProtoMessage() {}
+
+func (x *Record) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Record.ProtoReflect.Descriptor instead.
+func (*Record) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Record) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Record) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Record) GetTtl() uint32 {
+	if x != nil {
+		return x.Ttl
+	}
+	return 0
+}
+
+func (x *Record) GetIps() []string {
+	if x != nil {
+		return x.Ips
+	}
+	return nil
+}
+
+func (x *Record) GetFailover() []string {
+	if x != nil {
+		return x.Failover
+	}
+	return nil
+}
+
+func (x *Record) GetIpRegions() map[string]string {
+	if x != nil {
+		return x.IpRegions
+	}
+	return nil
+}
+
+func (x *Record) GetEndpoints() []*Endpoint {
+	if x != nil {
+		return x.Endpoints
+	}
+	return nil
+}
+
+func (x *Record) GetMaxAnswers() int32 {
+	if x != nil {
+		return x.MaxAnswers
+	}
+	return 0
+}
+
+func (x *Record) GetHealthCheck() *HealthCheck {
+	if x != nil {
+		return x.HealthCheck
+	}
+	return nil
+}
+
+type Endpoint struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ip            string                 `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	Weight        uint32                 `protobuf:"varint,2,opt,name=weight,proto3" json:"weight,omitempty"`
+	Region        string                 `protobuf:"bytes,3,opt,name=region,proto3" json:"region,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Endpoint) Reset() {
+	*x = Endpoint{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Endpoint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Endpoint) ProtoMessage() {}
+
+func (x *Endpoint) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Endpoint.ProtoReflect.Descriptor instead.
+func (*Endpoint) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Endpoint) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *Endpoint) GetWeight() uint32 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+func (x *Endpoint) GetRegion() string {
+	if x != nil {
+		return x.Region
+	}
+	return ""
+}
+
+type HealthCheck struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// "tcp", "http" or "https".
+	Type           string `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Port           int32  `protobuf:"varint,2,opt,name=port,proto3" json:"port,omitempty"`
+	Path           string `protobuf:"bytes,3,opt,name=path,proto3" json:"path,omitempty"`
+	ExpectedStatus int32  `protobuf:"varint,4,opt,name=expected_status,json=expectedStatus,proto3" json:"expected_status,omitempty"`
+	// Go durations, e.g. "10s".
+	Interval      string `protobuf:"bytes,5,opt,name=interval,proto3" json:"interval,omitempty"`
+	Timeout       string `protobuf:"bytes,6,opt,name=timeout,proto3" json:"timeout,omitempty"`
+	Rise          int32  `protobuf:"varint,7,opt,name=rise,proto3" json:"rise,omitempty"`
+	Fall          int32  `protobuf:"varint,8,opt,name=fall,proto3" json:"fall,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HealthCheck) Reset() {
+	*x = HealthCheck{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HealthCheck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HealthCheck) ProtoMessage() {}
+
+func (x *HealthCheck) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HealthCheck.ProtoReflect.Descriptor instead.
+func (*HealthCheck) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *HealthCheck) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *HealthCheck) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *HealthCheck) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *HealthCheck) GetExpectedStatus() int32 {
+	if x != nil {
+		return x.ExpectedStatus
+	}
+	return 0
+}
+
+func (x *HealthCheck) GetInterval() string {
+	if x != nil {
+		return x.Interval
+	}
+	return ""
+}
+
+func (x *HealthCheck) GetTimeout() string {
+	if x != nil {
+		return x.Timeout
+	}
+	return ""
+}
+
+func (x *HealthCheck) GetRise() int32 {
+	if x != nil {
+		return x.Rise
+	}
+	return 0
+}
+
+func (x *HealthCheck) GetFall() int32 {
+	if x != nil {
+		return x.Fall
+	}
+	return 0
+}
+
+type DeleteRecord struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Type          string                 `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteRecord) Reset() {
+	*x = DeleteRecord{}
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteRecord) ProtoMessage() {}
+
+func (x *DeleteRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_elchi_dns_v1_dns_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteRecord.ProtoReflect.Descriptor instead.
+func (*DeleteRecord) Descriptor() ([]byte, []int) {
+	return file_elchi_dns_v1_dns_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *DeleteRecord) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *DeleteRecord) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+var File_elchi_dns_v1_dns_proto protoreflect.FileDescriptor
+
+const file_elchi_dns_v1_dns_proto_rawDesc = "" +
+	"\n" +
+	"\x16elchi/dns/v1/dns.proto\x12\felchi.dns.v1\"\x8f\x01\n" +
+	"\bSnapshot\x12\x12\n" +
+	"\x04zone\x18\x01 \x01(\tR\x04zone\x12!\n" +
+	"\fversion_hash\x18\x02 \x01(\tR\vversionHash\x12.\n" +
+	"\arecords\x18\x03 \x03(\v2\x14.elchi.dns.v1.RecordR\arecords\x12\x1c\n" +
+	"\tsignature\x18\x04 \x01(\tR\tsignature\"\xff\x01\n" +
+	"\aChanges\x12\x1c\n" +
+	"\tunchanged\x18\x01 \x01(\bR\tunchanged\x12\x12\n" +
+	"\x04zone\x18\x02 \x01(\tR\x04zone\x12!\n" +
+	"\fversion_hash\x18\x03 \x01(\tR\vversionHash\x12\x1b\n" +
+	"\tbase_hash\x18\x04 \x01(\tR\bbaseHash\x12.\n" +
+	"\arecords\x18\x05 \x03(\v2\x14.elchi.dns.v1.RecordR\arecords\x124\n" +
+	"\adeletes\x18\x06 \x03(\v2\x1a.elchi.dns.v1.DeleteRecordR\adeletes\x12\x1c\n" +
+	"\tsignature\x18\a \x01(\tR\tsignature\"\xb1\x01\n" +
+	"\rNotifyRequest\x12.\n" +
+	"\arecords\x18\x01 \x03(\v2\x14.elchi.dns.v1.RecordR\arecords\x124\n" +
+	"\adeletes\x18\x02 \x03(\v2\x1a.elchi.dns.v1.DeleteRecordR\adeletes\x12\x1c\n" +
+	"\tsignature\x18\x03 \x01(\tR\tsignature\x12\x1c\n" +
+	"\ttimestamp\x18\x04 \x01(\x03R\ttimestamp\"\\\n" +
+	"\x0eNotifyResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x18\n" +
+	"\aupdated\x18\x02 \x01(\x05R\aupdated\x12\x18\n" +
+	"\adeleted\x18\x03 \x01(\x05R\adeleted\"\x87\x03\n" +
+	"\x06Record\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x10\n" +
+	"\x03ttl\x18\x03 \x01(\rR\x03ttl\x12\x10\n" +
+	"\x03ips\x18\x04 \x03(\tR\x03ips\x12\x1a\n" +
+	"\bfailover\x18\x05 \x03(\tR\bfailover\x12B\n" +
+	"\n" +
+	"ip_regions\x18\x06 \x03(\v2#.elchi.dns.v1.Record.IpRegionsEntryR\tipRegions\x124\n" +
+	"\tendpoints\x18\a \x03(\v2\x16.elchi.dns.v1.EndpointR\tendpoints\x12\x1f\n" +
+	"\vmax_answers\x18\b \x01(\x05R\n" +
+	"maxAnswers\x12<\n" +
+	"\fhealth_check\x18\t \x01(\v2\x19.elchi.dns.v1.HealthCheckR\vhealthCheck\x1a<\n" +
+	"\x0eIpRegionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"J\n" +
+	"\bEndpoint\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\x12\x16\n" +
+	"\x06weight\x18\x02 \x01(\rR\x06weight\x12\x16\n" +
+	"\x06region\x18\x03 \x01(\tR\x06region\"\xd0\x01\n" +
+	"\vHealthCheck\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x12\n" +
+	"\x04port\x18\x02 \x01(\x05R\x04port\x12\x12\n" +
+	"\x04path\x18\x03 \x01(\tR\x04path\x12'\n" +
+	"\x0fexpected_status\x18\x04 \x01(\x05R\x0eexpectedStatus\x12\x1a\n" +
+	"\binterval\x18\x05 \x01(\tR\binterval\x12\x18\n" +
+	"\atimeout\x18\x06 \x01(\tR\atimeout\x12\x12\n" +
+	"\x04rise\x18\a \x01(\x05R\x04rise\x12\x12\n" +
+	"\x04fall\x18\b \x01(\x05R\x04fall\"6\n" +
+	"\fDeleteRecord\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04typeBAZ?github.com/cloudnativeworks/elchi-gslb/proto/elchi/dns/v1;dnsv1b\x06proto3"
+
+var (
+	file_elchi_dns_v1_dns_proto_rawDescOnce sync.Once
+	file_elchi_dns_v1_dns_proto_rawDescData []byte
+)
+
+func file_elchi_dns_v1_dns_proto_rawDescGZIP() []byte {
+	file_elchi_dns_v1_dns_proto_rawDescOnce.Do(func() {
+		file_elchi_dns_v1_dns_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_elchi_dns_v1_dns_proto_rawDesc), len(file_elchi_dns_v1_dns_proto_rawDesc)))
+	})
+	return file_elchi_dns_v1_dns_proto_rawDescData
+}
+
+var file_elchi_dns_v1_dns_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_elchi_dns_v1_dns_proto_goTypes = []any{
+	(*Snapshot)(nil),       // 0: elchi.dns.v1.Snapshot
+	(*Changes)(nil),        // 1: elchi.dns.v1.Changes
+	(*NotifyRequest)(nil),  // 2: elchi.dns.v1.NotifyRequest
+	(*NotifyResponse)(nil), // 3: elchi.dns.v1.NotifyResponse
+	(*Record)(nil),         // 4: elchi.dns.v1.Record
+	(*Endpoint)(nil),       // 5: elchi.dns.v1.Endpoint
+	(*HealthCheck)(nil),    // 6: elchi.dns.v1.HealthCheck
+	(*DeleteRecord)(nil),   // 7: elchi.dns.v1.DeleteRecord
+	nil,                    // 8: elchi.dns.v1.Record.IpRegionsEntry
+}
+var file_elchi_dns_v1_dns_proto_depIdxs = []int32{
+	4, // 0: elchi.dns.v1.Snapshot.records:type_name -> elchi.dns.v1.Record
+	4, // 1: elchi.dns.v1.Changes.records:type_name -> elchi.dns.v1.Record
+	7, // 2: elchi.dns.v1.Changes.deletes:type_name -> elchi.dns.v1.DeleteRecord
+	4, // 3: elchi.dns.v1.NotifyRequest.records:type_name -> elchi.dns.v1.Record
+	7, // 4: elchi.dns.v1.NotifyRequest.deletes:type_name -> elchi.dns.v1.DeleteRecord
+	8, // 5: elchi.dns.v1.Record.ip_regions:type_name -> elchi.dns.v1.Record.IpRegionsEntry
+	5, // 6: elchi.dns.v1.Record.endpoints:type_name -> elchi.dns.v1.Endpoint
+	6, // 7: elchi.dns.v1.Record.health_check:type_name -> elchi.dns.v1.HealthCheck
+	8, // [8:8] is the sub-list for method output_type
+	8, // [8:8] is the sub-list for method input_type
+	8, // [8:8] is the sub-list for extension type_name
+	8, // [8:8] is the sub-list for extension extendee
+	0, // [0:8] is the sub-list for field type_name
+}
+
+func init() { file_elchi_dns_v1_dns_proto_init() }
+func file_elchi_dns_v1_dns_proto_init() {
+	if File_elchi_dns_v1_dns_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_elchi_dns_v1_dns_proto_rawDesc), len(file_elchi_dns_v1_dns_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_elchi_dns_v1_dns_proto_goTypes,
+		DependencyIndexes: file_elchi_dns_v1_dns_proto_depIdxs,
+		MessageInfos:      file_elchi_dns_v1_dns_proto_msgTypes,
+	}.Build()
+	File_elchi_dns_v1_dns_proto = out.File
+	file_elchi_dns_v1_dns_proto_goTypes = nil
+	file_elchi_dns_v1_dns_proto_depIdxs = nil
+}
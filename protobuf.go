@@ -0,0 +1,266 @@
+package elchi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	dnsv1 "github.com/cloudnativeworks/elchi-gslb/proto/elchi/dns/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// protobufMediaType is the media type of the protobuf encoding of the API,
+	// see proto/elchi/dns/v1/dns.proto
+	protobufMediaType = "application/vnd.elchi.dns.v1+protobuf"
+	// jsonMediaType is the media type of the default JSON encoding
+	jsonMediaType = "application/json"
+)
+
+// Encodings of controller responses, see the encoding directive.
+const (
+	encodingJSON     = "json"
+	encodingProtobuf = "protobuf"
+)
+
+// snapshotRecordsField is the field number of Snapshot.records, the only
+// field decodeSnapshotProto does not pass to the generated code as a whole.
+var snapshotRecordsField = (&dnsv1.Snapshot{}).ProtoReflect().Descriptor().Fields().ByName("records").Number()
+
+// isProtobuf reports whether a Content-Type header is the protobuf encoding.
+// Anything else, including no Content-Type, is JSON.
+func isProtobuf(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == protobufMediaType
+}
+
+// acceptHeader returns the Accept header for an encoding. JSON stays
+// acceptable with protobuf, for controllers that do not support it.
+func acceptHeader(encoding string) string {
+	if encoding == encodingProtobuf {
+		return protobufMediaType + ", " + jsonMediaType + ";q=0.5"
+	}
+	return jsonMediaType
+}
+
+// acceptsProtobuf reports whether an Accept header lists the protobuf
+// encoding.
+func acceptsProtobuf(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		if isProtobuf(mediaRange) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSnapshotProto decodes a protobuf Snapshot from r like decodeSnapshot
+// does for JSON: records are passed to add one at a time while they are read.
+// Only the top-level fields are split here, so the whole snapshot is never
+// held in memory; every field is then decoded by the generated code.
+func decodeSnapshotProto(r io.Reader, snapshot *DNSSnapshot, add func(DNSRecord) error) error {
+	br := bufio.NewReader(r)
+	var header dnsv1.Snapshot
+	for {
+		num, typ, field, err := readProtoField(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if num == snapshotRecordsField {
+			if typ != protowire.BytesType {
+				return fmt.Errorf("field %d: unexpected wire type %d", num, typ)
+			}
+			var record dnsv1.Record
+			if err := proto.Unmarshal(field, &record); err != nil {
+				return fmt.Errorf("field %d: %w", num, err)
+			}
+			if err := add(recordFromProto(&record)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Applied right away, the client checks the version hash on the first record
+		if err := (proto.UnmarshalOptions{Merge: true}).Unmarshal(field, &header); err != nil {
+			return fmt.Errorf("field %d: %w", num, err)
+		}
+		snapshot.Zone = header.GetZone()
+		snapshot.VersionHash = header.GetVersionHash()
+		snapshot.Signature = header.GetSignature()
+	}
+}
+
+// readProtoField reads the next top-level field of a message from r. For
+// the records field it returns the encoded record, for any other field the
+// complete encoded field including its tag. It returns io.EOF at the end of
+// the message.
+func readProtoField(r *bufio.Reader) (protowire.Number, protowire.Type, []byte, error) {
+	tag, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	num, typ := protowire.DecodeTag(tag)
+	if num < protowire.MinValidNumber {
+		return 0, 0, nil, fmt.Errorf("invalid field number %d", num)
+	}
+
+	field := protowire.AppendVarint(nil, tag)
+	switch typ {
+	case protowire.VarintType:
+		var v uint64
+		if v, err = binary.ReadUvarint(r); err == nil {
+			field = protowire.AppendVarint(field, v)
+		}
+	case protowire.BytesType:
+		var n uint64
+		if n, err = binary.ReadUvarint(r); err == nil {
+			// Read in chunks instead of allocating a length from the wire
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(r, int64(min(n, 1<<62)))) //nolint:gosec // Bounded above
+			if err == nil && uint64(len(value)) != n {
+				err = io.ErrUnexpectedEOF
+			}
+			if num == snapshotRecordsField {
+				field = value
+			} else {
+				field = protowire.AppendBytes(field, value)
+			}
+		}
+	case protowire.Fixed32Type, protowire.Fixed64Type:
+		size := 4
+		if typ == protowire.Fixed64Type {
+			size = 8
+		}
+		value := make([]byte, size)
+		if _, err = io.ReadFull(r, value); err == nil {
+			field = append(field, value...)
+		}
+	default:
+		return 0, 0, nil, fmt.Errorf("field %d: unexpected wire type %d", num, typ)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return num, typ, field, err
+}
+
+// decodeChanges decodes a changes response in the encoding of contentType.
+func decodeChanges(contentType string, r io.Reader, changes *DNSChangesResponse) error {
+	if !isProtobuf(contentType) {
+		return json.NewDecoder(r).Decode(changes)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var msg dnsv1.Changes
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	*changes = DNSChangesResponse{
+		Unchanged:   msg.GetUnchanged(),
+		Zone:        msg.GetZone(),
+		VersionHash: msg.GetVersionHash(),
+		BaseHash:    msg.GetBaseHash(),
+		Records:     recordsFromProto(msg.GetRecords()),
+		Deletes:     deletesFromProto(msg.GetDeletes()),
+		Signature:   msg.GetSignature(),
+	}
+	return nil
+}
+
+// decodeNotify decodes a /notify request body in the encoding of contentType.
+func decodeNotify(contentType string, r io.Reader, req *NotifyRequest) error {
+	if !isProtobuf(contentType) {
+		return json.NewDecoder(r).Decode(req)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var msg dnsv1.NotifyRequest
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	*req = NotifyRequest{
+		Records:   recordsFromProto(msg.GetRecords()),
+		Deletes:   deletesFromProto(msg.GetDeletes()),
+		Signature: msg.GetSignature(),
+		Timestamp: msg.GetTimestamp(),
+	}
+	return nil
+}
+
+// marshalProto encodes the response as an elchi.dns.v1.NotifyResponse.
+func (r *NotifyResponse) marshalProto() ([]byte, error) {
+	return proto.Marshal(&dnsv1.NotifyResponse{
+		Status:  r.Status,
+		Updated: int32(r.Updated), //nolint:gosec // Bounded by the records of one request
+		Deleted: int32(r.Deleted), //nolint:gosec // Bounded by the records of one request
+	})
+}
+
+// recordsFromProto converts decoded records to the plugin's record type.
+func recordsFromProto(msgs []*dnsv1.Record) []DNSRecord {
+	if len(msgs) == 0 {
+		return nil
+	}
+	records := make([]DNSRecord, len(msgs))
+	for i, msg := range msgs {
+		records[i] = recordFromProto(msg)
+	}
+	return records
+}
+
+func recordFromProto(msg *dnsv1.Record) DNSRecord {
+	record := DNSRecord{
+		Name:       msg.GetName(),
+		Type:       msg.GetType(),
+		TTL:        msg.GetTtl(),
+		IPs:        msg.GetIps(),
+		Failover:   FailoverTargets(msg.GetFailover()),
+		IPRegions:  msg.GetIpRegions(),
+		MaxAnswers: int(msg.GetMaxAnswers()),
+	}
+	for _, ep := range msg.GetEndpoints() {
+		record.Endpoints = append(record.Endpoints, Endpoint{
+			IP:     ep.GetIp(),
+			Weight: ep.GetWeight(),
+			Region: ep.GetRegion(),
+		})
+	}
+	if hc := msg.GetHealthCheck(); hc != nil {
+		record.HealthCheck = &HealthCheck{
+			Type:           hc.GetType(),
+			Port:           int(hc.GetPort()),
+			Path:           hc.GetPath(),
+			ExpectedStatus: int(hc.GetExpectedStatus()),
+			Interval:       hc.GetInterval(),
+			Timeout:        hc.GetTimeout(),
+			Rise:           int(hc.GetRise()),
+			Fall:           int(hc.GetFall()),
+		}
+	}
+	return record
+}
+
+// deletesFromProto converts decoded deletes to the plugin's type.
+func deletesFromProto(msgs []*dnsv1.DeleteRecord) []DeleteRecord {
+	if len(msgs) == 0 {
+		return nil
+	}
+	deletes := make([]DeleteRecord, len(msgs))
+	for i, msg := range msgs {
+		deletes[i] = DeleteRecord{Name: msg.GetName(), Type: msg.GetType()}
+	}
+	return deletes
+}
@@ -0,0 +1,348 @@
+package elchi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dnsv1 "github.com/cloudnativeworks/elchi-gslb/proto/elchi/dns/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// protoTestRecords uses every field of the record schema.
+var protoTestRecords = []DNSRecord{
+	{
+		Name:      "app.gslb.elchi",
+		Type:      "A",
+		TTL:       60,
+		IPs:       []string{"192.168.1.10", "192.168.1.11"},
+		IPRegions: map[string]string{"192.168.1.10": "eu", "192.168.1.11": "us"},
+		HealthCheck: &HealthCheck{
+			Type: "http", Port: 8080, Path: "/healthz", ExpectedStatus: 204,
+			Interval: "5s", Timeout: "1s", Rise: 2, Fall: 3,
+		},
+	},
+	{
+		Name:       "weighted.gslb.elchi",
+		Type:       "AAAA",
+		Endpoints:  []Endpoint{{IP: "2001:db8::10", Weight: 80, Region: "eu"}, {IP: "2001:db8::20"}},
+		MaxAnswers: 1,
+	},
+	{Name: "asia.gslb.elchi", Type: "A", Failover: FailoverTargets{"europe.gslb.elchi", "us.gslb.elchi"}},
+}
+
+// recordsToProto converts records to their protobuf messages, the way a
+// controller encodes them. The plugin itself only decodes records.
+func recordsToProto(records []DNSRecord) []*dnsv1.Record {
+	var msgs []*dnsv1.Record
+	for _, r := range records {
+		msg := &dnsv1.Record{
+			Name:       r.Name,
+			Type:       r.Type,
+			Ttl:        r.TTL,
+			Ips:        r.IPs,
+			Failover:   r.Failover,
+			IpRegions:  r.IPRegions,
+			MaxAnswers: int32(r.MaxAnswers),
+		}
+		for _, ep := range r.Endpoints {
+			msg.Endpoints = append(msg.Endpoints, &dnsv1.Endpoint{Ip: ep.IP, Weight: ep.Weight, Region: ep.Region})
+		}
+		if hc := r.HealthCheck; hc != nil {
+			msg.HealthCheck = &dnsv1.HealthCheck{
+				Type: hc.Type, Port: int32(hc.Port), Path: hc.Path, ExpectedStatus: int32(hc.ExpectedStatus),
+				Interval: hc.Interval, Timeout: hc.Timeout, Rise: int32(hc.Rise), Fall: int32(hc.Fall),
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// deletesToProto converts deletes to their protobuf messages.
+func deletesToProto(deletes []DeleteRecord) []*dnsv1.DeleteRecord {
+	var msgs []*dnsv1.DeleteRecord
+	for _, d := range deletes {
+		msgs = append(msgs, &dnsv1.DeleteRecord{Name: d.Name, Type: d.Type})
+	}
+	return msgs
+}
+
+// snapshotProto encodes a snapshot as an elchi.dns.v1.Snapshot.
+func snapshotProto(t *testing.T, s *DNSSnapshot) []byte {
+	t.Helper()
+	return mustMarshalProto(t, &dnsv1.Snapshot{
+		Zone:        s.Zone,
+		VersionHash: s.VersionHash,
+		Records:     recordsToProto(s.Records),
+		Signature:   s.Signature,
+	})
+}
+
+// changesProto encodes a changes response as an elchi.dns.v1.Changes.
+func changesProto(t *testing.T, c *DNSChangesResponse) []byte {
+	t.Helper()
+	return mustMarshalProto(t, &dnsv1.Changes{
+		Unchanged:   c.Unchanged,
+		Zone:        c.Zone,
+		VersionHash: c.VersionHash,
+		BaseHash:    c.BaseHash,
+		Records:     recordsToProto(c.Records),
+		Deletes:     deletesToProto(c.Deletes),
+		Signature:   c.Signature,
+	})
+}
+
+// notifyProto encodes a /notify request as an elchi.dns.v1.NotifyRequest.
+func notifyProto(t *testing.T, r *NotifyRequest) []byte {
+	t.Helper()
+	return mustMarshalProto(t, &dnsv1.NotifyRequest{
+		Records:   recordsToProto(r.Records),
+		Deletes:   deletesToProto(r.Deletes),
+		Signature: r.Signature,
+		Timestamp: r.Timestamp,
+	})
+}
+
+func mustMarshalProto(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatalf("proto.Marshal failed: %v", err)
+	}
+	return data
+}
+
+func TestProtobuf_RoundTrip(t *testing.T) {
+	changes := DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		VersionHash: "v2",
+		BaseHash:    "v1",
+		Records:     protoTestRecords,
+		Deletes:     []DeleteRecord{{Name: "old.gslb.elchi", Type: "A"}},
+		Signature:   "c2lnbmF0dXJl",
+	}
+	var decoded DNSChangesResponse
+	if err := decodeChanges(protobufMediaType, bytes.NewReader(changesProto(t, &changes)), &decoded); err != nil {
+		t.Fatalf("decodeChanges failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, changes) {
+		t.Errorf("Changes differ after a round trip:\n got %+v\nwant %+v", decoded, changes)
+	}
+
+	notify := NotifyRequest{Records: protoTestRecords[:1], Deletes: changes.Deletes, Signature: "c2lnbmF0dXJl", Timestamp: 1767225600}
+	var decodedNotify NotifyRequest
+	if err := decodeNotify(protobufMediaType, bytes.NewReader(notifyProto(t, &notify)), &decodedNotify); err != nil {
+		t.Fatalf("decodeNotify failed: %v", err)
+	}
+	if !reflect.DeepEqual(decodedNotify, notify) {
+		t.Errorf("Notify request differs after a round trip:\n got %+v\nwant %+v", decodedNotify, notify)
+	}
+}
+
+func TestDecodeSnapshotProto(t *testing.T) {
+	snapshot := DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: protoTestRecords, Signature: "c2lnbmF0dXJl"}
+	encoded := snapshotProto(t, &snapshot)
+
+	// Fields added to the schema later are skipped
+	extended := protowire.AppendTag(bytes.Clone(encoded), 15, protowire.VarintType)
+	extended = protowire.AppendVarint(extended, 42)
+	extended = protowire.AppendTag(extended, 16, protowire.Fixed64Type)
+	extended = protowire.AppendFixed64(extended, 42)
+	extended = protowire.AppendTag(extended, 17, protowire.BytesType)
+	extended = protowire.AppendString(extended, "later")
+
+	wrongType := protowire.AppendTag(nil, 3, protowire.VarintType)
+	wrongType = protowire.AppendVarint(wrongType, 1)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"snapshot", encoded, false},
+		{"unknown fields", extended, false},
+		{"truncated", encoded[:len(encoded)-3], true},
+		{"wrong wire type", wrongType, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var decoded DNSSnapshot
+			var records []DNSRecord
+			err := decodeSnapshotProto(bytes.NewReader(tt.data), &decoded, func(record DNSRecord) error {
+				records = append(records, record)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeSnapshotProto() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			decoded.Records = records
+			if !reflect.DeepEqual(decoded, snapshot) {
+				t.Errorf("Snapshot differs after a round trip:\n got %+v\nwant %+v", decoded, snapshot)
+			}
+		})
+	}
+}
+
+func TestRecordsHash_SameForBothEncodings(t *testing.T) {
+	// An empty ips array has no protobuf encoding of its own
+	data := []byte(`[{"name":"asia.gslb.elchi","type":"A","ips":[],"failover":"europe.gslb.elchi"}]`)
+	var fromJSON []DNSRecord
+	if err := json.Unmarshal(data, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsv1.Record
+	if err := proto.Unmarshal(mustMarshalProto(t, recordsToProto(fromJSON)[0]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	fromProto := recordFromProto(&msg)
+	if got, want := mustRecordsHash(t, []DNSRecord{fromProto}), mustRecordsHash(t, fromJSON); got != want {
+		t.Errorf("Expected the same hash for both encodings, got %s and %s", got, want)
+	}
+}
+
+// newNegotiatingServer serves the snapshot and changes as protobuf when the
+// request accepts it, else as JSON.
+func newNegotiatingServer(t *testing.T, snapshot DNSSnapshot, protobuf bool) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changes := DNSChangesResponse{Zone: snapshot.Zone, VersionHash: snapshot.VersionHash, Records: snapshot.Records, Signature: snapshot.Signature}
+		if protobuf && acceptsProtobuf(r.Header.Get("Accept")) {
+			w.Header().Set("Content-Type", protobufMediaType)
+			if strings.HasSuffix(r.URL.Path, "/snapshot") {
+				_, _ = w.Write(snapshotProto(t, &snapshot))
+			} else {
+				_, _ = w.Write(changesProto(t, &changes))
+			}
+			return
+		}
+		w.Header().Set("Content-Type", jsonMediaType)
+		if strings.HasSuffix(r.URL.Path, "/snapshot") {
+			_ = json.NewEncoder(w).Encode(snapshot)
+		} else {
+			_ = json.NewEncoder(w).Encode(changes)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_Protobuf(t *testing.T) {
+	public, private := newSigningKey(t)
+	hash := mustRecordsHash(t, protoTestRecords)
+	snapshot := DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: hash,
+		Records:     protoTestRecords,
+		Signature:   sign(t, private, signContextRecords, "gslb.elchi", hash, "", protoTestRecords, nil),
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		server   bool // Controller supports protobuf
+	}{
+		{"json", encodingJSON, true},
+		{"protobuf", encodingProtobuf, true},
+		{"protobuf with a JSON controller", encodingProtobuf, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newNegotiatingServer(t, snapshot, tt.server)
+			client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+			client.encoding = tt.encoding
+			client.strictHash = true
+			client.trusted = trustedKeys{public}
+
+			got, err := client.FetchSnapshot(context.Background())
+			if err != nil {
+				t.Fatalf("FetchSnapshot failed: %v", err)
+			}
+			if !reflect.DeepEqual(got.Records, snapshot.Records) {
+				t.Errorf("Unexpected records: %+v", got.Records)
+			}
+
+			changes, err := client.CheckChanges(context.Background(), "v0")
+			if err != nil {
+				t.Fatalf("CheckChanges failed: %v", err)
+			}
+			if !reflect.DeepEqual(changes.Records, snapshot.Records) {
+				t.Errorf("Unexpected changes: %+v", changes.Records)
+			}
+		})
+	}
+}
+
+func TestHandleNotify_Protobuf(t *testing.T) {
+	e := &Elchi{
+		Zone:   "gslb.elchi.",
+		Secret: "test-secret",
+		TTL:    300,
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.syncStatus = &SyncStatus{lastSyncStatus: "initial"}
+	ws := NewWebhookServer(e, ":8053")
+
+	notify := NotifyRequest{Records: []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}}
+	req := httptest.NewRequest(http.MethodPost, "/notify", bytes.NewReader(notifyProto(t, &notify)))
+	req.Header.Set("Content-Type", protobufMediaType)
+	req.Header.Set("Accept", protobufMediaType)
+	rr := httptest.NewRecorder()
+	ws.handleNotify(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !e.cache.HasName("test.gslb.elchi.") {
+		t.Error("Expected the protobuf records to be applied")
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != protobufMediaType {
+		t.Errorf("Expected a protobuf response, got %s", ct)
+	}
+	var resp dnsv1.NotifyResponse
+	if err := proto.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.GetStatus() != "ok" || resp.GetUpdated() != 1 || resp.GetDeleted() != 0 {
+		t.Errorf("Unexpected response %v", &resp)
+	}
+
+	// A body that is not protobuf is rejected
+	req = httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(`{"records":[]}`))
+	req.Header.Set("Content-Type", protobufMediaType)
+	rr = httptest.NewRecorder()
+	ws.handleNotify(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid body, got %d", rr.Code)
+	}
+}
+
+func TestAcceptsProtobuf(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{protobufMediaType, true},
+		{"application/json, " + protobufMediaType + ";q=0.9", true},
+		{"application/x-protobuf", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsProtobuf(tt.accept); got != tt.want {
+			t.Errorf("acceptsProtobuf(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package elchi
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretCheckInterval is how often a secret file is checked for changes at
+// most, so requests do not each stat the file.
+const secretCheckInterval = 5 * time.Second
+
+// secretSource provides the shared secrets of one direction, given in the
+// Corefile or read from a file with one secret per line. When the source is
+// used, a file is checked for changes at most every secretCheckInterval and
+// read again when its modification time changed, so secrets can be rotated
+// without reloading CoreDNS. Requests are signed with the first secret and
+// accepted with any of them.
+type secretSource struct {
+	file  string        // File with the secrets ("" = secrets from the Corefile)
+	grace time.Duration // How long secrets removed from the file stay accepted
+
+	mu      sync.Mutex
+	secrets []string
+	retired map[string]time.Time // secret removed from the file -> accepted until
+	modTime time.Time            // modification time of the loaded file
+	checked time.Time            // last check of the file for changes
+}
+
+// newSecretSource returns a source with fixed secrets.
+func newSecretSource(secrets ...string) *secretSource {
+	return &secretSource{secrets: secrets}
+}
+
+// loadSecretFile returns a source that reads its secrets from file. Unlike
+// later reloads, a file that cannot be loaded is an error.
+func loadSecretFile(file string, grace time.Duration) (*secretSource, error) {
+	s := &secretSource{
+		file:    file,
+		grace:   grace,
+		retired: make(map[string]time.Time),
+	}
+	if _, err := s.reload(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readSecretFile reads the secrets of file, one per line. Empty lines and
+// lines starting with # are skipped.
+func readSecretFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file) //nolint:gosec // Path comes from the Corefile
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []string
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) < minSecretLength {
+			return nil, fmt.Errorf("secrets in %s must be at least %d characters long", file, minSecretLength)
+		}
+		secrets = append(secrets, line)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no secret in %s", file)
+	}
+	return secrets, nil
+}
+
+// reload reads the file again if it changed since it was last loaded, and
+// reports whether it did. The file is not checked again within
+// secretCheckInterval of the last check. Secrets removed from the file stay
+// accepted for the grace period. On error the loaded secrets stay in use.
+func (s *secretSource) reload(now time.Time) (bool, error) {
+	if s.file == "" {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Failed checks are throttled too, so a broken file is not logged per request
+	if !s.checked.IsZero() && now.Sub(s.checked) < secretCheckInterval {
+		return false, nil
+	}
+	s.checked = now
+
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return false, nil
+	}
+	secrets, err := readSecretFile(s.file)
+	if err != nil {
+		return false, err
+	}
+
+	if s.grace > 0 {
+		for _, secret := range s.secrets {
+			if !slices.Contains(secrets, secret) {
+				s.retired[secret] = now.Add(s.grace)
+			}
+		}
+	}
+	for _, secret := range secrets {
+		delete(s.retired, secret)
+	}
+	s.secrets = secrets
+	s.modTime = info.ModTime()
+	return true, nil
+}
+
+// refresh reloads the file if it is due for a check and changed, keeping the
+// loaded secrets when it cannot be read.
+func (s *secretSource) refresh(now time.Time) {
+	if reloaded, err := s.reload(now); err != nil {
+		log.Warningf("Failed to reload secret file, keeping the loaded secrets: %v", err)
+	} else if reloaded {
+		log.Infof("Secret file %s reloaded", s.file)
+	}
+}
+
+// signing returns the secret requests are signed with.
+func (s *secretSource) signing(now time.Time) string {
+	s.refresh(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.secrets) == 0 {
+		return ""
+	}
+	return s.secrets[0]
+}
+
+// accepted returns the secrets requests are accepted with, including secrets
+// removed from the file within the grace period.
+func (s *secretSource) accepted(now time.Time) []string {
+	s.refresh(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accepted := slices.Clone(s.secrets)
+	for secret, until := range s.retired {
+		if now.Before(until) {
+			accepted = append(accepted, secret)
+		} else {
+			delete(s.retired, secret)
+		}
+	}
+	return accepted
+}
+
+// loadSecrets builds the secret sources of the controller client and the
+// webhook server. Each direction uses its own secret if one is configured,
+// else the shared one. Secret files are read now, so a missing or invalid
+// file is an error.
+func (e *Elchi) loadSecrets() error {
+	var err error
+	shared := newSecretSource(e.Secret)
+	if e.SecretFile != "" {
+		if shared, err = loadSecretFile(e.SecretFile, e.SecretGrace); err != nil {
+			return err
+		}
+	}
+
+	e.controllerSecrets = shared
+	switch {
+	case e.ControllerSecretFile != "":
+		if e.controllerSecrets, err = loadSecretFile(e.ControllerSecretFile, 0); err != nil {
+			return err
+		}
+	case e.ControllerSecret != "":
+		e.controllerSecrets = newSecretSource(e.ControllerSecret)
+	}
+
+	e.webhookSecrets = shared
+	switch {
+	case e.WebhookSecretFile != "":
+		if e.webhookSecrets, err = loadSecretFile(e.WebhookSecretFile, e.SecretGrace); err != nil {
+			return err
+		}
+	case len(e.WebhookSecrets) > 0:
+		e.webhookSecrets = newSecretSource(e.WebhookSecrets...)
+	}
+	return nil
+}
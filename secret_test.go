@@ -0,0 +1,178 @@
+package elchi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeSecretFile writes content to file with the given modification time,
+// so a rewrite within the same clock tick is still seen as a change.
+func writeSecretFile(t *testing.T, file, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{"one secret", "new-secret-1\n", []string{"new-secret-1"}, false},
+		{"rotation", "# rotated on 2025-12-31\nnew-secret-1\n\n  old-secret-1  \n", []string{"new-secret-1", "old-secret-1"}, false},
+		{"no trailing newline", "new-secret-1", []string{"new-secret-1"}, false},
+		{"empty", "\n# nothing yet\n", nil, true},
+		{"too short", "short\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "secret")
+			writeSecretFile(t, file, tt.content, time.Now())
+
+			got, err := readSecretFile(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSecretFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readSecretFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestSecretSource_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	start := time.Now().Add(-time.Hour)
+	writeSecretFile(t, file, "old-secret-1\n", start)
+
+	source, err := loadSecretFile(file, time.Minute)
+	if err != nil {
+		t.Fatalf("loadSecretFile failed: %v", err)
+	}
+	now := time.Now()
+	if got := source.signing(now); got != "old-secret-1" {
+		t.Errorf("Expected old-secret-1, got %s", got)
+	}
+
+	// The file is not checked again within secretCheckInterval
+	writeSecretFile(t, file, "new-secret-1\n", start.Add(time.Second))
+	if got := source.signing(now); got != "old-secret-1" {
+		t.Errorf("Expected old-secret-1 until the next check, got %s", got)
+	}
+
+	// The removed secret stays accepted for the grace period
+	now = now.Add(secretCheckInterval)
+	if got := source.signing(now); got != "new-secret-1" {
+		t.Errorf("Expected new-secret-1 after the rotation, got %s", got)
+	}
+	if got := source.accepted(now.Add(30 * time.Second)); !slices.Equal(got, []string{"new-secret-1", "old-secret-1"}) {
+		t.Errorf("Expected both secrets within the grace period, got %v", got)
+	}
+	if got := source.accepted(now.Add(2 * time.Minute)); !slices.Equal(got, []string{"new-secret-1"}) {
+		t.Errorf("Expected only the new secret after the grace period, got %v", got)
+	}
+
+	// A broken file keeps the loaded secrets
+	writeSecretFile(t, file, "short\n", start.Add(2*time.Second))
+	if got := source.signing(now.Add(3 * time.Minute)); got != "new-secret-1" {
+		t.Errorf("Expected the loaded secret to stay in use, got %s", got)
+	}
+
+	// Without a grace period, removed secrets are rejected right away
+	writeSecretFile(t, file, "old-secret-1\n", start)
+	if source, err = loadSecretFile(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	writeSecretFile(t, file, "new-secret-1\n", start.Add(time.Second))
+	if got := source.accepted(time.Now().Add(secretCheckInterval)); !slices.Equal(got, []string{"new-secret-1"}) {
+		t.Errorf("Expected only the new secret without a grace period, got %v", got)
+	}
+}
+
+func TestRequestVerifier_RotatedSecrets(t *testing.T) {
+	now := time.Now()
+	for _, mode := range []string{authHMAC, authLegacy} {
+		t.Run(mode, func(t *testing.T) {
+			v := newRequestVerifier(mode, newSecretSource("new-secret-1", "old-secret-1"), 0)
+			for _, secret := range []string{"new-secret-1", "old-secret-1", "other-secret"} {
+				req := newSignedRequest(t, http.MethodGet, "/records", "", secret, now)
+				req.Header.Set(headerSecret, secret)
+				err := v.verify(req, now)
+				if want := secret != "other-secret"; (err == nil) != want {
+					t.Errorf("Secret %s: got error %v, want accepted %v", secret, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSecrets_Separate(t *testing.T) {
+	var signedWith error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signedWith = newRequestVerifier(authHMAC, newSecretSource("controller-secret"), 0).verify(r, time.Now())
+		_ = json.NewEncoder(w).Encode(DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1"})
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "webhook-secret")
+	writeSecretFile(t, file, "webhook-secret-1\n", time.Now())
+
+	e := &Elchi{
+		Zone:              "gslb.elchi.",
+		ControllerSecret:  "controller-secret",
+		WebhookSecretFile: file,
+		TTL:               300,
+	}
+	e.cache = NewRecordCache(e.Zone)
+	e.syncStatus = &SyncStatus{lastSyncStatus: "initial"}
+	if err := e.loadSecrets(); err != nil {
+		t.Fatalf("loadSecrets failed: %v", err)
+	}
+
+	client := NewElchiClient([]string{server.URL}, e.Zone, e.Secret, "", nil, 5*time.Second, nil)
+	client.secrets = e.controllerSecrets
+	if _, err := client.FetchSnapshot(context.Background()); err != nil {
+		t.Fatalf("FetchSnapshot failed: %v", err)
+	}
+	if signedWith != nil {
+		t.Errorf("Expected requests to the controller signed with the controller secret, got %v", signedWith)
+	}
+
+	ws := NewWebhookServer(e, ":8053")
+	for secret, want := range map[string]int{
+		"webhook-secret-1":  http.StatusOK,
+		"controller-secret": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/records", nil)
+		req.Header.Set(headerSecret, secret)
+		rr := httptest.NewRecorder()
+		ws.authMiddleware(ws.handleRecords)(rr, req)
+		if rr.Code != want {
+			t.Errorf("Secret %s: expected status %d, got %d", secret, want, rr.Code)
+		}
+	}
+
+	// A missing file fails at startup
+	e.WebhookSecretFile = file + "-missing"
+	if err := e.loadSecrets(); err == nil {
+		t.Error("Expected an error for a missing secret file")
+	}
+}
@@ -3,6 +3,7 @@ package elchi
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
@@ -34,6 +35,11 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("elchi", err)
 	}
 
+	// Initialize the client
+	if err := e.InitClient(); err != nil {
+		return plugin.Error("elchi", fmt.Errorf("failed to initialize elchi client: %w", err))
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		e.Next = next
 		return e
@@ -47,16 +53,248 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// parseHealthCheck parses the arguments of the health_check directive:
+// [tcp|http|https PORT] [path PATH] [status CODE] [interval DURATION] [timeout DURATION] [rise N] [fall N].
+func parseHealthCheck(args []string) (*HealthCheck, error) {
+	check := &HealthCheck{}
+
+	// Optional leading type and port
+	if len(args) > 0 {
+		switch args[0] {
+		case healthCheckTCP, healthCheckHTTP, healthCheckHTTPS:
+			if len(args) < 2 {
+				return nil, fmt.Errorf("missing port for %s check", args[0])
+			}
+			port, err := strconv.Atoi(args[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid port: %s", args[1])
+			}
+			check.Type = args[0]
+			check.Port = port
+			args = args[2:]
+		}
+	}
+
+	for len(args) > 0 {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("missing value for '%s'", args[0])
+		}
+		key, val := args[0], args[1]
+		args = args[2:]
+
+		switch key {
+		case "path":
+			check.Path = val
+		case "status":
+			status, err := strconv.Atoi(val)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid status: %s", val)
+			}
+			check.ExpectedStatus = status
+		case "interval":
+			check.Interval = val
+		case "timeout":
+			check.Timeout = val
+		case "rise", "fall":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s must be a positive number: %s", key, val)
+			}
+			if key == "rise" {
+				check.Rise = n
+			} else {
+				check.Fall = n
+			}
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+
+	// Validate ports and durations the same way they are resolved at runtime.
+	// A check without type and port is fine, records then bring their own.
+	probe := check
+	if probe.Type == "" {
+		probe = &HealthCheck{Type: healthCheckTCP, Port: 1}
+	}
+	if _, err := resolveHealthCheck(probe, check); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// parseSOA parses the arguments of the soa directive:
+// [mname NAME] [rname MAILBOX] [refresh DURATION] [retry DURATION] [expire DURATION] [minimum DURATION].
+func parseSOA(args []string) (SOAConfig, error) {
+	var soa SOAConfig
+	if len(args) == 0 {
+		return soa, fmt.Errorf("no options given")
+	}
+
+	for len(args) > 0 {
+		if len(args) < 2 {
+			return soa, fmt.Errorf("missing value for '%s'", args[0])
+		}
+		key, val := args[0], args[1]
+		args = args[2:]
+
+		switch key {
+		case "mname":
+			soa.MName = normalizeDomain(val)
+		case "rname":
+			soa.RName = normalizeMailbox(val)
+		case "refresh", "retry", "expire", "minimum":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < time.Second || d > maxSOATimer {
+				return soa, fmt.Errorf("%s must be a duration between 1s and %v: %s", key, maxSOATimer, val)
+			}
+			switch key {
+			case "refresh":
+				soa.Refresh = d
+			case "retry":
+				soa.Retry = d
+			case "expire":
+				soa.Expire = d
+			default:
+				soa.MinTTL = d
+			}
+		default:
+			return soa, fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+	return soa, nil
+}
+
+// parseGuard parses the arguments of the guard directive:
+// [max_removed PERCENT] [max_ip_changes PERCENT] [min_records N].
+func parseGuard(args []string) (*GuardLimits, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no limits given")
+	}
+
+	guard := &GuardLimits{}
+	for len(args) > 0 {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("missing value for '%s'", args[0])
+		}
+		key, val := args[0], args[1]
+		args = args[2:]
+
+		switch key {
+		case guardMaxRemoved, guardMaxIPChanges:
+			share, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+			if err != nil || share <= 0 || share > 100 {
+				return nil, fmt.Errorf("%s must be a percentage between 0 and 100: %s", key, val)
+			}
+			if key == guardMaxRemoved {
+				guard.MaxRemoved = share
+			} else {
+				guard.MaxIPChanges = share
+			}
+		case guardMinRecords:
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s must be a positive number: %s", key, val)
+			}
+			guard.MinRecords = n
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+	return guard, nil
+}
+
+// parseDampening parses the arguments of the dampening directive:
+// [penalty N] [suppress N] [reuse N] [half_life DURATION] [max_suppress DURATION].
+func parseDampening(args []string) (*DampeningConfig, error) {
+	config := defaultDampening()
+	for len(args) > 0 {
+		if len(args) < 2 {
+			return nil, fmt.Errorf("missing value for '%s'", args[0])
+		}
+		key, val := args[0], args[1]
+		args = args[2:]
+
+		switch key {
+		case "penalty", "suppress", "reuse":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s must be a positive number: %s", key, val)
+			}
+			switch key {
+			case "penalty":
+				config.Penalty = n
+			case "suppress":
+				config.Suppress = n
+			default:
+				config.Reuse = n
+			}
+		case "half_life", "max_suppress":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s must be a positive duration: %s", key, val)
+			}
+			if key == "half_life" {
+				config.HalfLife = d
+			} else {
+				config.MaxSuppress = d
+			}
+		default:
+			return nil, fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validateSecrets checks that the secrets of both directions are set once.
+// Secret files are read by InitClient.
+func validateSecrets(e *Elchi) error {
+	switch {
+	case e.Secret != "" && e.SecretFile != "":
+		return fmt.Errorf("secret and secret_file cannot be combined")
+	case e.ControllerSecret != "" && e.ControllerSecretFile != "":
+		return fmt.Errorf("controller_secret and controller_secret_file cannot be combined")
+	case len(e.WebhookSecrets) > 0 && e.WebhookSecretFile != "":
+		return fmt.Errorf("webhook_secret and webhook_secret_file cannot be combined")
+	case e.WebhookEnable && e.Secret == "" && e.SecretFile == "" && len(e.WebhookSecrets) == 0 && e.WebhookSecretFile == "":
+		return fmt.Errorf("webhook requires secret, secret_file, webhook_secret or webhook_secret_file")
+	}
+
+	// Validate secret length (minimum 8 characters for basic security)
+	inline := []struct {
+		directive string
+		secrets   []string
+	}{
+		{"secret", []string{e.Secret}},
+		{"controller_secret", []string{e.ControllerSecret}},
+		{"webhook_secret", e.WebhookSecrets},
+	}
+	for _, d := range inline {
+		for _, secret := range d.secrets {
+			if secret != "" && len(secret) < minSecretLength {
+				return fmt.Errorf("%s must be at least %d characters long", d.directive, minSecretLength)
+			}
+		}
+	}
+	return nil
+}
+
 // parseElchi parses the Corefile configuration for the elchi plugin.
 //
 //nolint:gocyclo // Config parsing is inherently complex.
 func parseElchi(c *caddy.Controller) (*Elchi, error) {
 	e := &Elchi{
-		TTL:           defaultTTL,
-		SyncInterval:  defaultSyncInterval,
-		Timeout:       defaultTimeout,
-		WebhookEnable: false,
-		WebhookAddr:   defaultWebhookAddr,
+		TTL:             defaultTTL,
+		SyncInterval:    defaultSyncInterval,
+		Timeout:         defaultTimeout,
+		WebhookEnable:   false,
+		WebhookAddr:     defaultWebhookAddr,
+		AnswerOrder:     answerOrderFixed,
+		FailbackDelay:   defaultFailbackDelay,
+		ColdStartPolicy: coldStartServfail,
 	}
 
 	// Extract zone from server block keys
@@ -72,10 +310,11 @@ func parseElchi(c *caddy.Controller) (*Elchi, error) {
 		for c.NextBlock() {
 			switch c.Val() {
 			case "endpoint":
-				if !c.NextArg() {
+				urls := c.RemainingArgs()
+				if len(urls) == 0 {
 					return nil, c.ArgErr()
 				}
-				e.Endpoint = c.Val()
+				e.Endpoints = append(e.Endpoints, urls...)
 
 			case "secret":
 				if !c.NextArg() {
@@ -83,6 +322,52 @@ func parseElchi(c *caddy.Controller) (*Elchi, error) {
 				}
 				e.Secret = c.Val()
 
+			case "secret_file", "controller_secret_file", "webhook_secret_file":
+				// secret_file directives: read the secret from a file that is watched for changes
+				// Example: "secret_file /etc/elchi/secret"
+				directive := c.Val()
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch directive {
+				case "secret_file":
+					e.SecretFile = c.Val()
+				case "controller_secret_file":
+					e.ControllerSecretFile = c.Val()
+				default:
+					e.WebhookSecretFile = c.Val()
+				}
+
+			case "controller_secret":
+				// controller_secret directive: secret of requests to the controller, instead of secret
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				e.ControllerSecret = c.Val()
+
+			case "webhook_secret":
+				// webhook_secret directive: secrets accepted by the webhook, instead of secret
+				// Several secrets are accepted during a rotation: "webhook_secret NEW OLD"
+				secrets := c.RemainingArgs()
+				if len(secrets) == 0 {
+					return nil, c.ArgErr()
+				}
+				e.WebhookSecrets = append(e.WebhookSecrets, secrets...)
+
+			case "secret_grace":
+				// secret_grace directive: how long secrets removed from a secret file stay accepted
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				grace, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid secret_grace: %v", err)
+				}
+				if grace < 0 {
+					return nil, c.Errf("secret_grace must not be negative")
+				}
+				e.SecretGrace = grace
+
 			case "ttl":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -143,6 +428,28 @@ func parseElchi(c *caddy.Controller) (*Elchi, error) {
 				// WARNING: This is insecure and should only be used for testing with self-signed certs
 				e.TLSSkipVerify = true
 
+			case "tls_ca", "tls_cert", "tls_key", "tls_server_name":
+				// tls_* directives: private CA bundle, client certificate and key for
+				// mutual TLS, and the name verified in the controller certificate
+				// Example: "tls_ca /etc/elchi/ca.pem"
+				directive := c.Val()
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch directive {
+				case "tls_ca":
+					e.TLSCA = c.Val()
+				case "tls_cert":
+					e.TLSCert = c.Val()
+				case "tls_key":
+					e.TLSKey = c.Val()
+				case "tls_server_name":
+					e.TLSServerName = c.Val()
+				}
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+
 			case "node_ip":
 				// node_ip directive: identifies this node to the controller
 				// Typically set via env var: node_ip {$NODE_IP}
@@ -161,6 +468,235 @@ func parseElchi(c *caddy.Controller) (*Elchi, error) {
 				}
 				e.Regions = args
 
+			case "answer_order":
+				// answer_order directive: how A/AAAA answers are ordered per query
+				// Values: fixed (default), random, round_robin
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case answerOrderFixed, answerOrderRandom, answerOrderRoundRobin:
+					e.AnswerOrder = c.Val()
+				default:
+					return nil, c.Errf("invalid answer_order '%s' (must be fixed, random or round_robin)", c.Val())
+				}
+
+			case "max_answers":
+				// max_answers directive: cap the number of A/AAAA RRs per answer
+				// Records may override it with max_answers in the snapshot
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid max_answers value: %v", err)
+				}
+				if n < 1 {
+					return nil, c.Errf("max_answers must be at least 1")
+				}
+				e.MaxAnswers = n
+
+			case "health_check":
+				// health_check directive: probe record IPs locally and leave unhealthy ones out of answers
+				// Example: "health_check http 8080 path /healthz status 200 interval 5s timeout 1s rise 2 fall 3"
+				// Without type and port, only records with their own health_check are probed
+				check, err := parseHealthCheck(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid health_check: %v", err)
+				}
+				e.HealthCheck = check
+
+			case "failback_delay":
+				// failback_delay directive: how long a record failed over by local health checks
+				// must have healthy IPs again before answers switch back to them
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				delay, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid failback_delay: %v", err)
+				}
+				if delay < 0 {
+					return nil, c.Errf("failback_delay must not be negative")
+				}
+				e.FailbackDelay = delay
+
+			case "cold_start_policy":
+				// cold_start_policy directive: how to answer before the first snapshot is loaded
+				// Values: servfail (default), refused, fallthrough, nxdomain
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case coldStartServfail, coldStartRefused, coldStartFallthrough, coldStartNXDOMAIN:
+					e.ColdStartPolicy = c.Val()
+				default:
+					return nil, c.Errf("invalid cold_start_policy '%s' (must be servfail, refused, fallthrough or nxdomain)", c.Val())
+				}
+
+			case "startup_wait":
+				// startup_wait directive: block startup until the first snapshot is loaded,
+				// retrying until the deadline, then continue with the cold start policy
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				wait, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid startup_wait: %v", err)
+				}
+				if wait < 0 {
+					return nil, c.Errf("startup_wait must not be negative")
+				}
+				e.StartupWait = wait
+
+			case "persist":
+				// persist directive: save every applied snapshot to PATH and load it at startup
+				// Example: "persist /var/lib/elchi/snapshot.json"
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				e.PersistPath = c.Val()
+
+			case "auth":
+				// auth directive: request authentication mode and clock skew for signatures
+				// Example: "auth hmac max_skew 2m"
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				switch args[0] {
+				case authHMAC, authCompat, authLegacy:
+					e.AuthMode = args[0]
+				default:
+					return nil, c.Errf("invalid auth mode '%s': must be hmac, compat or legacy", args[0])
+				}
+				if len(args) > 1 {
+					if len(args) != 3 || args[1] != "max_skew" {
+						return nil, c.Errf("auth expects 'max_skew DURATION' after the mode")
+					}
+					skew, err := time.ParseDuration(args[2])
+					if err != nil || skew <= 0 {
+						return nil, c.Errf("invalid auth max_skew '%s'", args[2])
+					}
+					e.AuthSkew = skew
+				}
+
+			case "trusted_keys":
+				// trusted_keys directive: Ed25519 public keys the controller signs records with
+				// Keys are base64 raw keys or PEM files, may be repeated for key rotation
+				// Example: "trusted_keys /etc/elchi/controller.pub 11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, arg := range args {
+					key, err := parseTrustedKey(arg)
+					if err != nil {
+						return nil, c.Errf("invalid trusted key: %v", err)
+					}
+					e.TrustedKeys = append(e.TrustedKeys, key)
+				}
+
+			case "strict_hash":
+				// strict_hash directive: only accept canonical version hashes, which are verified
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				e.StrictHash = true
+
+			case "max_response_size":
+				// max_response_size directive: largest decoded controller response
+				// Example: "max_response_size 128M"
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				size, err := parseSize(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid max_response_size: %v", err)
+				}
+				e.MaxResponseSize = size
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+
+			case "encoding":
+				// encoding directive: preferred encoding of controller responses
+				// Example: "encoding protobuf"
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case encodingJSON, encodingProtobuf:
+					e.Encoding = c.Val()
+				default:
+					return nil, c.Errf("invalid encoding '%s' (must be json or protobuf)", c.Val())
+				}
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+
+			case "watch":
+				// watch directive: receive changes over a long-lived request to /dns/watch
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				e.Watch = true
+
+			case "guard":
+				// guard directive: quarantine snapshots that would change too much at once
+				// Example: "guard max_removed 20% max_ip_changes 50% min_records 10"
+				guard, err := parseGuard(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid guard: %v", err)
+				}
+				e.Guard = guard
+
+			case "dampening":
+				// dampening directive: hold back changes to names whose records flap
+				// Example: "dampening penalty 1000 suppress 2000 reuse 750 half_life 15m max_suppress 1h"
+				dampening, err := parseDampening(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid dampening: %v", err)
+				}
+				e.Dampening = dampening
+
+			case "soa":
+				// soa directive: override the zone's SOA record
+				// Example: "soa mname ns1.gslb.elchi rname hostmaster@example.com minimum 60s"
+				soa, err := parseSOA(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Errf("invalid soa: %v", err)
+				}
+				e.SOA = soa
+
+			case "ns":
+				// ns directive: name servers returned for the zone apex NS query
+				// Example: "ns ns1.gslb.elchi ns2.gslb.elchi"
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, name := range args {
+					e.NameServers = append(e.NameServers, normalizeDomain(name))
+				}
+
+			case "client_region":
+				// client_region directive: map client subnets to a region for ECS-aware answers
+				// Example: "client_region avrupa 10.20.0.0/16 2001:db8:20::/48"
+				// May be repeated, the most specific subnet wins
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				if e.clientRegions == nil {
+					e.clientRegions = &clientRegionTable{}
+				}
+				for _, cidr := range args[1:] {
+					if err := e.clientRegions.add(args[0], cidr); err != nil {
+						return nil, c.Errf("invalid client_region: %v", err)
+					}
+				}
+
 			default:
 				return nil, c.Errf("unknown directive '%s'", c.Val())
 			}
@@ -171,19 +707,29 @@ func parseElchi(c *caddy.Controller) (*Elchi, error) {
 	if e.Zone == "" {
 		return nil, fmt.Errorf("zone is required (specify zone in server block, e.g., gslb.elchi)")
 	}
-	if e.Endpoint == "" {
+	if len(e.Endpoints) == 0 {
 		return nil, fmt.Errorf("endpoint is required")
 	}
-	if e.Secret == "" {
+	if e.Secret == "" && e.SecretFile == "" && e.ControllerSecret == "" && e.ControllerSecretFile == "" {
 		return nil, fmt.Errorf("secret is required")
 	}
 	if e.NodeIP == "" {
 		return nil, fmt.Errorf("node_ip is required (e.g., node_ip {$NODE_IP})")
 	}
+	if e.SOA.MName == "" && len(e.NameServers) == 0 {
+		return nil, fmt.Errorf("ns or soa mname is required (the name servers the zone is delegated to)")
+	}
 
-	// Validate secret length (minimum 8 characters for basic security)
-	if len(e.Secret) < minSecretLength {
-		return nil, fmt.Errorf("secret must be at least %d characters long", minSecretLength)
+	if err := validateSecrets(e); err != nil {
+		return nil, err
+	}
+
+	// Validate TLS settings, the files themselves are loaded by InitClient
+	if (e.TLSCert == "") != (e.TLSKey == "") {
+		return nil, fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if e.TLSSkipVerify && e.TLSCA != "" {
+		return nil, fmt.Errorf("tls_skip_verify cannot be combined with tls_ca")
 	}
 
 	// Validate sync_interval vs timeout
@@ -191,10 +737,5 @@ func parseElchi(c *caddy.Controller) (*Elchi, error) {
 		return nil, fmt.Errorf("sync_interval must be greater than timeout")
 	}
 
-	// Initialize the client
-	if err := e.InitClient(); err != nil {
-		return nil, fmt.Errorf("failed to initialize elchi client: %w", err)
-	}
-
 	return e, nil
 }
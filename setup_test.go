@@ -1,8 +1,13 @@
 package elchi
 
 import (
+	"reflect"
+	"slices"
 	"testing"
 	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 )
 
 // Test validation logic for setup.go
@@ -232,3 +237,712 @@ type validationError struct {
 func (e *validationError) Error() string {
 	return e.msg
 }
+
+// newTestController returns a caddy controller for the given elchi block in zone gslb.elchi.
+func newTestController(input string) *caddy.Controller {
+	c := caddy.NewTestController("dns", input)
+	c.ServerBlockKeys = []string{"gslb.elchi."}
+	return c
+}
+
+func TestParseElchi_Minimal(t *testing.T) {
+	c := newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.example.com
+	}`)
+
+	e, err := parseElchi(c)
+	if err != nil {
+		t.Fatalf("parseElchi failed: %v", err)
+	}
+	if e.Zone != "gslb.elchi." {
+		t.Errorf("Zone = %s, want gslb.elchi.", e.Zone)
+	}
+	if e.TTL != defaultTTL {
+		t.Errorf("TTL = %d, want %d", e.TTL, defaultTTL)
+	}
+	if e.clientRegions != nil {
+		t.Error("Expected no client regions by default")
+	}
+}
+
+func TestParseElchi_Endpoints(t *testing.T) {
+	c := newTestController(`elchi {
+		endpoint http://elchi-1:8080 http://elchi-2:8080
+		endpoint http://elchi-3:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.example.com
+	}`)
+
+	e, err := parseElchi(c)
+	if err != nil {
+		t.Fatalf("parseElchi failed: %v", err)
+	}
+	want := []string{"http://elchi-1:8080", "http://elchi-2:8080", "http://elchi-3:8080"}
+	if !slices.Equal(e.Endpoints, want) {
+		t.Errorf("Endpoints = %v, want %v", e.Endpoints, want)
+	}
+
+	c = newTestController(`elchi {
+		endpoint
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.example.com
+	}`)
+	if _, err := parseElchi(c); err == nil {
+		t.Error("Expected error for endpoint without URL")
+	}
+}
+
+func TestParseElchi_Watch(t *testing.T) {
+	c := newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.example.com
+		watch
+	}`)
+	e, err := parseElchi(c)
+	if err != nil {
+		t.Fatalf("parseElchi failed: %v", err)
+	}
+	if !e.Watch {
+		t.Error("Expected watch to be enabled")
+	}
+
+	c = newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.example.com
+		watch sse
+	}`)
+	if _, err := parseElchi(c); err == nil {
+		t.Error("Expected error for watch with an argument")
+	}
+}
+
+func TestParseElchi_TrustedKeys(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantKeys int
+		wantErr  bool
+	}{
+		{"", 0, false},
+		{"trusted_keys 11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=", 1, false},
+		{"trusted_keys 11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo= PUAXw+hDiVqStwqnTRt+vJyYLM8uxJaMwM1V8Sr0Zgw=", 2, false},
+		{"trusted_keys 11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=\ntrusted_keys PUAXw+hDiVqStwqnTRt+vJyYLM8uxJaMwM1V8Sr0Zgw=", 2, false},
+		{"trusted_keys", 0, true},
+		{"trusted_keys /nonexistent/controller.pub", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(e.TrustedKeys) != tt.wantKeys {
+				t.Errorf("Expected %d trusted keys, got %d", tt.wantKeys, len(e.TrustedKeys))
+			}
+		})
+	}
+}
+
+func TestParseElchi_StrictHash(t *testing.T) {
+	c := newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.example.com
+		strict_hash
+	}`)
+	e, err := parseElchi(c)
+	if err != nil {
+		t.Fatalf("parseElchi failed: %v", err)
+	}
+	if !e.StrictHash {
+		t.Error("Expected strict_hash to be enabled")
+	}
+
+	c = newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.example.com
+		strict_hash on
+	}`)
+	if _, err := parseElchi(c); err == nil {
+		t.Error("Expected error for strict_hash with an argument")
+	}
+}
+
+func TestParseElchi_Encoding(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"encoding json", encodingJSON, false},
+		{"encoding protobuf", encodingProtobuf, false},
+		{"encoding", "", true},
+		{"encoding msgpack", "", true},
+		{"encoding protobuf json", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && e.Encoding != tt.want {
+				t.Errorf("got %q, want %q", e.Encoding, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_Guard(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *GuardLimits
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"guard max_removed 20%", &GuardLimits{MaxRemoved: 20}, false},
+		{"guard max_removed 12.5 max_ip_changes 50% min_records 10", &GuardLimits{MaxRemoved: 12.5, MaxIPChanges: 50, MinRecords: 10}, false},
+		{"guard", nil, true},
+		{"guard max_removed", nil, true},
+		{"guard max_removed 0", nil, true},
+		{"guard max_ip_changes 101%", nil, true},
+		{"guard min_records 0", nil, true},
+		{"guard max_names 10", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(e.Guard, tt.want) {
+				t.Errorf("got %+v, want %+v", e.Guard, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_Secrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		check   func(e *Elchi) bool
+		wantErr bool
+	}{
+		{"secret file", "secret_file /etc/elchi/secret\nwebhook", func(e *Elchi) bool {
+			return e.SecretFile == "/etc/elchi/secret" && e.Secret == ""
+		}, false},
+		{"separate secrets", "controller_secret controller123\nwebhook_secret newsecret123 oldsecret123\nwebhook", func(e *Elchi) bool {
+			return e.ControllerSecret == "controller123" && slices.Equal(e.WebhookSecrets, []string{"newsecret123", "oldsecret123"})
+		}, false},
+		{"separate files", "controller_secret_file /etc/elchi/controller\nwebhook_secret_file /etc/elchi/webhook\nsecret_grace 10m", func(e *Elchi) bool {
+			return e.ControllerSecretFile == "/etc/elchi/controller" && e.WebhookSecretFile == "/etc/elchi/webhook" && e.SecretGrace == 10*time.Minute
+		}, false},
+		{"controller secret without webhook", "controller_secret controller123", func(e *Elchi) bool {
+			return e.ControllerSecret == "controller123"
+		}, false},
+		{"no secret", "webhook_secret webhook123", nil, true},
+		{"webhook without its secret", "controller_secret controller123\nwebhook", nil, true},
+		{"secret and secret_file", "secret testsecret123\nsecret_file /etc/elchi/secret", nil, true},
+		{"short webhook secret", "secret testsecret123\nwebhook_secret short", nil, true},
+		{"short controller secret", "secret testsecret123\ncontroller_secret short", nil, true},
+		{"missing file", "secret_file", nil, true},
+		{"negative grace", "secret testsecret123\nsecret_grace -1m", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.config + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(e) {
+				t.Errorf("Unexpected secrets %+v", e)
+			}
+		})
+	}
+}
+
+func TestParseElchi_Dampening(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *DampeningConfig
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"dampening", defaultDampening(), false},
+		{"dampening penalty 500 suppress 1500 reuse 500 half_life 5m max_suppress 20m",
+			&DampeningConfig{Penalty: 500, Suppress: 1500, Reuse: 500, HalfLife: 5 * time.Minute, MaxSuppress: 20 * time.Minute}, false},
+		{"dampening penalty", nil, true},
+		{"dampening penalty 0", nil, true},
+		{"dampening half_life forever", nil, true},
+		{"dampening reuse 2000", nil, true},
+		{"dampening max_suppress 15m", nil, true},
+		{"dampening threshold 10", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(e.Dampening, tt.want) {
+				t.Errorf("got %+v, want %+v", e.Dampening, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_MaxResponseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"max_response_size 1048576", 1 << 20, false},
+		{"max_response_size 128M", 128 << 20, false},
+		{"max_response_size 1GB", 1 << 30, false},
+		{"max_response_size", 0, true},
+		{"max_response_size 0", 0, true},
+		{"max_response_size 10X", 0, true},
+		{"max_response_size 1M 2M", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && e.MaxResponseSize != tt.want {
+				t.Errorf("got %d, want %d", e.MaxResponseSize, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_Auth(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantMode string
+		wantSkew time.Duration
+		wantErr  bool
+	}{
+		{"", "", 0, false},
+		{"auth hmac", authHMAC, 0, false},
+		{"auth compat max_skew 2m", authCompat, 2 * time.Minute, false},
+		{"auth legacy", authLegacy, 0, false},
+		{"auth", "", 0, true},
+		{"auth token", "", 0, true},
+		{"auth hmac max_skew", "", 0, true},
+		{"auth hmac max_skew -1m", "", 0, true},
+		{"auth hmac skew 1m", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (e.AuthMode != tt.wantMode || e.AuthSkew != tt.wantSkew) {
+				t.Errorf("got mode %q skew %v, want %q %v", e.AuthMode, e.AuthSkew, tt.wantMode, tt.wantSkew)
+			}
+		})
+	}
+}
+
+func TestParseElchi_TLS(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"", false},
+		{"tls_ca /etc/elchi/ca.pem", false},
+		{"tls_cert /etc/elchi/client.pem\ntls_key /etc/elchi/client-key.pem", false},
+		{"tls_server_name controller.elchi.internal", false},
+		{"tls_cert /etc/elchi/client.pem", true},
+		{"tls_key /etc/elchi/client-key.pem", true},
+		{"tls_ca", true},
+		{"tls_ca /etc/elchi/ca.pem /etc/elchi/other.pem", true},
+		{"tls_ca /etc/elchi/ca.pem\ntls_skip_verify", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint https://localhost:8443
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.value == "tls_server_name controller.elchi.internal" && e.TLSServerName != "controller.elchi.internal" {
+				t.Errorf("Expected TLSServerName controller.elchi.internal, got %q", e.TLSServerName)
+			}
+		})
+	}
+}
+
+func TestParseElchi_ClientRegion(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"single subnet", "client_region avrupa 10.20.0.0/16", false},
+		{"multiple subnets", "client_region asya 10.10.0.0/16 2001:db8:10::/48", false},
+		{"missing subnet", "client_region avrupa", true},
+		{"invalid subnet", "client_region avrupa 10.20.0.0/33", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.input + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && e.clientRegions == nil {
+				t.Error("Expected client regions to be configured")
+			}
+		})
+	}
+}
+
+func TestParseElchi_AnswerOrder(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"fixed", answerOrderFixed, false},
+		{"random", answerOrderRandom, false},
+		{"round_robin", answerOrderRoundRobin, false},
+		{"weighted", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				answer_order ` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && e.AnswerOrder != tt.want {
+				t.Errorf("AnswerOrder = %s, want %s", e.AnswerOrder, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_MaxAnswers(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"1", 1, false},
+		{"8", 8, false},
+		{"0", 0, true},
+		{"many", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				max_answers ` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && e.MaxAnswers != tt.want {
+				t.Errorf("MaxAnswers = %d, want %d", e.MaxAnswers, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_FailbackDelay(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", defaultFailbackDelay, false},
+		{"failback_delay 2m", 2 * time.Minute, false},
+		{"failback_delay 0s", 0, false},
+		{"failback_delay -1s", 0, true},
+		{"failback_delay soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && e.FailbackDelay != tt.want {
+				t.Errorf("FailbackDelay = %v, want %v", e.FailbackDelay, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_ColdStart(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantPolicy string
+		wantWait   time.Duration
+		wantErr    bool
+	}{
+		{"", coldStartServfail, 0, false},
+		{"cold_start_policy refused", coldStartRefused, 0, false},
+		{"cold_start_policy fallthrough\nstartup_wait 30s", coldStartFallthrough, 30 * time.Second, false},
+		{"cold_start_policy nxdomain", coldStartNXDOMAIN, 0, false},
+		{"cold_start_policy ignore", "", 0, true},
+		{"startup_wait -5s", "", 0, true},
+		{"persist", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := newTestController(`elchi {
+				endpoint http://localhost:8080
+				secret testsecret123
+				node_ip 10.0.0.1
+				ns ns1.example.com
+				` + tt.value + `
+			}`)
+
+			e, err := parseElchi(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseElchi() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if e.ColdStartPolicy != tt.wantPolicy || e.StartupWait != tt.wantWait {
+				t.Errorf("got policy %q wait %v, want %q %v", e.ColdStartPolicy, e.StartupWait, tt.wantPolicy, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestParseSOA(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    SOAConfig
+		wantErr bool
+	}{
+		{
+			"all options",
+			[]string{"mname", "ns1.gslb.elchi", "rname", "dns.admin@example.com", "refresh", "1h", "retry", "10m", "expire", "48h", "minimum", "1m"},
+			SOAConfig{MName: "ns1.gslb.elchi.", RName: "dns\\.admin.example.com.", Refresh: time.Hour, Retry: 10 * time.Minute, Expire: 48 * time.Hour, MinTTL: time.Minute},
+			false,
+		},
+		{"mailbox in domain form", []string{"rname", "hostmaster.example.com"}, SOAConfig{RName: "hostmaster.example.com."}, false},
+		{"no options", nil, SOAConfig{}, true},
+		{"missing value", []string{"mname"}, SOAConfig{}, true},
+		{"sub-second timer", []string{"minimum", "500ms"}, SOAConfig{}, true},
+		{"unknown option", []string{"serial", "1"}, SOAConfig{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSOA(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSOA() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseSOA() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseElchi_NS(t *testing.T) {
+	c := newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		ns ns1.gslb.elchi NS2.example.com.
+	}`)
+
+	e, err := parseElchi(c)
+	if err != nil {
+		t.Fatalf("parseElchi() error = %v", err)
+	}
+	if len(e.NameServers) != 2 || e.NameServers[0] != "ns1.gslb.elchi." || e.NameServers[1] != "ns2.example.com." {
+		t.Errorf("NameServers = %v", e.NameServers)
+	}
+}
+
+func TestParseElchi_NameServerRequired(t *testing.T) {
+	c := newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+	}`)
+	if _, err := parseElchi(c); err == nil {
+		t.Fatal("Expected error without ns or soa mname")
+	}
+
+	// soa mname alone is the name server of the apex too
+	c = newTestController(`elchi {
+		endpoint http://localhost:8080
+		secret testsecret123
+		node_ip 10.0.0.1
+		soa mname ns1.example.com
+	}`)
+	e, err := parseElchi(c)
+	if err != nil {
+		t.Fatalf("parseElchi() error = %v", err)
+	}
+	if ns := e.nsRecords(); len(ns) != 1 || ns[0].(*dns.NS).Ns != "ns1.example.com." {
+		t.Errorf("Unexpected NS records %v", ns)
+	}
+}
+
+func TestParseHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    HealthCheck
+		wantErr bool
+	}{
+		{"bare", nil, HealthCheck{}, false},
+		{"tcp", []string{"tcp", "443"}, HealthCheck{Type: "tcp", Port: 443}, false},
+		{
+			"http with options",
+			[]string{"http", "8080", "path", "/healthz", "status", "204", "interval", "5s", "timeout", "1s", "rise", "2", "fall", "3"},
+			HealthCheck{Type: "http", Port: 8080, Path: "/healthz", ExpectedStatus: 204, Interval: "5s", Timeout: "1s", Rise: 2, Fall: 3},
+			false,
+		},
+		{"options only", []string{"interval", "30s"}, HealthCheck{Interval: "30s"}, false},
+		{"missing port", []string{"http"}, HealthCheck{}, true},
+		{"invalid port", []string{"tcp", "99999"}, HealthCheck{}, true},
+		{"invalid interval", []string{"tcp", "80", "interval", "soon"}, HealthCheck{}, true},
+		{"invalid fall", []string{"tcp", "80", "fall", "0"}, HealthCheck{}, true},
+		{"unknown option", []string{"tcp", "80", "retries", "3"}, HealthCheck{}, true},
+		{"missing value", []string{"tcp", "80", "path"}, HealthCheck{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHealthCheck(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHealthCheck() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("parseHealthCheck() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
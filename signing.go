@@ -0,0 +1,151 @@
+package elchi
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errBadSignature is returned when records are not signed by a trusted key.
+var errBadSignature = errors.New("record signature verification failed")
+
+// Signing contexts, so records signed for one purpose cannot be replayed for
+// another.
+const (
+	signContextRecords = "records" // Snapshots and changes responses
+	signContextNotify  = "notify"  // POST /notify requests
+)
+
+// signatureVersion is the first line of every signed message.
+const signatureVersion = "elchi-signature-v1"
+
+// trustedKeys are the Ed25519 public keys records may be signed with. Several
+// keys are accepted at once, so the controller key can be rotated.
+type trustedKeys []ed25519.PublicKey
+
+// parseTrustedKey parses a public key given as base64 of the raw 32 byte key,
+// or as the path of a PEM file with a PKIX public key.
+func parseTrustedKey(value string) (ed25519.PublicKey, error) {
+	if raw, err := base64.StdEncoding.DecodeString(value); err == nil && len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+
+	data, err := os.ReadFile(value) //nolint:gosec // Key file path comes from the Corefile
+	if err != nil {
+		return nil, fmt.Errorf("not a base64 Ed25519 public key or a readable PEM file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", value)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %w", value, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key in %s is not an Ed25519 key", value)
+	}
+	return edKey, nil
+}
+
+// verify checks a base64 signature of message against the trusted keys.
+func (k trustedKeys) verify(message []byte, signature string) error {
+	if signature == "" {
+		return fmt.Errorf("%w: missing signature", errBadSignature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed signature", errBadSignature)
+	}
+	for _, key := range k {
+		if ed25519.Verify(key, message, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: not signed by a trusted key", errBadSignature)
+}
+
+// signedMessage returns the message an Ed25519 signature covers: the
+// signature version, context, zone (lowercase, without trailing dot),
+// version hash, base hash and the canonical hashes of the records and
+// deletes, each on its own line.
+func signedMessage(context, zone, versionHash, baseHash string, records []DNSRecord, deletes []DeleteRecord) ([]byte, error) {
+	recordsSum, err := recordsHash(records)
+	if err != nil {
+		return nil, err
+	}
+	deletesSum, err := canonicalHash(deletes)
+	if err != nil {
+		return nil, err
+	}
+	return signedMessageOf(context, zone, versionHash, baseHash, recordsSum, deletesSum), nil
+}
+
+// signedMessageOf returns the signed message for the canonical hashes of
+// records and deletes.
+func signedMessageOf(context, zone, versionHash, baseHash, recordsSum, deletesSum string) []byte {
+	return []byte(strings.Join([]string{
+		signatureVersion,
+		context,
+		strings.ToLower(strings.TrimSuffix(zone, ".")),
+		versionHash,
+		baseHash,
+		recordsSum,
+		deletesSum,
+	}, "\n"))
+}
+
+// verifySnapshotSum checks the signature of a snapshot whose records have the
+// canonical hash recordsSum, if trusted keys are configured.
+func (k trustedKeys) verifySnapshotSum(s *DNSSnapshot, recordsSum string) error {
+	if len(k) == 0 {
+		return nil
+	}
+	var none canonicalHasher
+	return k.verify(signedMessageOf(signContextRecords, s.Zone, s.VersionHash, "", recordsSum, none.sum()), s.Signature)
+}
+
+// verifyChanges checks the signature of a changes response, if trusted keys
+// are configured. Unchanged responses carry no records and are not signed.
+func (k trustedKeys) verifyChanges(r *DNSChangesResponse) error {
+	if len(k) == 0 || r.Unchanged {
+		return nil
+	}
+	message, err := signedMessage(signContextRecords, r.Zone, r.VersionHash, r.BaseHash, r.Records, r.Deletes)
+	if err != nil {
+		return err
+	}
+	return k.verify(message, r.Signature)
+}
+
+// verifyNotify checks the signature of a /notify request for zone, if
+// trusted keys are configured. The signature covers the timestamp of the
+// request in place of a version hash, and requests signed more than skew away
+// from now are rejected, so a captured request cannot roll records back later.
+// Repeats within skew are left to the caller.
+func (k trustedKeys) verifyNotify(zone string, r *NotifyRequest, now time.Time, skew time.Duration) error {
+	if len(k) == 0 {
+		return nil
+	}
+	message, err := signedMessage(signContextNotify, zone, strconv.FormatInt(r.Timestamp, 10), "", r.Records, r.Deletes)
+	if err != nil {
+		return err
+	}
+	if err := k.verify(message, r.Signature); err != nil {
+		return err
+	}
+	signedAt := time.Unix(r.Timestamp, 0)
+	if signedAt.Before(now.Add(-skew)) || signedAt.After(now.Add(skew)) {
+		return fmt.Errorf("%w: signed at %s, outside the allowed skew of %v",
+			errBadSignature, signedAt.UTC().Format(time.RFC3339), skew)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package elchi
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newSigningKey returns a new Ed25519 key pair.
+func newSigningKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// sign returns the base64 signature of the message for the given fields.
+func sign(t *testing.T, key ed25519.PrivateKey, context, zone, versionHash, baseHash string, records []DNSRecord, deletes []DeleteRecord) string {
+	t.Helper()
+	message, err := signedMessage(context, zone, versionHash, baseHash, records, deletes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, message))
+}
+
+func TestParseTrustedKey(t *testing.T) {
+	public, _ := newSigningKey(t)
+	dir := t.TempDir()
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := filepath.Join(dir, "controller.pub")
+	if err := os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecFile := filepath.Join(dir, "ecdsa.pub")
+	if err := os.WriteFile(ecFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"base64", base64.StdEncoding.EncodeToString(public), false},
+		{"PEM file", pemFile, false},
+		{"ECDSA key", ecFile, true},
+		{"short base64", base64.StdEncoding.EncodeToString(public[:16]), true},
+		{"missing file", filepath.Join(dir, "missing.pub"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseTrustedKey(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTrustedKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !key.Equal(public) {
+				t.Error("Expected the parsed key to match")
+			}
+		})
+	}
+}
+
+func TestTrustedKeys_Verify(t *testing.T) {
+	oldPublic, oldPrivate := newSigningKey(t)
+	newPublic, newPrivate := newSigningKey(t)
+	_, otherPrivate := newSigningKey(t)
+	message := []byte("message")
+
+	// Both keys are trusted while the controller key is rotated
+	keys := trustedKeys{oldPublic, newPublic}
+	tests := []struct {
+		name      string
+		signature string
+		wantErr   bool
+	}{
+		{"old key", base64.StdEncoding.EncodeToString(ed25519.Sign(oldPrivate, message)), false},
+		{"new key", base64.StdEncoding.EncodeToString(ed25519.Sign(newPrivate, message)), false},
+		{"untrusted key", base64.StdEncoding.EncodeToString(ed25519.Sign(otherPrivate, message)), true},
+		{"missing", "", true},
+		{"malformed", "not base64!", true},
+		{"short", base64.StdEncoding.EncodeToString([]byte("short")), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := keys.verify(message, tt.signature)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errBadSignature) {
+				t.Errorf("Expected errBadSignature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSignedMessage_Context(t *testing.T) {
+	records := []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}
+	forRecords, err := signedMessage(signContextRecords, "gslb.elchi", "v1", "", records, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forNotify, err := signedMessage(signContextNotify, "gslb.elchi", "v1", "", records, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(forRecords, forNotify) {
+		t.Error("Expected a snapshot signature not to be valid for /notify")
+	}
+
+	// The zone is compared without case and trailing dot
+	fqdn, err := signedMessage(signContextRecords, "GSLB.elchi.", "v1", "", records, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forRecords, fqdn) {
+		t.Error("Expected the same message for both spellings of the zone")
+	}
+}
+
+func TestFetchSnapshot_Signed(t *testing.T) {
+	public, private := newSigningKey(t)
+	records := []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}
+	snapshot := DNSSnapshot{
+		Zone:        "gslb.elchi",
+		VersionHash: "v1",
+		Records:     records,
+		Signature:   sign(t, private, signContextRecords, "gslb.elchi", "v1", "", records, nil),
+	}
+
+	var served DNSSnapshot
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(served)
+	}))
+	defer server.Close()
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	client.trusted = trustedKeys{public}
+
+	served = snapshot
+	if _, err := client.FetchSnapshot(context.Background()); err != nil {
+		t.Fatalf("FetchSnapshot failed for a signed snapshot: %v", err)
+	}
+
+	// Changed records no longer match the signature
+	served = snapshot
+	served.Records = []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"203.0.113.66"}}}
+	if _, err := client.FetchSnapshot(context.Background()); !errors.Is(err, errBadSignature) {
+		t.Errorf("Expected errBadSignature for changed records, got %v", err)
+	}
+
+	served = snapshot
+	served.Signature = ""
+	if _, err := client.FetchSnapshot(context.Background()); !errors.Is(err, errBadSignature) {
+		t.Errorf("Expected errBadSignature for an unsigned snapshot, got %v", err)
+	}
+}
+
+func TestCheckChanges_SignedDelta(t *testing.T) {
+	public, private := newSigningKey(t)
+	records := []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}
+	deletes := []DeleteRecord{{Name: "old.gslb.elchi", Type: "A"}}
+	changes := DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		VersionHash: "v2",
+		BaseHash:    "v1",
+		Records:     records,
+		Deletes:     deletes,
+		Signature:   sign(t, private, signContextRecords, "gslb.elchi", "v2", "v1", records, deletes),
+	}
+
+	var served DNSChangesResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(served)
+	}))
+	defer server.Close()
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	client.trusted = trustedKeys{public}
+
+	served = changes
+	if _, err := client.CheckChanges(context.Background(), "v1"); err != nil {
+		t.Fatalf("CheckChanges failed for a signed delta: %v", err)
+	}
+
+	// An extra delete is not covered by the signature
+	served = changes
+	served.Deletes = append([]DeleteRecord{{Name: "app2.gslb.elchi", Type: "A"}}, deletes...)
+	if _, err := client.CheckChanges(context.Background(), "v1"); !errors.Is(err, errBadSignature) {
+		t.Errorf("Expected errBadSignature for an extra delete, got %v", err)
+	}
+
+	// The delta cannot be moved onto another base
+	served = changes
+	served.BaseHash = "v0"
+	if _, err := client.CheckChanges(context.Background(), "v0"); !errors.Is(err, errBadSignature) {
+		t.Errorf("Expected errBadSignature for another base hash, got %v", err)
+	}
+}
+
+func TestHandleNotify_TrustedKeys(t *testing.T) {
+	public, private := newSigningKey(t)
+	e := &Elchi{
+		Zone:        "gslb.elchi.",
+		Secret:      "test-secret",
+		TTL:         300,
+		TrustedKeys: []ed25519.PublicKey{public},
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.syncStatus = &SyncStatus{lastSyncStatus: "initial"}
+	ws := NewWebhookServer(e, ":8053")
+
+	records := []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}
+	notify := func(req NotifyRequest) int {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		rr := httptest.NewRecorder()
+		ws.handleNotify(rr, httptest.NewRequest(http.MethodPost, "/notify", bytes.NewReader(body)))
+		return rr.Code
+	}
+
+	if code := notify(NotifyRequest{Records: records}); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for unsigned records, got %d", code)
+	}
+	// A snapshot signature is not valid for /notify
+	snapshotSignature := sign(t, private, signContextRecords, "gslb.elchi", "", "", records, nil)
+	if code := notify(NotifyRequest{Records: records, Signature: snapshotSignature}); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a snapshot signature, got %d", code)
+	}
+	if e.cache.RRCount() != 0 {
+		t.Fatalf("Expected rejected records not to be applied, got %d RRs", e.cache.RRCount())
+	}
+
+	now := time.Now()
+	signNotify := func(signedAt time.Time) NotifyRequest {
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		return NotifyRequest{
+			Records:   records,
+			Timestamp: signedAt.Unix(),
+			Signature: sign(t, private, signContextNotify, "gslb.elchi", timestamp, "", records, nil),
+		}
+	}
+	if code := notify(signNotify(now.Add(-time.Hour))); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a stale request, got %d", code)
+	}
+	// The timestamp is covered by the signature
+	stale := signNotify(now.Add(-time.Hour))
+	stale.Timestamp = now.Unix()
+	if code := notify(stale); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a changed timestamp, got %d", code)
+	}
+	if e.cache.RRCount() != 0 {
+		t.Fatalf("Expected rejected records not to be applied, got %d RRs", e.cache.RRCount())
+	}
+
+	signed := signNotify(now)
+	if code := notify(signed); code != http.StatusOK {
+		t.Errorf("Expected status 200 for signed records, got %d", code)
+	}
+	if e.cache.RRCount() != 1 {
+		t.Errorf("Expected the signed records to be applied, got %d RRs", e.cache.RRCount())
+	}
+
+	// A captured request cannot be replayed, e.g. after a newer update
+	if code := notify(signed); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a replayed request, got %d", code)
+	}
+}
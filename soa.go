@@ -0,0 +1,134 @@
+package elchi
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SOA defaults.
+const (
+	defaultSOARefresh = 2 * time.Hour    // Secondary refresh interval
+	defaultSOARetry   = 30 * time.Minute // Secondary retry interval
+	defaultSOAExpire  = 24 * time.Hour   // Secondary expiry
+	defaultSOAMinTTL  = 30 * time.Second // Negative caching TTL, kept short so new records show up quickly
+
+	maxSOATimer = (1<<31 - 1) * time.Second // Largest SOA timer (RFC 2181)
+)
+
+// SOAConfig configures the SOA record of the zone. Empty fields fall back to
+// the defaults: the first name server of the ns directive as primary name
+// server and hostmaster.<zone> as responsible mailbox.
+type SOAConfig struct {
+	MName   string        // Primary name server
+	RName   string        // Responsible mailbox in domain name form (hostmaster.example.com.)
+	Refresh time.Duration // Refresh timer
+	Retry   time.Duration // Retry timer
+	Expire  time.Duration // Expire timer
+	MinTTL  time.Duration // Negative caching TTL (SOA minimum)
+}
+
+// soa returns the SOA record of the zone. The serial is derived from the
+// version hash of the cache, so it changes whenever the records change.
+func (e *Elchi) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   e.Zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    e.TTL,
+		},
+		Ns:      e.primaryNS(),
+		Mbox:    orDefault(e.SOA.RName, "hostmaster."+e.Zone),
+		Serial:  soaSerial(e.cache.GetVersionHash()),
+		Refresh: seconds(e.SOA.Refresh, defaultSOARefresh),
+		Retry:   seconds(e.SOA.Retry, defaultSOARetry),
+		Expire:  seconds(e.SOA.Expire, defaultSOAExpire),
+		Minttl:  seconds(e.SOA.MinTTL, defaultSOAMinTTL),
+	}
+}
+
+// primaryNS returns the primary name server of the zone. Setup requires
+// soa mname or ns to be set.
+func (e *Elchi) primaryNS() string {
+	if e.SOA.MName == "" && len(e.NameServers) > 0 {
+		return e.NameServers[0]
+	}
+	return e.SOA.MName
+}
+
+// nsRecords returns the NS records of the zone apex. Without configured name
+// servers, the SOA primary name server is used.
+func (e *Elchi) nsRecords() []dns.RR {
+	names := e.NameServers
+	if len(names) == 0 {
+		names = []string{e.SOA.MName}
+	}
+
+	rrs := make([]dns.RR, 0, len(names))
+	for _, name := range names {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   e.Zone,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    e.TTL,
+			},
+			Ns: name,
+		})
+	}
+	return rrs
+}
+
+// glue returns the cached A/AAAA records of name servers inside the zone,
+// for the additional section of NS answers.
+func (e *Elchi) glue(nsRRs []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range nsRRs {
+		name := rr.(*dns.NS).Ns
+		if !dns.IsSubDomain(e.Zone, name) {
+			continue
+		}
+		extra = append(extra, e.cache.Get(name, dns.TypeA)...)
+		extra = append(extra, e.cache.Get(name, dns.TypeAAAA)...)
+	}
+	return extra
+}
+
+// soaSerial maps an opaque version hash to an SOA serial. Serials are not
+// monotonic, which is fine as the zone is never transferred.
+func soaSerial(versionHash string) uint32 {
+	if versionHash == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(versionHash))
+	return h.Sum32()
+}
+
+// seconds converts a duration to whole seconds, using def if d is zero.
+func seconds(d, def time.Duration) uint32 {
+	if d == 0 {
+		d = def
+	}
+	return uint32(d / time.Second) //nolint:gosec // SOA timers are validated at setup
+}
+
+// orDefault returns s, or def if s is empty.
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// normalizeMailbox converts an email address to the domain name form used in
+// SOA records (hostmaster@example.com -> hostmaster.example.com.).
+func normalizeMailbox(mailbox string) string {
+	if local, domain, ok := strings.Cut(mailbox, "@"); ok {
+		mailbox = strings.ReplaceAll(local, ".", "\\.") + "." + domain
+	}
+	return normalizeDomain(mailbox)
+}
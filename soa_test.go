@@ -0,0 +1,103 @@
+package elchi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeDNS_ApexSOA(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, NameServers: []string{"ns1.gslb.elchi.", "ns2.example.com."}}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi.", VersionHash: "v1"}, 300)
+
+	msg := query(t, e, "gslb.elchi.", dns.TypeSOA)
+	if msg.Rcode != dns.RcodeSuccess || !msg.Authoritative {
+		t.Fatalf("Expected authoritative NOERROR, got rcode %d", msg.Rcode)
+	}
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Expected 1 answer, got %d", len(msg.Answer))
+	}
+	soa, ok := msg.Answer[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("Expected SOA record, got %T", msg.Answer[0])
+	}
+	if soa.Ns != "ns1.gslb.elchi." || soa.Mbox != "hostmaster.gslb.elchi." {
+		t.Errorf("Unexpected default mname/rname: %s %s", soa.Ns, soa.Mbox)
+	}
+	if soa.Serial != soaSerial("v1") || soa.Minttl != 30 || soa.Hdr.Ttl != 300 {
+		t.Errorf("Unexpected serial %d, minimum %d or TTL %d", soa.Serial, soa.Minttl, soa.Hdr.Ttl)
+	}
+}
+
+func TestServeDNS_ApexNS(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, NameServers: []string{"ns1.gslb.elchi.", "ns2.example.com."}}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "ns1.gslb.elchi", Type: "A", IPs: []string{"10.0.0.53"}},
+		},
+	}, 300)
+
+	msg := query(t, e, "gslb.elchi.", dns.TypeNS)
+	if len(msg.Answer) != 2 {
+		t.Fatalf("Expected 2 NS records, got %d", len(msg.Answer))
+	}
+
+	// Only the in-zone name server has glue
+	if len(msg.Extra) != 1 || rrIP(msg.Extra[0]) != "10.0.0.53" {
+		t.Errorf("Expected glue A record 10.0.0.53, got %v", msg.Extra)
+	}
+}
+
+func TestServeDNS_NegativeAuthority(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, SOA: SOAConfig{MName: "ns1.gslb.elchi.", MinTTL: time.Minute}}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{
+		Zone:        "gslb.elchi.",
+		VersionHash: "v1",
+		Records: []DNSRecord{
+			{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		},
+	}, 300)
+
+	msg := query(t, e, "missing.gslb.elchi.", dns.TypeA)
+	if msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN, got %d", msg.Rcode)
+	}
+	if len(msg.Ns) != 1 {
+		t.Fatalf("Expected SOA in authority section, got %v", msg.Ns)
+	}
+	if soa := msg.Ns[0].(*dns.SOA); soa.Ns != "ns1.gslb.elchi." || soa.Minttl != 60 {
+		t.Errorf("Unexpected SOA in authority: %s", soa)
+	}
+
+	// Negative answers are cached for at most the SOA minimum
+	if ttl := msg.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("Expected the SOA TTL capped at the minimum 60, got %d", ttl)
+	}
+
+	// The apex exists, so an A query there is NODATA
+	msg = query(t, e, "gslb.elchi.", dns.TypeA)
+	if msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected NODATA for apex A query, got rcode %d", msg.Rcode)
+	}
+	if len(msg.Answer) != 0 || len(msg.Ns) != 1 {
+		t.Errorf("Expected empty answer and SOA authority, got %v / %v", msg.Answer, msg.Ns)
+	}
+}
+
+func TestSOASerial_FollowsVersionHash(t *testing.T) {
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, SOA: SOAConfig{MName: "ns1.gslb.elchi."}}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi.", VersionHash: "v1"}, 300)
+	before := e.soa().Serial
+
+	e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi.", VersionHash: "v2"}, 300)
+	if after := e.soa().Serial; after == before {
+		t.Errorf("Expected serial to change with the version hash, got %d twice", after)
+	}
+}
@@ -0,0 +1,142 @@
+package elchi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// controllerTLS builds the TLS configuration of connections to the
+// controller from the tls_* directives. The CA bundle and the client
+// certificate are read again when their files change on disk, so rotated
+// certificates are used by the next connection without a restart.
+type controllerTLS struct {
+	caFile     string // PEM bundle of CAs trusted for the controller ("" = system roots)
+	certFile   string // PEM client certificate for mutual TLS ("" = none)
+	keyFile    string // PEM private key of certFile
+	serverName string // Name verified in the controller certificate ("" = endpoint host)
+	skipVerify bool   // Do not verify the controller certificate at all
+
+	mu      sync.Mutex
+	roots   *x509.CertPool
+	cert    *tls.Certificate
+	modTime map[string]time.Time // file -> modification time of the loaded version
+}
+
+// newControllerTLS creates the TLS configuration and loads the configured
+// files. Unlike later reloads, a file that cannot be loaded is an error.
+func newControllerTLS(caFile, certFile, keyFile, serverName string, skipVerify bool) (*controllerTLS, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls_cert and tls_key must be set together")
+	}
+	t := &controllerTLS{
+		caFile:     caFile,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		serverName: serverName,
+		skipVerify: skipVerify,
+		modTime:    make(map[string]time.Time),
+	}
+	if _, err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload reads the files again if any of them changed since they were last
+// loaded, and reports whether it did. On error the previous CA bundle and
+// certificate stay in use.
+func (t *controllerTLS) reload() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	modTime := make(map[string]time.Time)
+	changed := false
+	for _, file := range []string{t.caFile, t.certFile, t.keyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTime[file] = info.ModTime()
+		if !info.ModTime().Equal(t.modTime[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	roots := t.roots
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return false, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates found in %s", t.caFile)
+		}
+	}
+
+	cert := t.cert
+	if t.certFile != "" {
+		// A rotation replacing the certificate and key one after the other
+		// fails here until both are written, and is retried on the next
+		// connection
+		pair, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &pair
+	}
+
+	t.roots = roots
+	t.cert = cert
+	t.modTime = modTime
+	return true, nil
+}
+
+// config returns the TLS configuration for a new connection, with the current
+// CA bundle and client certificate.
+func (t *controllerTLS) config() *tls.Config {
+	if reloaded, err := t.reload(); err != nil {
+		log.Warningf("Failed to reload controller TLS files, keeping the loaded ones: %v", err)
+	} else if reloaded {
+		log.Infof("Controller TLS files reloaded")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: t.serverName,
+		RootCAs:    t.roots,
+	}
+	if t.skipVerify {
+		cfg.InsecureSkipVerify = true //nolint:gosec // User explicitly requested to skip TLS verification
+	}
+	if t.cert != nil {
+		cfg.Certificates = []tls.Certificate{*t.cert}
+	}
+	return cfg
+}
+
+// dialTLS opens a TLS connection to the controller. It is used as the
+// transport's DialTLSContext, so every connection gets the current config.
+func (t *controllerTLS) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		Config:    t.config(), // The dialer verifies the endpoint host when ServerName is empty
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,280 @@
+package elchi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by a test CA.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate for name. Without a parent it is a
+// self-signed CA.
+func newTestCert(t *testing.T, name string, parent *testCert, hosts ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and, if keyPath is set, its key as PEM files.
+func (c *testCert) write(t *testing.T, certPath, keyPath string) {
+	t.Helper()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if keyPath == "" {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newMutualTLSServer returns a controller that requires a client certificate
+// signed by ca and answers with the common name of that certificate as the
+// version hash.
+func newMutualTLSServer(t *testing.T, ca, serverCert *testCert) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(DNSSnapshot{
+			Zone:        "gslb.elchi",
+			VersionHash: r.TLS.PeerCertificates[0].Subject.CommonName,
+		})
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server.TLS = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{serverCert.der},
+			PrivateKey:  serverCert.key,
+		}},
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// touch moves the modification time of the files forward, so a rewrite is
+// noticed even on file systems with coarse timestamps.
+func touch(t *testing.T, at time.Time, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		if err := os.Chtimes(file, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestControllerTLS_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+
+	ca := newTestCert(t, "test-ca", nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "node-1", ca).write(t, certFile, keyFile)
+	server := newMutualTLSServer(t, ca, newTestCert(t, "controller", ca, "127.0.0.1"))
+
+	tlsConfig, err := newControllerTLS(caFile, certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatalf("newControllerTLS failed: %v", err)
+	}
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, tlsConfig)
+	snapshot, err := client.FetchSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("FetchSnapshot failed: %v", err)
+	}
+	if snapshot.VersionHash != "node-1" {
+		t.Errorf("Expected the controller to see client certificate node-1, got %s", snapshot.VersionHash)
+	}
+
+	// Without a client certificate the controller rejects the handshake
+	tlsConfig, err = newControllerTLS(caFile, "", "", "", false)
+	if err != nil {
+		t.Fatalf("newControllerTLS failed: %v", err)
+	}
+	client = NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, tlsConfig)
+	if _, err := client.FetchSnapshot(context.Background()); err == nil {
+		t.Error("Expected an error without a client certificate")
+	}
+
+	// Without the private CA the controller certificate is not trusted
+	client = NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	if _, err := client.FetchSnapshot(context.Background()); err == nil {
+		t.Error("Expected an error for a controller signed by an unknown CA")
+	}
+}
+
+func TestControllerTLS_ServerName(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+
+	ca := newTestCert(t, "test-ca", nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "node-1", ca).write(t, certFile, keyFile)
+	// The certificate does not cover the IP the controller is reached at
+	server := newMutualTLSServer(t, ca, newTestCert(t, "controller", ca, "controller.elchi.internal"))
+
+	tlsConfig, err := newControllerTLS(caFile, certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatalf("newControllerTLS failed: %v", err)
+	}
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, tlsConfig)
+	if _, err := client.FetchSnapshot(context.Background()); err == nil {
+		t.Error("Expected an error for a certificate without the endpoint IP")
+	}
+
+	tlsConfig, err = newControllerTLS(caFile, certFile, keyFile, "controller.elchi.internal", false)
+	if err != nil {
+		t.Fatalf("newControllerTLS failed: %v", err)
+	}
+	client = NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, tlsConfig)
+	if _, err := client.FetchSnapshot(context.Background()); err != nil {
+		t.Errorf("FetchSnapshot with tls_server_name failed: %v", err)
+	}
+}
+
+func TestControllerTLS_Reload(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+
+	ca := newTestCert(t, "test-ca", nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "node-1", ca).write(t, certFile, keyFile)
+	server := newMutualTLSServer(t, ca, newTestCert(t, "controller", ca, "127.0.0.1"))
+
+	tlsConfig, err := newControllerTLS(caFile, certFile, keyFile, "", false)
+	if err != nil {
+		t.Fatalf("newControllerTLS failed: %v", err)
+	}
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, tlsConfig)
+	fetch := func() string {
+		t.Helper()
+		// Force a new handshake, as open connections keep their certificate
+		client.httpClient.CloseIdleConnections()
+		snapshot, err := client.FetchSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("FetchSnapshot failed: %v", err)
+		}
+		return snapshot.VersionHash
+	}
+	if got := fetch(); got != "node-1" {
+		t.Fatalf("Expected client certificate node-1, got %s", got)
+	}
+
+	// A rotated certificate is used by the next connection
+	newTestCert(t, "node-1-rotated", ca).write(t, certFile, keyFile)
+	touch(t, time.Now().Add(time.Minute), certFile, keyFile)
+	if got := fetch(); got != "node-1-rotated" {
+		t.Errorf("Expected rotated client certificate, got %s", got)
+	}
+
+	// A half-written rotation keeps the loaded certificate in use
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, time.Now().Add(2*time.Minute), keyFile)
+	if got := fetch(); got != "node-1-rotated" {
+		t.Errorf("Expected the loaded certificate after a failed reload, got %s", got)
+	}
+
+	// Once the key is complete, the new pair is loaded
+	newTestCert(t, "node-1-final", ca).write(t, certFile, keyFile)
+	touch(t, time.Now().Add(3*time.Minute), certFile, keyFile)
+	if got := fetch(); got != "node-1-final" {
+		t.Errorf("Expected client certificate node-1-final, got %s", got)
+	}
+}
+
+func TestNewControllerTLS_Errors(t *testing.T) {
+	dir := t.TempDir()
+	emptyCA := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(emptyCA, []byte("no certificates"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                      string
+		caFile, certFile, keyFile string
+	}{
+		{"cert without key", "", filepath.Join(dir, "client.pem"), ""},
+		{"key without cert", "", "", filepath.Join(dir, "client-key.pem")},
+		{"missing CA", filepath.Join(dir, "missing.pem"), "", ""},
+		{"CA without certificates", emptyCA, "", ""},
+		{"missing cert", "", filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newControllerTLS(tt.caFile, tt.certFile, tt.keyFile, "", false); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package elchi
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// acceptEncoding lists the content encodings the plugin decodes, preferred first
+	acceptEncoding = "zstd, gzip"
+	// defaultMaxResponseSize is the largest decoded response body read from the controller
+	defaultMaxResponseSize = 64 << 20
+)
+
+// errResponseTooLarge is returned when a controller response is larger than
+// max_response_size.
+var errResponseTooLarge = errors.New("response exceeds max_response_size")
+
+// sizeLimitReader reads up to limit bytes and fails after that, where
+// io.LimitReader would silently truncate.
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return 0, fmt.Errorf("%w of %d bytes", errResponseTooLarge, l.limit)
+	}
+	return n, err
+}
+
+// reset starts counting from zero again, for streams of separate messages.
+func (l *sizeLimitReader) reset() {
+	l.n = 0
+}
+
+// responseBody returns the body of a response decoded according to its
+// Content-Encoding and limited to limit decoded bytes. release frees the
+// decoder, the body itself is still closed by the caller.
+func responseBody(resp *http.Response, limit int64) (body *sizeLimitReader, release func(), err error) {
+	var r io.Reader = resp.Body
+	release = func() {}
+
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid gzip response: %w", err)
+		}
+		r = gz
+		release = func() { _ = gz.Close() }
+	case "zstd":
+		// Windows up to 8MiB must be accepted from any encoder, larger ones
+		// are never needed for a response of at most limit bytes
+		window := min(max(uint64(limit), 8<<20), zstd.MaxWindowSize) //nolint:gosec // limit is positive
+		zr, err := zstd.NewReader(resp.Body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(window))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid zstd response: %w", err)
+		}
+		r = zr
+		release = zr.Close
+	default:
+		return nil, nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	return &sizeLimitReader{r: r, limit: limit}, release, nil
+}
+
+// decodeSnapshot decodes a snapshot from r. Records are passed to add one at
+// a time while they are decoded, instead of being collected in
+// snapshot.Records, so a large snapshot is never held in memory twice.
+// Unknown fields are skipped.
+func decodeSnapshot(r io.Reader, snapshot *DNSSnapshot, add func(DNSRecord) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+
+		switch key {
+		case "zone":
+			err = dec.Decode(&snapshot.Zone)
+		case "version_hash":
+			err = dec.Decode(&snapshot.VersionHash)
+		case "signature":
+			err = dec.Decode(&snapshot.Signature)
+		case "records":
+			err = decodeRecords(dec, add)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return fmt.Errorf("field %s: %w", key, err)
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeRecords decodes a JSON array of records, or null, passing each record
+// to add.
+func decodeRecords(dec *json.Decoder, add func(DNSRecord) error) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected array, got %v", token)
+	}
+	for dec.More() {
+		var record DNSRecord
+		if err := dec.Decode(&record); err != nil {
+			return err
+		}
+		if err := add(record); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token and checks that it is delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if got, ok := token.(json.Delim); !ok || got != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
+
+// parseSize parses a byte size with an optional K, M or G suffix (powers of
+// 1024), e.g. "64M".
+func parseSize(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToUpper(s), "B")
+	shift := 0
+	switch {
+	case strings.HasSuffix(value, "K"):
+		shift = 10
+	case strings.HasSuffix(value, "M"):
+		shift = 20
+	case strings.HasSuffix(value, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
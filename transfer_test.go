@@ -0,0 +1,276 @@
+package elchi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress encodes data with the given content encoding.
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "zstd":
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		return data
+	}
+	return buf.Bytes()
+}
+
+// newEncodedServer serves body with the given content encoding and records
+// the Accept-Encoding header of the last request.
+func newEncodedServer(t *testing.T, encoding string, body []byte, accepted *string) *httptest.Server {
+	t.Helper()
+	encoded := compress(t, encoding, body)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accepted != nil {
+			*accepted = r.Header.Get("Accept-Encoding")
+		}
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		_, _ = w.Write(encoded)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchSnapshot_Compressed(t *testing.T) {
+	records := []DNSRecord{
+		{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}},
+		{Name: "web.gslb.elchi", Type: "AAAA", IPs: []string{"2001:db8::10"}},
+	}
+	body, err := json.Marshal(DNSSnapshot{Zone: "gslb.elchi", VersionHash: mustRecordsHash(t, records), Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			var accepted string
+			server := newEncodedServer(t, encoding, body, &accepted)
+			client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+
+			snapshot, err := client.FetchSnapshot(context.Background())
+			if err != nil {
+				t.Fatalf("FetchSnapshot failed: %v", err)
+			}
+			if len(snapshot.Records) != len(records) {
+				t.Errorf("Expected %d records, got %d", len(records), len(snapshot.Records))
+			}
+			if accepted != acceptEncoding {
+				t.Errorf("Expected Accept-Encoding %q, got %q", acceptEncoding, accepted)
+			}
+		})
+	}
+}
+
+func TestCheckChanges_Compressed(t *testing.T) {
+	body, err := json.Marshal(DNSChangesResponse{
+		Zone:        "gslb.elchi",
+		VersionHash: "v2",
+		Records:     []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newEncodedServer(t, "zstd", body, nil)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+
+	changes, err := client.CheckChanges(context.Background(), "v1")
+	if err != nil {
+		t.Fatalf("CheckChanges failed: %v", err)
+	}
+	if changes.VersionHash != "v2" || len(changes.Records) != 1 {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+}
+
+func TestFetchSnapshot_MaxResponseSize(t *testing.T) {
+	// Highly compressible, so the compressed body is far below the limit
+	records := make([]DNSRecord, 2000)
+	for i := range records {
+		records[i] = DNSRecord{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}
+	}
+	body, err := json.Marshal(DNSSnapshot{Zone: "gslb.elchi", VersionHash: "v1", Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			server := newEncodedServer(t, encoding, body, nil)
+			client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+
+			client.maxSize = int64(len(body))
+			if _, err := client.FetchSnapshot(context.Background()); err != nil {
+				t.Fatalf("FetchSnapshot failed at the limit: %v", err)
+			}
+
+			client.maxSize = int64(len(body)) / 2
+			if _, err := client.FetchSnapshot(context.Background()); !errors.Is(err, errResponseTooLarge) {
+				t.Errorf("Expected errResponseTooLarge, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckChanges_MaxResponseSize(t *testing.T) {
+	body := []byte(`{"zone":"gslb.elchi","version_hash":"v2","records":[` +
+		strings.Repeat(`{"name":"app.gslb.elchi","type":"A","ips":["192.168.1.10"]},`, 100) +
+		`{"name":"app.gslb.elchi","type":"A","ips":["192.168.1.10"]}]}`)
+	server := newEncodedServer(t, "gzip", body, nil)
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	client.maxSize = 1024
+
+	if _, err := client.CheckChanges(context.Background(), "v1"); !errors.Is(err, errResponseTooLarge) {
+		t.Errorf("Expected errResponseTooLarge, got %v", err)
+	}
+}
+
+func TestFetchSnapshot_UnsupportedEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = w.Write([]byte("not brotli"))
+	}))
+	defer server.Close()
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+
+	_, err := client.FetchSnapshot(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unsupported content encoding") {
+		t.Errorf("Expected an unsupported encoding error, got %v", err)
+	}
+}
+
+func TestDecodeSnapshot(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantRecords int
+		wantErr     bool
+	}{
+		{"records", `{"zone":"gslb.elchi","version_hash":"v1","records":[{"name":"app.gslb.elchi","type":"A"},{"name":"web.gslb.elchi","type":"A"}]}`, 2, false},
+		{"records first", `{"records":[{"name":"app.gslb.elchi","type":"A"}],"zone":"gslb.elchi","version_hash":"v1"}`, 1, false},
+		{"unknown fields", `{"zone":"gslb.elchi","generated":{"at":"now","by":["a"]},"version_hash":"v1","records":[]}`, 0, false},
+		{"null records", `{"zone":"gslb.elchi","version_hash":"v1","records":null}`, 0, false},
+		{"records object", `{"zone":"gslb.elchi","records":{}}`, 0, true},
+		{"invalid record", `{"zone":"gslb.elchi","records":[{"name":1}]}`, 0, true},
+		{"not an object", `[]`, 0, true},
+		{"truncated", `{"zone":"gslb.elchi","records":[{"name":"app.gslb.elchi","type":"A"}`, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var snapshot DNSSnapshot
+			count := 0
+			err := decodeSnapshot(strings.NewReader(tt.body), &snapshot, func(DNSRecord) error {
+				count++
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeSnapshot() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if count != tt.wantRecords {
+				t.Errorf("Expected %d records, got %d", tt.wantRecords, count)
+			}
+			if err == nil && (snapshot.Zone != "gslb.elchi" || snapshot.VersionHash != "v1") {
+				t.Errorf("Unexpected snapshot header: %+v", snapshot)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"4096", 4096, false},
+		{"512K", 512 << 10, false},
+		{"64M", 64 << 20, false},
+		{"64mb", 64 << 20, false},
+		{"2G", 2 << 30, false},
+		{"0", 0, true},
+		{"-1M", 0, true},
+		{"M", 0, true},
+		{"1T", 0, true},
+		{"99999999999G", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerformSync_StreamedSnapshotFailover(t *testing.T) {
+	// The first controller breaks off in the middle of the records
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"zone":"gslb.elchi","version_hash":"v1","records":[{"name":"stale.gslb.elchi","type":"A","ips":["192.168.1.99"]},`))
+	}))
+	defer broken.Close()
+
+	records := []DNSRecord{{Name: "app.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}}
+	hash := mustRecordsHash(t, records)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(DNSSnapshot{Zone: "gslb.elchi", VersionHash: hash, Records: records})
+	}))
+	defer healthy.Close()
+
+	e := &Elchi{
+		Zone:       "gslb.elchi.",
+		TTL:        300,
+		cache:      NewRecordCache("gslb.elchi."),
+		client:     NewElchiClient([]string{broken.URL, healthy.URL}, "gslb.elchi.", "test-secret", "", nil, 5*time.Second, nil),
+		syncStatus: &SyncStatus{lastSyncStatus: "initial"},
+	}
+
+	if !e.performSync() {
+		t.Fatal("Expected the sync to succeed from the second controller")
+	}
+	if got := e.cache.GetVersionHash(); got != hash {
+		t.Errorf("Expected version hash %s, got %s", hash, got)
+	}
+	if e.cache.HasName("stale.gslb.elchi.") {
+		t.Error("Expected the records of the broken response to be discarded")
+	}
+	if !e.cache.HasName("app.gslb.elchi.") {
+		t.Error("Expected the records of the second controller to be loaded")
+	}
+}
@@ -0,0 +1,251 @@
+package elchi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// errWatchUnsupported is returned by Watch when no controller endpoint has a
+// /dns/watch endpoint.
+var errWatchUnsupported = errors.New("controller does not support /dns/watch")
+
+// Watch opens a watch on the controller and passes every change it delivers
+// to handle, until the connection ends or ctx is done. The controller either
+// streams Server-Sent Events or answers like a long-poll with a single
+// changes response (or 304 when nothing changed before its own timeout).
+// since is called on every connection attempt, so a reconnect resumes from
+// the version hash loaded last.
+//
+// Endpoints are tried in the order of the controller pool, but watch results
+// are not reported to it: a controller without /dns/watch still serves
+// snapshots, so watch failures must not move the preferred endpoint or open
+// its circuit breaker. If no endpoint has a watch endpoint, errWatchUnsupported
+// is returned.
+func (c *ElchiClient) Watch(ctx context.Context, since func() string, handle func(*DNSChangesResponse)) error {
+	order := c.endpoints.order(time.Now())
+	if len(order) == 0 {
+		return errCircuitOpen
+	}
+
+	unsupported := 0
+	var err error
+	for i, ep := range order {
+		if i > 0 && ctx.Err() != nil {
+			break
+		}
+		err = c.watch(ctx, ep.url, since(), handle)
+		if err == nil {
+			return nil
+		}
+		var se *statusError
+		if errors.As(err, &se) && se.code == http.StatusNotFound {
+			unsupported++
+		}
+		if len(order) > 1 {
+			err = fmt.Errorf("controller %s: %w", ep.url, err)
+		}
+	}
+	if unsupported == len(order) {
+		return errWatchUnsupported
+	}
+	return err
+}
+
+// watch runs one watch request against a single controller endpoint.
+func (c *ElchiClient) watch(ctx context.Context, endpoint, sinceHash string, handle func(*DNSChangesResponse)) error {
+	u, err := url.Parse(fmt.Sprintf("%s/dns/watch", endpoint))
+	if err != nil {
+		return fmt.Errorf("invalid endpoint URL: %w", err)
+	}
+
+	q := u.Query()
+	q.Set("zone", c.zone)
+	q.Set("since", sinceHash)
+	q.Set("delta", "true")
+	c.addNodeIP(q)
+	c.addRegions(q)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	c.signRequest(req)
+	req.Header.Set("Accept", "text/event-stream, "+acceptHeader(c.encoding))
+
+	resp, err := c.watchClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil // Shutting down
+		}
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// Long-poll timed out without changes
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &statusError{code: resp.StatusCode, body: string(body)}
+	}
+
+	// Limits the long-poll response, or each event of a stream
+	body := &sizeLimitReader{r: resp.Body, limit: c.maxSize}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		var changes DNSChangesResponse
+		if err := decodeChanges(resp.Header.Get("Content-Type"), body, &changes); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		if err := changes.validate(); err != nil {
+			return err
+		}
+		if err := c.verifyChanges(&changes); err != nil {
+			return err
+		}
+		handle(&changes)
+		return nil
+	}
+
+	log.Infof("Watching %s for changes", endpoint)
+	err = readEvents(body, func(data string) error {
+		body.reset()
+		var changes DNSChangesResponse
+		if err := json.Unmarshal([]byte(data), &changes); err != nil {
+			return fmt.Errorf("failed to decode event: %w", err)
+		}
+		if err := changes.validate(); err != nil {
+			return err
+		}
+		if err := c.verifyChanges(&changes); err != nil {
+			return err
+		}
+		handle(&changes)
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// readEvents reads a Server-Sent Events stream and calls dispatch with the
+// data of every event. Event names and ids are ignored, as every event
+// carries a complete changes response. It returns nil when the stream ends.
+func readEvents(r io.Reader, dispatch func(data string) error) error {
+	br := bufio.NewReader(r)
+	var data []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("watch stream failed: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if len(data) > 0 {
+				if err := dispatch(strings.Join(data, "\n")); err != nil {
+					return err
+				}
+				data = data[:0]
+			}
+		case strings.HasPrefix(line, ":"):
+			// Comment, used by controllers as keepalive
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			if field == "data" {
+				data = append(data, strings.TrimPrefix(value, " "))
+			}
+		}
+	}
+}
+
+// watchChanges keeps a watch on the controller open until shutdown and
+// applies every change it delivers. Periodic polling keeps running next to
+// it, so changes are still picked up while the watch is down. Failed
+// connections are retried with the same backoff as failed syncs.
+func (e *Elchi) watchChanges() {
+	scheduler := newSyncScheduler(e.SyncInterval)
+	unsupported := false // Logged that the controller has no watch endpoint
+	for {
+		start := time.Now()
+		updates := 0
+		err := e.client.Watch(e.shutdownCtx, e.cache.syncHash, func(changes *DNSChangesResponse) {
+			updates++
+			e.applyWatchUpdate(changes)
+		})
+		if e.shutdownCtx.Err() != nil {
+			return
+		}
+
+		// Reconnect right away after a normal end, unless the controller
+		// closes the connection without sending anything
+		if err == nil && (updates > 0 || time.Since(start) >= retryBaseDelay) {
+			scheduler.reset()
+			unsupported = false
+			continue
+		}
+
+		delay := scheduler.next(false)
+		if errors.Is(err, errWatchUnsupported) {
+			// Not an outage, check again at the polling pace in case the
+			// controller is upgraded
+			if !unsupported {
+				log.Infof("Controller does not support /dns/watch, falling back to polling every %v", e.SyncInterval)
+			}
+			unsupported = true
+			scheduler.reset()
+			delay = e.SyncInterval
+		} else if err != nil {
+			unsupported = false
+			log.Warningf("Watch failed: %v (polling continues)", err)
+		}
+
+		select {
+		case <-e.shutdownCtx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// applyWatchUpdate loads a change delivered by the watch.
+func (e *Elchi) applyWatchUpdate(changes *DNSChangesResponse) {
+	if changes.Unchanged || changes.VersionHash == e.cache.GetVersionHash() || changes.VersionHash == e.cache.syncHash() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(e.shutdownCtx, e.client.syncTimeout())
+	defer cancel()
+	if err := e.loadChanges(ctx, changes); err != nil {
+		log.Errorf("Failed to load watched changes: %v", err)
+		e.countSyncError("watch", err)
+		e.syncStatus.Update("failed", err)
+		return
+	}
+
+	log.Infof("Watch update loaded: %d records, hash=%s",
+		len(changes.Records), changes.VersionHash)
+	watchUpdates.WithLabelValues(e.Zone).Inc()
+	e.syncStatus.Update("success", nil)
+}
@@ -0,0 +1,206 @@
+package elchi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadEvents(t *testing.T) {
+	stream := ": keepalive\n\n" +
+		"event: changes\nid: v1\ndata: {\"a\":\ndata: 1}\n\n" +
+		"data:{\"b\":2}\r\n\r\n" +
+		"data: {\"incomplete\":true}\n"
+
+	var got []string
+	err := readEvents(strings.NewReader(stream), func(data string) error {
+		got = append(got, data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readEvents failed: %v", err)
+	}
+	want := []string{"{\"a\":\n1}", "{\"b\":2}"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected events %q, got %q", want, got)
+	}
+}
+
+func TestWatch_EventStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns/watch" {
+			t.Errorf("Expected path /dns/watch, got %s", r.URL.Path)
+		}
+		if since := r.URL.Query().Get("since"); since != "v1" {
+			t.Errorf("Expected since v1, got %s", since)
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			t.Errorf("Expected event stream to be accepted, got %s", r.Header.Get("Accept"))
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, hash := range []string{"v2", "v3"} {
+			data, _ := json.Marshal(DNSChangesResponse{Zone: "gslb.elchi", VersionHash: hash})
+			fmt.Fprintf(w, "event: changes\ndata: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	var hashes []string
+	err := client.Watch(context.Background(), func() string { return "v1" }, func(changes *DNSChangesResponse) {
+		hashes = append(hashes, changes.VersionHash)
+	})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if len(hashes) != 2 || hashes[0] != "v2" || hashes[1] != "v3" {
+		t.Errorf("Expected [v2 v3], got %v", hashes)
+	}
+}
+
+func TestWatch_LongPoll(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("since") == "v2" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(DNSChangesResponse{Zone: "gslb.elchi", VersionHash: "v2"})
+	}))
+	defer server.Close()
+
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	var hashes []string
+	handle := func(changes *DNSChangesResponse) {
+		hashes = append(hashes, changes.VersionHash)
+	}
+	if err := client.Watch(context.Background(), func() string { return "v1" }, handle); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	// A long-poll that timed out without changes is not an error
+	if err := client.Watch(context.Background(), func() string { return "v2" }, handle); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if len(hashes) != 1 || hashes[0] != "v2" {
+		t.Errorf("Expected [v2], got %v", hashes)
+	}
+}
+
+func TestWatch_Unsupported(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	client := NewElchiClient([]string{server.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	err := client.Watch(context.Background(), func() string { return "v1" }, func(*DNSChangesResponse) {
+		t.Error("Expected no changes from a failed watch")
+	})
+	if !errors.Is(err, errWatchUnsupported) {
+		t.Errorf("Expected errWatchUnsupported, got %v", err)
+	}
+	if failures := client.endpoints.endpoints[0].failures; failures != 0 {
+		t.Errorf("Expected the endpoint not to be penalized, got %d failures", failures)
+	}
+}
+
+func TestWatch_FailuresDoNotAffectPool(t *testing.T) {
+	// The preferred controller serves snapshots but fails every watch
+	preferred := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer preferred.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(DNSChangesResponse{Zone: "gslb.elchi", VersionHash: "v2"})
+	}))
+	defer other.Close()
+
+	client := NewElchiClient([]string{preferred.URL, other.URL}, "gslb.elchi", "test-secret", "", nil, 5*time.Second, nil)
+	for range breakerThreshold {
+		var hashes []string
+		err := client.Watch(context.Background(), func() string { return "v1" }, func(changes *DNSChangesResponse) {
+			hashes = append(hashes, changes.VersionHash)
+		})
+		if err != nil || len(hashes) != 1 {
+			t.Fatalf("Expected the watch to fall back to the other controller, got %v, %v", hashes, err)
+		}
+	}
+
+	if active := client.endpoints.active(); active != preferred.URL {
+		t.Errorf("Expected the preferred controller to stay %s, got %s", preferred.URL, active)
+	}
+	if order := client.endpoints.order(time.Now()); len(order) != 2 {
+		t.Errorf("Expected no circuit breaker to open, got %d usable endpoints", len(order))
+	}
+}
+
+func TestWatchChanges_ResumesFromLastHash(t *testing.T) {
+	sinces := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since := r.URL.Query().Get("since")
+		sinces <- since
+
+		// Every connection delivers the next version, then drops
+		next := map[string]string{"v1": "v2", "v2": "v3"}[since]
+		if next == "" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		data, _ := json.Marshal(DNSChangesResponse{
+			Zone:        "gslb.elchi",
+			VersionHash: next,
+			Records:     []DNSRecord{{Name: next + ".gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}))
+	defer server.Close()
+
+	e := &Elchi{Zone: "gslb.elchi.", TTL: 300, SyncInterval: time.Minute}
+	e.client = NewElchiClient([]string{server.URL}, e.Zone, "test-secret", "", nil, 5*time.Second, nil)
+	e.cache = NewRecordCache(e.Zone)
+	e.syncStatus = &SyncStatus{}
+	if err := e.cache.ReplaceFromSnapshot(&DNSSnapshot{Zone: "gslb.elchi.", VersionHash: "v1"}, 300); err != nil {
+		t.Fatal(err)
+	}
+	e.shutdownCtx, e.shutdownCancel = context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		e.watchChanges()
+		close(done)
+	}()
+
+	for _, want := range []string{"v1", "v2", "v3"} {
+		select {
+		case got := <-sinces:
+			if got != want {
+				t.Fatalf("Expected watch since %s, got %s", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for watch since %s", want)
+		}
+	}
+	if hash := e.cache.GetVersionHash(); hash != "v3" {
+		t.Errorf("Expected hash v3, got %s", hash)
+	}
+	if rrs := e.cache.Get("v3.gslb.elchi.", dns.TypeA); len(rrs) != 1 {
+		t.Errorf("Expected the watched record, got %v", rrs)
+	}
+
+	e.shutdownCancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchChanges did not stop on shutdown")
+	}
+}
@@ -3,8 +3,8 @@ package elchi
 import (
 	"bytes"
 	"context"
-	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -58,18 +58,26 @@ func (s *SyncStatus) Get() (time.Time, string, string) {
 
 // WebhookServer manages the HTTP server for webhook endpoints.
 type WebhookServer struct {
-	elchi  *Elchi
-	server *http.Server
-	mux    *http.ServeMux
+	elchi    *Elchi
+	server   *http.Server
+	mux      *http.ServeMux
+	verifier *requestVerifier
 }
 
 // NewWebhookServer creates a new webhook server.
 func NewWebhookServer(elchi *Elchi, addr string) *WebhookServer {
 	mux := http.NewServeMux()
 
+	// Set by InitClient, servers created without it accept the shared secret
+	secrets := elchi.webhookSecrets
+	if secrets == nil {
+		secrets = newSecretSource(elchi.Secret)
+	}
+
 	ws := &WebhookServer{
-		elchi: elchi,
-		mux:   mux,
+		elchi:    elchi,
+		mux:      mux,
+		verifier: newRequestVerifier(elchi.AuthMode, secrets, elchi.AuthSkew),
 		server: &http.Server{
 			Addr:         addr,
 			Handler:      mux,
@@ -82,6 +90,8 @@ func NewWebhookServer(elchi *Elchi, addr string) *WebhookServer {
 	mux.HandleFunc("/notify", ws.authMiddleware(ws.handleNotify))
 	mux.HandleFunc("/health", ws.handleHealth)
 	mux.HandleFunc("/records", ws.authMiddleware(ws.handleRecords))
+	mux.HandleFunc("/quarantine", ws.authMiddleware(ws.handleQuarantine))
+	mux.HandleFunc("/quarantine/apply", ws.authMiddleware(ws.handleQuarantineApply))
 
 	return ws
 }
@@ -102,14 +112,12 @@ func (ws *WebhookServer) Stop(ctx context.Context) error {
 	return ws.server.Shutdown(ctx)
 }
 
-// to prevent timing attacks.
+// authMiddleware rejects requests that fail authentication (see
+// requestVerifier).
 func (ws *WebhookServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		secret := r.Header.Get("X-Elchi-Secret")
-
-		// Use constant-time comparison to prevent timing attacks
-		// subtle.ConstantTimeCompare returns 1 if equal, 0 otherwise
-		if subtle.ConstantTimeCompare([]byte(secret), []byte(ws.elchi.Secret)) != 1 {
+		if err := ws.verifier.verify(r, time.Now()); err != nil {
+			log.Debugf("Rejected webhook request to %s: %v", r.URL.Path, err)
 			// Track unauthorized webhook request
 			endpoint := strings.TrimPrefix(r.URL.Path, "/")
 			webhookRequests.WithLabelValues(endpoint, "unauthorized").Inc()
@@ -123,8 +131,10 @@ func (ws *WebhookServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 
 // NotifyRequest represents the POST /notify request body.
 type NotifyRequest struct {
-	Records []DNSRecord    `json:"records,omitempty"`
-	Deletes []DeleteRecord `json:"deletes,omitempty"`
+	Records   []DNSRecord    `json:"records,omitempty"`
+	Deletes   []DeleteRecord `json:"deletes,omitempty"`
+	Signature string         `json:"signature,omitempty"` // Base64 Ed25519 signature of the controller (see trusted_keys)
+	Timestamp int64          `json:"timestamp,omitempty"` // Unix time in seconds the request was signed at (see trusted_keys)
 }
 
 // NotifyResponse represents the POST /notify response.
@@ -142,12 +152,28 @@ func (ws *WebhookServer) handleNotify(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req NotifyRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := decodeNotify(r.Header.Get("Content-Type"), r.Body, &req); err != nil {
 		webhookRequests.WithLabelValues("notify", "error").Inc()
 		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
+	// With trusted keys, only records signed by the controller are applied,
+	// each signed request once
+	now := time.Now()
+	err := trustedKeys(ws.elchi.TrustedKeys).verifyNotify(ws.elchi.Zone, &req, now, ws.verifier.skew)
+	if err == nil && len(ws.elchi.TrustedKeys) > 0 &&
+		!ws.verifier.claimNonce("notify "+req.Signature, time.Unix(req.Timestamp, 0).Add(ws.verifier.skew), now) {
+		err = fmt.Errorf("%w: replayed notify request", errBadSignature)
+	}
+	if err != nil {
+		log.Warningf("Rejected notify request: %v", err)
+		signatureErrors.WithLabelValues(ws.elchi.Zone, "notify").Inc()
+		webhookRequests.WithLabelValues("notify", "unauthorized").Inc()
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
 	updated := 0
 	deleted := 0
 
@@ -184,18 +210,34 @@ func (ws *WebhookServer) handleNotify(w http.ResponseWriter, r *http.Request) {
 		Updated: updated,
 		Deleted: deleted,
 	}
+	if acceptsProtobuf(r.Header.Get("Accept")) {
+		data, err := resp.marshalProto()
+		if err != nil {
+			log.Errorf("Failed to encode response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", protobufMediaType)
+		if _, err := w.Write(data); err != nil {
+			log.Errorf("Failed to write response: %v", err)
+		}
+		return
+	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
 // HealthResponse represents the GET /health response.
 type HealthResponse struct {
-	Status         string `json:"status"`
-	Zone           string `json:"zone"`
-	RecordsCount   int    `json:"records_count"`
-	VersionHash    string `json:"version_hash"`
-	LastSync       string `json:"last_sync"`
-	LastSyncStatus string `json:"last_sync_status"`
-	Error          string `json:"error,omitempty"`
+	Status         string   `json:"status"`
+	Zone           string   `json:"zone"`
+	RecordsCount   int      `json:"records_count"`
+	VersionHash    string   `json:"version_hash"`
+	LastSync       string   `json:"last_sync"`
+	LastSyncStatus string   `json:"last_sync_status"`
+	Controller     string   `json:"controller,omitempty"`  // Controller endpoint currently used for syncs
+	FailedOver     []string `json:"failed_over,omitempty"` // Records failed over by local health checks
+	Quarantined    string   `json:"quarantined,omitempty"` // Version hash of a snapshot quarantined by the guard
+	Error          string   `json:"error,omitempty"`
 }
 
 // handleHealth handles GET /health endpoint.
@@ -213,6 +255,11 @@ func (ws *WebhookServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 		VersionHash:    ws.elchi.cache.GetVersionHash(),
 		LastSync:       lastSync.Format(time.RFC3339),
 		LastSyncStatus: syncStatus,
+		Controller:     ws.elchi.client.activeEndpoint(),
+		FailedOver:     ws.elchi.healthChecker.failedOver(),
+	}
+	if q, ok := ws.elchi.cache.quarantined(); ok {
+		resp.Quarantined = q.versionHash
 	}
 
 	// Determine overall health status
@@ -232,10 +279,21 @@ func (ws *WebhookServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // RecordsResponse represents the GET /records response.
 type RecordsResponse struct {
-	Zone        string      `json:"zone"`
-	VersionHash string      `json:"version_hash"`
-	Count       int         `json:"count"`
-	Records     []DNSRecord `json:"records"`
+	Zone        string           `json:"zone"`
+	VersionHash string           `json:"version_hash"`
+	Count       int              `json:"count"`
+	Records     []DNSRecord      `json:"records"`
+	Suppressed  []SuppressedName `json:"suppressed,omitempty"` // Names whose changes are held back by dampening
+}
+
+// SuppressedName describes a name whose changes are held back by flap
+// dampening. Its records show the last ones before the suppression.
+type SuppressedName struct {
+	Name    string `json:"name"`
+	Penalty int    `json:"penalty"`
+	Changes int    `json:"changes"` // Changes since the name is tracked
+	Since   string `json:"since"`
+	Until   string `json:"until"` // Release if the name does not change again
 }
 
 // handleRecords handles GET /records endpoint.
@@ -277,5 +335,103 @@ func (ws *WebhookServer) handleRecords(w http.ResponseWriter, r *http.Request) {
 		Count:       len(filteredRecords),
 		Records:     filteredRecords,
 	}
+	for _, name := range ws.elchi.cache.suppressed() {
+		if nameFilter != "" && !strings.Contains(name.name, nameFilter) {
+			continue
+		}
+		resp.Suppressed = append(resp.Suppressed, SuppressedName{
+			Name:    strings.TrimSuffix(name.name, "."),
+			Penalty: int(name.penalty),
+			Changes: name.changes,
+			Since:   name.since.Format(time.RFC3339),
+			Until:   name.until.Format(time.RFC3339),
+		})
+	}
 	writeJSON(w, http.StatusOK, resp)
 }
+
+// QuarantineResponse represents the GET /quarantine response.
+type QuarantineResponse struct {
+	Quarantined  bool        `json:"quarantined"`
+	CurrentHash  string      `json:"current_hash"`            // Version hash of the records in use
+	VersionHash  string      `json:"version_hash,omitempty"`  // Version hash of the quarantined snapshot
+	Limit        string      `json:"limit,omitempty"`         // Guard limit the snapshot exceeded
+	Reason       string      `json:"reason,omitempty"`        // How far it exceeded the limit
+	Since        string      `json:"since,omitempty"`         // First rejection of this version
+	Rejections   int         `json:"rejections,omitempty"`    // Syncs that received this version
+	RemovedNames []string    `json:"removed_names,omitempty"` // Names in use that the snapshot does not have
+	Count        int         `json:"count"`
+	Records      []DNSRecord `json:"records,omitempty"`
+}
+
+// handleQuarantine handles GET /quarantine endpoint.
+func (ws *WebhookServer) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := QuarantineResponse{CurrentHash: ws.elchi.cache.GetVersionHash()}
+	if q, ok := ws.elchi.cache.quarantined(); ok {
+		resp.Quarantined = true
+		resp.VersionHash = q.versionHash
+		resp.Limit = q.limit
+		resp.Reason = q.reason
+		resp.Since = q.since.Format(time.RFC3339)
+		resp.Rejections = q.rejections
+		resp.RemovedNames = q.removedNames
+		resp.Count = len(q.records)
+		resp.Records = q.records
+	}
+
+	webhookRequests.WithLabelValues("quarantine", "success").Inc()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// QuarantineApplyResponse represents the POST /quarantine/apply response.
+type QuarantineApplyResponse struct {
+	Status       string `json:"status"`
+	VersionHash  string `json:"version_hash"`
+	RecordsCount int    `json:"records_count"`
+}
+
+// handleQuarantineApply handles POST /quarantine/apply?version_hash=HASH
+// endpoint. It force-applies the quarantined snapshot with that version hash.
+func (ws *WebhookServer) handleQuarantineApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	versionHash := r.URL.Query().Get("version_hash")
+	if versionHash == "" {
+		webhookRequests.WithLabelValues("quarantine", "error").Inc()
+		http.Error(w, "Missing version_hash parameter", http.StatusBadRequest)
+		return
+	}
+
+	count, err := ws.elchi.cache.ApplyQuarantined(versionHash)
+	switch {
+	case errors.Is(err, errNoQuarantine):
+		webhookRequests.WithLabelValues("quarantine", "error").Inc()
+		http.Error(w, "No snapshot in quarantine", http.StatusNotFound)
+		return
+	case errors.Is(err, errQuarantineChanged):
+		webhookRequests.WithLabelValues("quarantine", "error").Inc()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Errorf("Failed to apply quarantined snapshot: %v", err)
+		webhookRequests.WithLabelValues("quarantine", "error").Inc()
+		http.Error(w, "Failed to apply quarantined snapshot", http.StatusInternalServerError)
+		return
+	}
+	ws.elchi.persistCache()
+
+	webhookRequests.WithLabelValues("quarantine", "success").Inc()
+	writeJSON(w, http.StatusOK, QuarantineApplyResponse{
+		Status:       "applied",
+		VersionHash:  versionHash,
+		RecordsCount: count,
+	})
+}
@@ -3,6 +3,7 @@ package elchi
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -166,6 +167,53 @@ func TestHandleNotify_Unauthorized(t *testing.T) {
 	}
 }
 
+func TestHandleNotify_Signed(t *testing.T) {
+	e := &Elchi{
+		Zone:     "gslb.elchi.",
+		Secret:   "test-secret",
+		TTL:      300,
+		AuthMode: authHMAC,
+	}
+	e.cache = NewRecordCache("gslb.elchi.")
+	e.syncStatus = &SyncStatus{lastSyncStatus: "initial"}
+
+	ws := NewWebhookServer(e, ":8053")
+	handler := ws.authMiddleware(ws.handleNotify)
+
+	body, _ := json.Marshal(NotifyRequest{
+		Records: []DNSRecord{{Name: "test.gslb.elchi", Type: "A", IPs: []string{"192.168.1.10"}}},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/notify", bytes.NewReader(body))
+	signRequestHMAC(req, "test-secret", body, time.Now())
+	replay := req.Clone(req.Context())
+	replay.Body = io.NopCloser(bytes.NewReader(body))
+
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if e.cache.RRCount() != 1 {
+		t.Errorf("Expected the signed update to be applied, got %d RRs", e.cache.RRCount())
+	}
+
+	// A captured request cannot be sent again
+	rr = httptest.NewRecorder()
+	handler(rr, replay)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a replay, got %d", rr.Code)
+	}
+
+	// The legacy header is not enough in hmac mode
+	req = httptest.NewRequest(http.MethodPost, "/notify", bytes.NewReader(body))
+	req.Header.Set("X-Elchi-Secret", "test-secret")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for the legacy header, got %d", rr.Code)
+	}
+}
+
 func TestHandleHealth_Healthy(t *testing.T) {
 	e := &Elchi{
 		Zone:         "gslb.elchi.",